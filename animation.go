@@ -0,0 +1,473 @@
+package minicap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+var ErrAnimationTooLarge = errors.New("animation does not fit in MaxBytes")
+
+// AnimationOptions of WriteAnimation
+type AnimationOptions struct {
+	Format   ImageFormat   // FormatGIF, or FormatPNG for APNG. GIF by default
+	MaxSide  int           // frames are shrunk to fit in MaxSide x MaxSide, 480 by default
+	Colors   int           // size of the palette shared by the frames, at most and by default 256
+	Hold     time.Duration // how long the last frame shows, 1s by default
+	MaxBytes int64         // frames are shrunk further to fit in MaxBytes, 0 for no limit
+}
+
+const (
+	minAnimationSide  = 32
+	minAnimationDelay = 2 // in 1/100 s, browsers slow down shorter GIF delays
+)
+
+// WriteAnimation writes frames, ordered by time, as an animated GIF or APNG
+// that loops forever. Frames show until the time of the next one, the frames
+// of a burst closer than 20ms are merged. Every frame is quantized with the
+// same palette, so colors do not flicker, and only the changed region of a
+// frame is stored.
+func WriteAnimation(w io.Writer, frames []*Frame, opt AnimationOptions) (err error) {
+	if opt.Format == "" {
+		opt.Format = FormatGIF
+	}
+	if opt.Format != FormatGIF && opt.Format != FormatPNG {
+		return errors.New("animations are GIF or PNG")
+	}
+	if opt.MaxSide <= 0 {
+		opt.MaxSide = 480
+	}
+	if opt.Colors <= 0 || opt.Colors > 256 {
+		opt.Colors = 256
+	}
+	if opt.Hold <= 0 {
+		opt.Hold = time.Second
+	}
+	if len(frames) == 0 {
+		return errors.New("no frames to animate")
+	}
+	shown, delays := animationTiming(frames, opt.Hold)
+	side := opt.MaxSide
+	for attempt := 0; ; attempt++ {
+		var buf bytes.Buffer
+		if err = encodeAnimation(&buf, shown, delays, side, opt); err != nil {
+			return
+		}
+		if opt.MaxBytes <= 0 || int64(buf.Len()) <= opt.MaxBytes {
+			_, err = w.Write(buf.Bytes())
+			return
+		}
+		// the size goes roughly with the area of the frames
+		next := int(float64(side) * math.Sqrt(float64(opt.MaxBytes)/float64(buf.Len())) * 0.95)
+		if next >= side {
+			next = side - 1
+		}
+		if next < minAnimationSide || attempt == 4 {
+			return ErrAnimationTooLarge
+		}
+		side = next
+	}
+}
+
+// animationTiming returns the frames to show and their delays in 1/100 s,
+// a frame closer than minAnimationDelay to the previous one replaces it
+func animationTiming(frames []*Frame, hold time.Duration) (shown []*Frame, delays []int) {
+	start := frames[0].Time
+	var starts []int // of the shown frames, in 1/100 s
+	for _, f := range frames {
+		cs := int((f.Time.Sub(start) + 5*time.Millisecond) / (10 * time.Millisecond))
+		if n := len(shown); n > 0 && cs-starts[n-1] < minAnimationDelay {
+			shown[n-1] = f
+			continue
+		}
+		shown = append(shown, f)
+		starts = append(starts, cs)
+	}
+	for i := 1; i < len(starts); i++ {
+		delays = append(delays, starts[i]-starts[i-1])
+	}
+	delays = append(delays, maxInt(minAnimationDelay, int(hold/(10*time.Millisecond))))
+	return
+}
+
+// encodeAnimation writes frames shrunk to fit in side x side
+func encodeAnimation(w io.Writer, frames []*Frame, delays []int, side int, opt AnimationOptions) (err error) {
+	size, err := frameImageSize(frames[0])
+	if err != nil {
+		return
+	}
+	canvas := fitSize(size, image.Pt(side, side))
+
+	// 15 bit colors of the frames, and how often they are used
+	var hist [1 << 15]uint32
+	keys := make([][]uint16, len(frames))
+	for i, f := range frames {
+		var im *image.RGBA
+		if im, err = animationImage(f, canvas); err != nil {
+			return
+		}
+		k := make([]uint16, len(im.Pix)/4)
+		for j := range k {
+			p := im.Pix[j*4 : j*4+3]
+			k[j] = uint16(p[0]>>3)<<10 | uint16(p[1]>>3)<<5 | uint16(p[2]>>3)
+			hist[k[j]]++
+		}
+		keys[i] = k
+	}
+	pal := medianCut(&hist, opt.Colors)
+
+	var (
+		index  [1 << 15]int16 // palette index + 1 of a 15 bit color, 0 until needed
+		images []*image.Paletted
+		shown  []int // delays of images
+		prev   *image.Paletted
+	)
+	for i, k := range keys {
+		pm := image.NewPaletted(image.Rectangle{Max: canvas}, pal)
+		for j, key := range k {
+			if index[key] == 0 {
+				index[key] = int16(pal.Index(color15(key))) + 1
+			}
+			pm.Pix[j] = uint8(index[key] - 1)
+		}
+		keys[i] = nil
+		if prev == nil {
+			images = append(images, pm)
+			shown = append(shown, delays[i])
+			prev = pm
+			continue
+		}
+		changed := changedRect(prev, pm)
+		prev = pm
+		if changed.Empty() {
+			shown[len(shown)-1] += delays[i]
+			continue
+		}
+		images = append(images, pm.SubImage(changed).(*image.Paletted))
+		shown = append(shown, delays[i])
+	}
+
+	if opt.Format == FormatPNG {
+		return writeAPNG(w, images, shown, canvas)
+	}
+	disposal := make([]byte, len(images))
+	for i := range disposal {
+		disposal[i] = gif.DisposalNone
+	}
+	return gif.EncodeAll(w, &gif.GIF{
+		Image:    images,
+		Delay:    shown,
+		Disposal: disposal,
+		Config:   image.Config{ColorModel: pal, Width: canvas.X, Height: canvas.Y},
+	})
+}
+
+// frameImageSize returns the size of the image of f, decoded or not
+func frameImageSize(f *Frame) (image.Point, error) {
+	if f.Image != nil {
+		return f.Image.Bounds().Size(), nil
+	}
+	return f.Size()
+}
+
+// fitSize shrinks size to fit in max keeping its aspect ratio, sizes that fit are kept
+func fitSize(size, max image.Point) image.Point {
+	if size.X <= max.X && size.Y <= max.Y {
+		return size
+	}
+	scale := math.Min(float64(max.X)/float64(size.X), float64(max.Y)/float64(size.Y))
+	return image.Pt(maxInt(1, int(float64(size.X)*scale+0.5)), maxInt(1, int(float64(size.Y)*scale+0.5)))
+}
+
+// animationImage decodes f into an image of size canvas. Frames of another
+// aspect ratio, after a rotation, are centered on black.
+func animationImage(f *Frame, canvas image.Point) (*image.RGBA, error) {
+	size, err := frameImageSize(f)
+	if err != nil {
+		return nil, err
+	}
+	fit := fitSize(size, canvas)
+	im, err := f.DecodeScaled(minInt(size.X/fit.X, size.Y/fit.Y))
+	if err != nil {
+		return nil, err
+	}
+	scaled := resizeImage(im, fit.X, fit.Y)
+	if fit == canvas {
+		return scaled, nil
+	}
+	dst := image.NewRGBA(image.Rectangle{Max: canvas})
+	for i := 3; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = 0xff
+	}
+	off := canvas.Sub(fit).Div(2)
+	for y := 0; y < fit.Y; y++ {
+		copy(dst.Pix[dst.PixOffset(off.X, off.Y+y):], scaled.Pix[y*scaled.Stride:y*scaled.Stride+fit.X*4])
+	}
+	return dst, nil
+}
+
+func color15(key uint16) color.RGBA {
+	c := func(v uint16) uint8 { return uint8(v&31)<<3 | 4 } // center of the bucket
+	return color.RGBA{c(key >> 10), c(key >> 5), c(key), 0xff}
+}
+
+// colorBox is a set of 15 bit colors for medianCut
+type colorBox struct {
+	keys  []uint16
+	count uint64
+}
+
+// medianCut builds a palette of at most n colors for the histogram hist:
+// the box of colors with the most pixels is split along its widest channel
+// until there are n boxes, every box gives its average color
+func medianCut(hist *[1 << 15]uint32, n int) color.Palette {
+	all := colorBox{}
+	for key, count := range hist {
+		if count > 0 {
+			all.keys = append(all.keys, uint16(key))
+			all.count += uint64(count)
+		}
+	}
+	boxes := []colorBox{all}
+	for len(boxes) < n {
+		// the most used box that can still be split
+		best := -1
+		for i, b := range boxes {
+			if len(b.keys) > 1 && (best < 0 || b.count > boxes[best].count) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		b := boxes[best]
+		shift := widestChannel(b.keys)
+		sort.Slice(b.keys, func(i, j int) bool { return b.keys[i]>>shift&31 < b.keys[j]>>shift&31 })
+		// split at the median pixel, leaving at least one color on each side
+		var sum uint64
+		cut := 1
+		for i, key := range b.keys[:len(b.keys)-1] {
+			sum += uint64(hist[key])
+			cut = i + 1
+			if sum*2 >= b.count {
+				break
+			}
+		}
+		lo := colorBox{keys: b.keys[:cut:cut], count: sum}
+		hi := colorBox{keys: b.keys[cut:], count: b.count - sum}
+		boxes[best] = lo
+		boxes = append(boxes, hi)
+	}
+	pal := make(color.Palette, 0, len(boxes))
+	for _, b := range boxes {
+		var r, g, bl, total uint64
+		for _, key := range b.keys {
+			c, count := color15(key), uint64(hist[key])
+			r += uint64(c.R) * count
+			g += uint64(c.G) * count
+			bl += uint64(c.B) * count
+			total += count
+		}
+		if total == 0 {
+			pal = append(pal, color.RGBA{A: 0xff})
+			continue
+		}
+		pal = append(pal, color.RGBA{uint8(r / total), uint8(g / total), uint8(bl / total), 0xff})
+	}
+	return pal
+}
+
+// widestChannel returns the shift of the channel of keys with the largest range
+func widestChannel(keys []uint16) uint {
+	var best, bestRange uint16
+	for _, shift := range []uint16{10, 5, 0} {
+		lo, hi := uint16(31), uint16(0)
+		for _, key := range keys {
+			v := key >> shift & 31
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo >= bestRange {
+			best, bestRange = shift, hi-lo
+		}
+	}
+	return uint(best)
+}
+
+// changedRect returns the bounds of the pixels that differ between a and b
+func changedRect(a, b *image.Paletted) (r image.Rectangle) {
+	w, h := b.Rect.Dx(), b.Rect.Dy()
+	for y := 0; y < h; y++ {
+		ra, rb := a.Pix[y*a.Stride:y*a.Stride+w], b.Pix[y*b.Stride:y*b.Stride+w]
+		if bytes.Equal(ra, rb) {
+			continue
+		}
+		x0, x1 := 0, w
+		for ra[x0] == rb[x0] {
+			x0++
+		}
+		for ra[x1-1] == rb[x1-1] {
+			x1--
+		}
+		r = r.Union(image.Rect(x0, y, x1, y+1))
+	}
+	return
+}
+
+// writeAPNG writes images as the frames of an animated PNG, the first image
+// is the whole canvas and the default image. delays are in 1/100 s.
+func writeAPNG(w io.Writer, images []*image.Paletted, delays []int, canvas image.Point) error {
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	var out bytes.Buffer
+	out.WriteString(pngHeader)
+	seq := uint32(0)
+	for i, im := range images {
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, im); err != nil {
+			return err
+		}
+		b := im.Bounds()
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+		binary.BigEndian.PutUint32(fctl[12:], uint32(b.Min.X))
+		binary.BigEndian.PutUint32(fctl[16:], uint32(b.Min.Y))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(minInt(delays[i], math.MaxUint16)))
+		binary.BigEndian.PutUint16(fctl[22:], 100)
+		// dispose and blend ops are 0: keep the canvas, replace the pixels
+		seq++
+
+		wroteFCTL := false
+		data := buf.Bytes()[len(pngHeader):]
+		for len(data) >= 12 {
+			size := binary.BigEndian.Uint32(data)
+			typ, chunk := string(data[4:8]), data[8:8+size]
+			data = data[12+size:]
+			switch {
+			case typ == "IEND":
+			case typ == "IDAT" && i == 0:
+				if !wroteFCTL {
+					writePNGChunk(&out, "fcTL", fctl)
+					wroteFCTL = true
+				}
+				writePNGChunk(&out, typ, chunk)
+			case typ == "IDAT":
+				if !wroteFCTL {
+					writePNGChunk(&out, "fcTL", fctl)
+					wroteFCTL = true
+				}
+				fdat := make([]byte, 4+len(chunk))
+				binary.BigEndian.PutUint32(fdat, seq)
+				copy(fdat[4:], chunk)
+				writePNGChunk(&out, "fdAT", fdat)
+				seq++
+			case i == 0:
+				writePNGChunk(&out, typ, chunk)
+				if typ == "IHDR" {
+					actl := make([]byte, 8)
+					binary.BigEndian.PutUint32(actl, uint32(len(images)))
+					writePNGChunk(&out, "acTL", actl) // plays forever
+				}
+			}
+		}
+	}
+	writePNGChunk(&out, "IEND", nil)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// CollectFrames returns the frames src sends during d, starting with the
+// frame shown when it is called if src has a LastFrame method. Frames hold a
+// reference, see Frame.Release.
+func CollectFrames(ctx context.Context, src FrameSource, d time.Duration) (frames []*Frame, err error) {
+	sub := src.Subscribe(16)
+	defer sub.Close()
+	start := time.Now()
+	if ls, ok := src.(interface{ LastFrame() *Frame }); ok {
+		if f := ls.LastFrame(); f != nil {
+			// shown from the start of the window
+			first := *f
+			if first.Time.Before(start) {
+				first.Time = start
+			}
+			frames = append(frames, &first)
+		}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case f, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			frames = append(frames, f)
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			for _, f := range frames {
+				f.Release()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// SessionFrames returns the frames of a session file shown between the
+// offsets from and to, the frame shown at from starts the list
+func SessionFrames(r io.Reader, from, to time.Duration) (frames []*Frame, err error) {
+	sr, err := NewSessionReader(r)
+	if err != nil {
+		return
+	}
+	var (
+		orientation int
+		shown       *Frame // at from
+	)
+	for {
+		rec, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec.Offset > to {
+			break
+		}
+		switch rec.Type {
+		case SessionOrientation:
+			orientation = rec.Orientation
+		case SessionFrame:
+			f := &Frame{Data: rec.Data, Time: sr.Start.Add(rec.Offset), Orientation: orientation}
+			if rec.Offset <= from {
+				f.Time = sr.Start.Add(from)
+				shown = f
+				continue
+			}
+			if shown != nil {
+				frames = append(frames, shown)
+				shown = nil
+			}
+			frames = append(frames, f)
+		}
+	}
+	if shown != nil {
+		frames = append(frames, shown)
+	}
+	return frames, nil
+}
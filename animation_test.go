@@ -0,0 +1,169 @@
+package minicap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// animationFrames returns 200x100 gray frames with a white box moving right,
+// at the offsets in ms
+func animationFrames(t *testing.T, offsets ...int) (frames []*Frame) {
+	start := time.Now()
+	for i, ms := range offsets {
+		f := testFrame(t, grayImage(200, 100, 60, image.Rect(i*40, 0, i*40+40, 40), 250))
+		f.Time = start.Add(time.Duration(ms) * time.Millisecond)
+		frames = append(frames, f)
+	}
+	return
+}
+
+// apngChunks returns the types of the chunks of an APNG and its fcTL chunks
+func apngChunks(data []byte) (types []string, fctls [][]byte) {
+	for data = data[8:]; len(data) >= 12; {
+		size := binary.BigEndian.Uint32(data)
+		typ := string(data[4:8])
+		types = append(types, typ)
+		if typ == "fcTL" {
+			fctls = append(fctls, data[8:8+size])
+		}
+		data = data[12+size:]
+	}
+	return
+}
+
+func TestWriteAnimationGIF(t *testing.T) {
+	assert := assert.New(t)
+	// the frame at 105ms replaces the one at 100ms
+	frames := animationFrames(t, 0, 100, 105, 300)
+	var buf bytes.Buffer
+	err := WriteAnimation(&buf, frames, AnimationOptions{MaxSide: 100, Colors: 16, Hold: 200 * time.Millisecond})
+	assert.Nil(err)
+
+	g, err := gif.DecodeAll(&buf)
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(100, g.Config.Width)
+	assert.Equal(50, g.Config.Height)
+	assert.Equal([]int{10, 20, 20}, g.Delay)
+	assert.Len(g.Image, 3)
+	assert.Equal(image.Rect(0, 0, 100, 50), g.Image[0].Bounds())
+	// only the rows of the moving box are stored
+	assert.True(g.Image[1].Bounds().Dy() < 50)
+	palette := g.Config.ColorModel.(color.Palette)
+	assert.True(len(palette) <= 16)
+	for _, im := range g.Image {
+		assert.Equal(palette, im.Palette, "the palette is shared")
+	}
+}
+
+func TestWriteAnimationAPNG(t *testing.T) {
+	assert := assert.New(t)
+	frames := animationFrames(t, 0, 50, 150)
+	var buf bytes.Buffer
+	assert.Nil(WriteAnimation(&buf, frames, AnimationOptions{Format: FormatPNG, MaxSide: 100}))
+
+	// decoders without APNG support show the first frame
+	im, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if !assert.Nil(err) {
+		return
+	}
+	assert.Equal(image.Pt(100, 50), im.Bounds().Size())
+
+	types, fctls := apngChunks(buf.Bytes())
+	assert.Equal("IHDR", types[0])
+	assert.Equal("acTL", types[1])
+	assert.Equal("IEND", types[len(types)-1])
+	assert.Contains(types, "fdAT")
+	if assert.Len(fctls, 3) {
+		var delays []uint16
+		for i, fctl := range fctls {
+			if i == 0 {
+				assert.Equal(uint32(0), binary.BigEndian.Uint32(fctl))
+			}
+			delays = append(delays, binary.BigEndian.Uint16(fctl[20:]))
+			assert.Equal(uint16(100), binary.BigEndian.Uint16(fctl[22:]))
+		}
+		assert.Equal([]uint16{5, 10, 100}, delays)
+	}
+}
+
+func TestWriteAnimationBudget(t *testing.T) {
+	assert := assert.New(t)
+	rnd := rand.New(rand.NewSource(1))
+	var frames []*Frame
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		noise := image.NewRGBA(image.Rect(0, 0, 320, 160))
+		rnd.Read(noise.Pix)
+		f := testFrame(t, noise)
+		f.Time = start.Add(time.Duration(i) * 100 * time.Millisecond)
+		frames = append(frames, f)
+	}
+
+	var full bytes.Buffer
+	assert.Nil(WriteAnimation(&full, frames, AnimationOptions{}))
+	var buf bytes.Buffer
+	budget := int64(full.Len() / 3)
+	assert.Nil(WriteAnimation(&buf, frames, AnimationOptions{MaxBytes: budget}))
+	assert.True(int64(buf.Len()) <= budget)
+	cfg, err := gif.DecodeConfig(&buf)
+	assert.Nil(err)
+	assert.True(cfg.Width < 320)
+
+	buf.Reset()
+	assert.Equal(ErrAnimationTooLarge, WriteAnimation(&buf, frames, AnimationOptions{MaxBytes: 100}))
+	assert.Zero(buf.Len())
+	assert.NotNil(WriteAnimation(&buf, nil, AnimationOptions{}))
+}
+
+func TestSessionFrames(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	frames := animationFrames(t, 0, 1000, 2000, 3000)
+	for i, f := range frames {
+		f.Time = start.Add(time.Duration(i) * time.Second)
+	}
+	frames[2].Orientation = 90
+	buf := writeTestSession(t, start, frames...)
+
+	window, err := SessionFrames(buf, 1500*time.Millisecond, 2500*time.Millisecond)
+	assert.Nil(err)
+	if assert.Len(window, 2) {
+		assert.Equal(frames[1].Data, window[0].Data)
+		assert.Equal(1500*time.Millisecond, window[0].Time.Sub(start), "shown from the start of the window")
+		assert.Equal(90, window[1].Orientation)
+	}
+}
+
+func TestCollectFrames(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	s.lastFrame = &Frame{Data: []byte{1}, Time: time.Now().Add(-time.Hour)}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.frames.publish(&Frame{Data: []byte{2}, Time: time.Now()})
+	}()
+	frames, err := CollectFrames(context.Background(), s, 100*time.Millisecond)
+	assert.Nil(err)
+	if assert.Len(frames, 2) {
+		assert.Equal([]byte{1}, frames[0].Data)
+		assert.True(time.Since(frames[0].Time) < time.Minute)
+		assert.Equal([]byte{2}, frames[1].Data)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = CollectFrames(ctx, s, time.Second)
+	assert.Equal(context.Canceled, err)
+}
@@ -0,0 +1,248 @@
+package minicap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// AVI 1.0 files can not be larger than 1GB without OpenDML extensions
+const maxAVISize = 1 << 30
+
+var ErrAVITooLarge = errors.New("avi: file size limit reached")
+
+const (
+	aviHasIndex     = 0x10
+	aviKeyFrame     = 0x10
+	aviHeaderLength = 224 // bytes written by writeHeader
+)
+
+type aviIndexEntry struct {
+	offset uint32
+	size   uint32
+}
+
+// AVIWriter writes JPEG images into a Motion JPEG AVI file.
+// The header is updated on Close, which requires w to be seekable.
+// The file starts at the offset of w when NewAVIWriter is called.
+type AVIWriter struct {
+	w      io.WriteSeeker
+	width  int
+	height int
+	fps    int
+
+	base         int64 // offset of the file in w
+	pos          int64 // bytes written so far
+	index        []aviIndexEntry
+	maxFrameSize uint32
+	closed       bool
+}
+
+func NewAVIWriter(w io.WriteSeeker, width, height, fps int) (aw *AVIWriter, err error) {
+	if fps <= 0 {
+		return nil, errors.New("avi: fps must be positive")
+	}
+	aw = &AVIWriter{
+		w:      w,
+		width:  width,
+		height: height,
+		fps:    fps,
+	}
+	if aw.base, err = w.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	if err = aw.writeHeader(); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Frames returns the number of frames written
+func (aw *AVIWriter) Frames() int {
+	return len(aw.index)
+}
+
+// Size returns the current file size, not counting the index
+func (aw *AVIWriter) Size() int64 {
+	return aw.pos
+}
+
+// SizeWith returns the size of the closed file, index included, once a
+// frame of n bytes is written
+func (aw *AVIWriter) SizeWith(n int) int64 {
+	chunkSize := int64(8 + n + n&1)
+	indexSize := int64(8 + 16*(len(aw.index)+1))
+	return aw.pos + chunkSize + indexSize
+}
+
+// WriteFrame appends one JPEG image to the movie
+func (aw *AVIWriter) WriteFrame(jpegData []byte) (err error) {
+	if aw.closed {
+		return ErrAlreadyClosed
+	}
+	size := uint32(len(jpegData))
+	if aw.SizeWith(len(jpegData)) > maxAVISize {
+		return ErrAVITooLarge
+	}
+	// offsets in idx1 are relative to the 'movi' fourcc
+	aw.index = append(aw.index, aviIndexEntry{
+		offset: uint32(aw.pos - (aviHeaderLength - 4)),
+		size:   size,
+	})
+	if err = aw.writeChunk("00dc", jpegData); err != nil {
+		return
+	}
+	if size > aw.maxFrameSize {
+		aw.maxFrameSize = size
+	}
+	return nil
+}
+
+// Close writes the index and fixes up the header.
+// The underlying writer is not closed.
+func (aw *AVIWriter) Close() (err error) {
+	if aw.closed {
+		return ErrAlreadyClosed
+	}
+	aw.closed = true
+	moviSize := aw.pos - (aviHeaderLength - 4)
+
+	idx := make([]byte, 16*len(aw.index))
+	for i, e := range aw.index {
+		b := idx[i*16:]
+		copy(b, "00dc")
+		binary.LittleEndian.PutUint32(b[4:], aviKeyFrame)
+		binary.LittleEndian.PutUint32(b[8:], e.offset)
+		binary.LittleEndian.PutUint32(b[12:], e.size)
+	}
+	if err = aw.writeChunk("idx1", idx); err != nil {
+		return
+	}
+	fileSize := aw.pos
+
+	patch := func(offset int64, v uint32) error {
+		if _, err := aw.w.Seek(aw.base+offset, io.SeekStart); err != nil {
+			return err
+		}
+		return binary.Write(aw.w, binary.LittleEndian, v)
+	}
+	frames := uint32(len(aw.index))
+	for _, p := range []struct {
+		offset int64
+		value  uint32
+	}{
+		{4, uint32(fileSize - 8)},               // RIFF size
+		{48, frames},                            // avih.dwTotalFrames
+		{60, aw.maxFrameSize},                   // avih.dwSuggestedBufferSize
+		{140, frames},                           // strh.dwLength
+		{144, aw.maxFrameSize},                  // strh.dwSuggestedBufferSize
+		{aviHeaderLength - 8, uint32(moviSize)}, // LIST movi size
+	} {
+		if err = patch(p.offset, p.value); err != nil {
+			return
+		}
+	}
+	_, err = aw.w.Seek(aw.base+fileSize, io.SeekStart)
+	return
+}
+
+func (aw *AVIWriter) write(data interface{}) error {
+	if err := binary.Write(aw.w, binary.LittleEndian, data); err != nil {
+		return err
+	}
+	aw.pos += int64(binary.Size(data))
+	return nil
+}
+
+func (aw *AVIWriter) writeChunk(fourcc string, data []byte) (err error) {
+	if err = aw.write([]byte(fourcc)); err != nil {
+		return
+	}
+	if err = aw.write(uint32(len(data))); err != nil {
+		return
+	}
+	if err = aw.write(data); err != nil {
+		return
+	}
+	if len(data)%2 == 1 {
+		err = aw.write([]byte{0})
+	}
+	return
+}
+
+func (aw *AVIWriter) writeHeader() error {
+	w, h := uint32(aw.width), uint32(aw.height)
+	header := []interface{}{
+		[]byte("RIFF"), uint32(0), []byte("AVI "),
+		[]byte("LIST"), uint32(192), []byte("hdrl"),
+		// MainAVIHeader
+		[]byte("avih"), uint32(56),
+		uint32(1000000 / aw.fps), // dwMicroSecPerFrame
+		uint32(0),                // dwMaxBytesPerSec
+		uint32(0),                // dwPaddingGranularity
+		uint32(aviHasIndex),      // dwFlags
+		uint32(0),                // dwTotalFrames
+		uint32(0),                // dwInitialFrames
+		uint32(1),                // dwStreams
+		uint32(0),                // dwSuggestedBufferSize
+		w, h,                     // dwWidth, dwHeight
+		[4]uint32{}, // dwReserved
+		[]byte("LIST"), uint32(116), []byte("strl"),
+		// AVIStreamHeader
+		[]byte("strh"), uint32(56),
+		[]byte("vids"), []byte("MJPG"),
+		uint32(0),            // dwFlags
+		uint16(0), uint16(0), // wPriority, wLanguage
+		uint32(0),                 // dwInitialFrames
+		uint32(1), uint32(aw.fps), // dwScale, dwRate
+		uint32(0),                          // dwStart
+		uint32(0),                          // dwLength
+		uint32(0),                          // dwSuggestedBufferSize
+		int32(-1),                          // dwQuality
+		uint32(0),                          // dwSampleSize
+		[4]int16{0, 0, int16(w), int16(h)}, // rcFrame
+		// BITMAPINFOHEADER
+		[]byte("strf"), uint32(40),
+		uint32(40), int32(w), int32(h),
+		uint16(1), uint16(24), // biPlanes, biBitCount
+		[]byte("MJPG"),
+		w * h * 3, // biSizeImage
+		int32(0), int32(0), uint32(0), uint32(0),
+		[]byte("LIST"), uint32(0), []byte("movi"),
+	}
+	for _, v := range header {
+		if err := aw.write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memWriteSeeker is an in-memory io.WriteSeeker, for AVI files built in memory
+type memWriteSeeker struct {
+	buf []byte
+	pos int
+}
+
+func (m *memWriteSeeker) Write(p []byte) (n int, err error) {
+	if end := m.pos + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	n = copy(m.buf[m.pos:], p)
+	m.pos += n
+	return
+}
+
+func (m *memWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(m.pos)
+	case io.SeekEnd:
+		offset += int64(len(m.buf))
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start")
+	}
+	m.pos = int(offset)
+	return offset, nil
+}
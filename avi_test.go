@@ -0,0 +1,151 @@
+package minicap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// parseAVIIndex checks the RIFF structure and returns the frames listed in idx1
+func parseAVIIndex(t *testing.T, data []byte) (frames [][]byte) {
+	le := binary.LittleEndian
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "AVI " {
+		t.Fatal("not an avi file")
+	}
+	if int(le.Uint32(data[4:]))+8 != len(data) {
+		t.Fatalf("bad RIFF size %d, file size %d", le.Uint32(data[4:]), len(data))
+	}
+	movi := bytes.Index(data, []byte("movi"))
+	moviSize := int(le.Uint32(data[movi-4:]))
+	idx := movi + moviSize
+	if string(data[idx:idx+4]) != "idx1" {
+		t.Fatalf("idx1 not found after movi, got %q", data[idx:idx+4])
+	}
+	n := int(le.Uint32(data[idx+4:])) / 16
+	totalFrames := int(le.Uint32(data[48:]))
+	if totalFrames != n {
+		t.Fatalf("avih has %d frames, index has %d", totalFrames, n)
+	}
+	for i := 0; i < n; i++ {
+		e := data[idx+8+i*16:]
+		off := movi + int(le.Uint32(e[8:]))
+		size := int(le.Uint32(e[12:]))
+		if string(data[off:off+4]) != "00dc" || int(le.Uint32(data[off+4:])) != size {
+			t.Fatalf("index entry %d does not point to a frame", i)
+		}
+		frames = append(frames, data[off+8:off+8+size])
+	}
+	return
+}
+
+func TestAVIWriter(t *testing.T) {
+	assert := assert.New(t)
+	f := &memWriteSeeker{}
+	aw, err := NewAVIWriter(f, 40, 20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(int64(aviHeaderLength), aw.Size())
+	assert.Nil(aw.WriteFrame([]byte{1, 2, 3}))
+	assert.Nil(aw.WriteFrame([]byte{4, 5}))
+	assert.Nil(aw.Close())
+	assert.Equal(ErrAlreadyClosed, aw.WriteFrame([]byte{6}))
+
+	frames := parseAVIIndex(t, f.buf)
+	assert.Equal([][]byte{{1, 2, 3}, {4, 5}}, frames)
+
+	// the file starts where w is
+	f = &memWriteSeeker{}
+	f.Write([]byte("prefix"))
+	aw, err = NewAVIWriter(f, 40, 20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(aw.WriteFrame([]byte{1, 2, 3}))
+	assert.Nil(aw.Close())
+	assert.Equal("prefix", string(f.buf[:6]))
+	assert.Equal([][]byte{{1, 2, 3}}, parseAVIIndex(t, f.buf[6:]))
+}
+
+type testSource struct {
+	frameHub
+}
+
+func (ts *testSource) Subscribe(size int) *Subscription {
+	return ts.subscribe(size)
+}
+
+func TestRecorderRepeatsFrames(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "out.avi")
+	src := &testSource{}
+	r := NewRecorder(src, RecorderOptions{FPS: 1})
+	if err := r.Start(path); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	start := r.start
+	r.mu.Unlock()
+	f1 := &Frame{Data: testJPEG(t, 40, 20), Time: start}
+	f2 := &Frame{Data: testJPEG(t, 40, 20), Time: start.Add(3 * time.Second)}
+	f2.Data = append(f2.Data, 0) // make it distinguishable
+	src.publish(f1)
+	src.publish(f2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(r.Stop())
+	<-r.Done()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := parseAVIIndex(t, data)
+	if assert.Len(frames, 4) {
+		assert.Equal(f1.Data, frames[0])
+		assert.Equal(f1.Data, frames[2])
+		assert.Equal(f2.Data, frames[3])
+	}
+}
+
+func TestRecorderLimits(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	src := &testSource{}
+	data := testJPEG(t, 40, 20)
+	maxSize := int64(aviHeaderLength + 8 + len(data) + len(data)&1 + 8 + 16)
+	r := NewRecorder(src, RecorderOptions{FPS: 1, MaxSize: maxSize})
+
+	// one frame and its index fit
+	assert.Nil(r.Start(filepath.Join(dir, "size.avi")))
+	r.mu.Lock()
+	start := r.start
+	r.mu.Unlock()
+	src.publish(&Frame{Data: data, Time: start})
+	src.publish(&Frame{Data: data, Time: start.Add(time.Second)})
+	<-r.Done()
+	assert.Nil(r.Err(), "reaching MaxSize is not an error")
+	info, err := os.Stat(filepath.Join(dir, "size.avi"))
+	if assert.Nil(err) {
+		assert.Equal(maxSize, info.Size())
+	}
+
+	// the screen rotates with RotationRaw
+	r = NewRecorder(src, RecorderOptions{FPS: 1})
+	assert.Nil(r.Start(filepath.Join(dir, "rotate.avi")))
+	r.mu.Lock()
+	start = r.start
+	r.mu.Unlock()
+	src.publish(&Frame{Data: data, Time: start})
+	src.publish(&Frame{Data: testJPEG(t, 20, 40), Time: start.Add(2 * time.Second)})
+	<-r.Done()
+	assert.Equal(ErrFrameSizeChanged, r.Err())
+	raw, err := os.ReadFile(filepath.Join(dir, "rotate.avi"))
+	if assert.Nil(err) {
+		assert.Len(parseAVIIndex(t, raw), 2, "the frames before the rotation are kept")
+	}
+}
@@ -0,0 +1,90 @@
+package minicap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// backend runs minicap for a Service, only the run loop of the service calls it
+type backend interface {
+	// prepare installs minicap and returns the display in portrait
+	prepare() (DisplayInfo, error)
+	// watchRotation sends the orientation of the display on every rotation
+	// until stop, starting with the current one
+	watchRotation() (<-chan int, error)
+	// start (re)starts minicap projecting the display in orientation
+	start(info DisplayInfo, orientation int) error
+	// kill stops minicap
+	kill() error
+	// dial connects to the running minicap
+	dial() (io.ReadCloser, error)
+	// stop releases minicap, the rotation watcher and the port forward
+	stop()
+}
+
+// adbBackend runs minicap on the device of a Service through adb
+type adbBackend struct {
+	s *Service
+}
+
+func (b adbBackend) prepare() (info DisplayInfo, err error) {
+	if !b.s.IsSupported() {
+		err = errors.New("minicap not supported")
+		return
+	}
+	if info, err = b.s.d.getDisplayInfo(); err != nil {
+		return
+	}
+	if info.Width > info.Height {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return
+}
+
+func (b adbBackend) watchRotation() (orienC <-chan int, err error) {
+	if err = b.s.r.start(); err != nil {
+		return
+	}
+	return b.s.r.watch()
+}
+
+func (b adbBackend) start(info DisplayInfo, orientation int) (err error) {
+	b.kill()
+	params := fmt.Sprintf("%dx%d@%dx%d/%d", info.Width, info.Height,
+		info.Width, info.Height, orientation)
+	cmd := b.s.d.buildCommand("LD_LIBRARY_PATH=/data/local/tmp", "/data/local/tmp/minicap", "-P", params, "-S")
+	if err = cmd.Start(); err != nil {
+		b.s.logger().Error("start minicap", "err", err)
+		return
+	}
+	b.s.logger().Info("minicap started", "socket", "minicap", "params", params)
+	time.Sleep(time.Millisecond) // ?
+	if b.s.lforwardPort == 0 {
+		b.s.lforwardPort, err = freePort()
+		if err != nil {
+			return
+		}
+	}
+	_, err = b.s.d.run("forward", fmt.Sprintf("tcp:%d", b.s.lforwardPort), "localabstract:minicap")
+	return
+}
+
+func (b adbBackend) kill() error {
+	return b.s.d.killProc("minicap")
+}
+
+func (b adbBackend) dial() (io.ReadCloser, error) {
+	return net.Dial("tcp", net.JoinHostPort(b.s.AdbHost, strconv.Itoa(b.s.lforwardPort)))
+}
+
+func (b adbBackend) stop() {
+	b.s.r.stop()
+	b.kill()
+	if b.s.lforwardPort != 0 {
+		b.s.d.run("forward", "--remove", fmt.Sprintf("tcp:%d", b.s.lforwardPort))
+	}
+}
@@ -0,0 +1,216 @@
+package minicap
+
+import (
+	"context"
+	"image"
+	"time"
+)
+
+const (
+	thumbWidth     = 64 // frames are compared at this width
+	thumbPixelDiff = 16 // gray levels two thumbnail pixels may differ by and still count as equal
+)
+
+type ChangeEventType int
+
+const (
+	ScreenChanged ChangeEventType = iota // the screen differs from the last settled one
+	ScreenSettled                        // no change for the whole window
+)
+
+func (t ChangeEventType) String() string {
+	if t == ScreenSettled {
+		return "settled"
+	}
+	return "changed"
+}
+
+type ChangeEvent struct {
+	Type ChangeEventType
+	Time time.Time
+	Diff float64 // fraction of the screen that changed, for ScreenChanged
+}
+
+type ChangeOptions struct {
+	// A frame counts as changed when more than this fraction of the
+	// screen differs, default 0.005
+	Threshold float64
+	// Regions ignored when comparing, in frame coordinates, such as the status bar clock
+	Ignore []image.Rectangle
+}
+
+// grayThumb is a small grayscale copy of a frame used for comparison
+type grayThumb struct {
+	w, h   int
+	pix    []uint8
+	ignore []bool
+}
+
+func newGrayThumb(im image.Image, ignore []image.Rectangle) *grayThumb {
+	b := im.Bounds()
+	w := thumbWidth
+	if b.Dx() < w {
+		w = b.Dx()
+	}
+	h := b.Dy() * w / b.Dx()
+	if h < 1 {
+		h = 1
+	}
+	small := scaleGray(grayPlane(im), w, h)
+	t := &grayThumb{
+		w:      w,
+		h:      h,
+		pix:    small.Pix,
+		ignore: make([]bool, w*h),
+	}
+	if len(ignore) == 0 {
+		return t
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			center := image.Pt(b.Min.X+(2*x+1)*b.Dx()/(2*w), b.Min.Y+(2*y+1)*b.Dy()/(2*h))
+			for _, r := range ignore {
+				if center.In(r) {
+					t.ignore[y*w+x] = true
+					break
+				}
+			}
+		}
+	}
+	return t
+}
+
+// grayPlane returns the luminance of im with origin at (0, 0).
+// JPEG frames decode to YCbCr, whose Y plane is used as is.
+func grayPlane(im image.Image) *image.Gray {
+	b := im.Bounds()
+	switch m := im.(type) {
+	case *image.YCbCr:
+		return &image.Gray{Pix: m.Y[m.YOffset(b.Min.X, b.Min.Y):], Stride: m.YStride, Rect: image.Rect(0, 0, b.Dx(), b.Dy())}
+	case *image.Gray:
+		return &image.Gray{Pix: m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], Stride: m.Stride, Rect: image.Rect(0, 0, b.Dx(), b.Dy())}
+	}
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			gray.Set(x, y, im.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return gray
+}
+
+// diff returns the fraction of pixels that differ between t and o.
+// Thumbnails of different size, i.e. after a rotation, differ completely.
+func (t *grayThumb) diff(o *grayThumb) float64 {
+	if t.w != o.w || t.h != o.h {
+		return 1
+	}
+	var changed, total int
+	for i, p := range t.pix {
+		if t.ignore[i] || o.ignore[i] {
+			continue
+		}
+		total++
+		d := int(p) - int(o.pix[i])
+		if d > thumbPixelDiff || d < -thumbPixelDiff {
+			changed++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(changed) / float64(total)
+}
+
+// WatchChanges reports when the screen of src changes, and when it settled
+// for window. The channel is closed when ctx is done or src stops.
+func WatchChanges(ctx context.Context, src FrameSource, window time.Duration, opt ChangeOptions) <-chan ChangeEvent {
+	if opt.Threshold <= 0 {
+		opt.Threshold = 0.005
+	}
+	eventC := make(chan ChangeEvent, 4)
+	sub := src.Subscribe(1)
+	go func() {
+		defer close(eventC)
+		defer sub.Close()
+		send := func(ev ChangeEvent) bool {
+			select {
+			case eventC <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// minicap only sends frames when something changed, so the screen is
+		// settled once no significant frame arrived for a whole window
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+		settled := false
+		var ref *grayThumb
+		for {
+			select {
+			case f, ok := <-sub.C():
+				if !ok {
+					return
+				}
+				im, err := f.Decode()
+				f.Release()
+				if err != nil {
+					continue
+				}
+				thumb := newGrayThumb(im, opt.Ignore)
+				if ref == nil {
+					ref = thumb
+					continue
+				}
+				d := ref.diff(thumb)
+				if d <= opt.Threshold {
+					continue
+				}
+				ref = thumb
+				settled = false
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(window)
+				if !send(ChangeEvent{Type: ScreenChanged, Time: f.Time, Diff: d}) {
+					return
+				}
+			case now := <-timer.C:
+				if !settled {
+					settled = true
+					if !send(ChangeEvent{Type: ScreenSettled, Time: now}) {
+						return
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return eventC
+}
+
+// WatchChanges reports changes of the screen, see WatchChanges
+func (s *Service) WatchChanges(ctx context.Context, window time.Duration, opt ChangeOptions) <-chan ChangeEvent {
+	return WatchChanges(ctx, s, window, opt)
+}
+
+// WaitStable blocks until no more than threshold of the screen changed for window.
+// The capture must be running.
+func (s *Service) WaitStable(ctx context.Context, window time.Duration, threshold float64, ignore ...image.Rectangle) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for ev := range WatchChanges(ctx, s, window, ChangeOptions{Threshold: threshold, Ignore: ignore}) {
+		if ev.Type == ScreenSettled {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrAlreadyClosed
+}
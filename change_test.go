@@ -0,0 +1,73 @@
+package minicap
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFrame(t *testing.T, im image.Image) *Frame {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, im, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return &Frame{Data: buf.Bytes(), Time: time.Now()}
+}
+
+func grayImage(w, h int, v uint8, box image.Rectangle, boxValue uint8) *image.Gray {
+	im := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(im, im.Rect, &image.Uniform{color.Gray{v}}, image.Point{}, draw.Src)
+	draw.Draw(im, box, &image.Uniform{color.Gray{boxValue}}, image.Point{}, draw.Src)
+	return im
+}
+
+func TestGrayThumbDiff(t *testing.T) {
+	assert := assert.New(t)
+	base := grayImage(128, 256, 100, image.Rectangle{}, 0)
+	clock := grayImage(128, 256, 100, image.Rect(0, 0, 128, 16), 250)
+	a := newGrayThumb(base, nil)
+	assert.Equal(64, a.w)
+	assert.Equal(128, a.h)
+	assert.Equal(0.0, a.diff(newGrayThumb(base, nil)))
+	assert.InDelta(16.0/256, a.diff(newGrayThumb(clock, nil)), 0.001)
+
+	ignore := []image.Rectangle{image.Rect(0, 0, 128, 16)}
+	assert.Equal(0.0, newGrayThumb(base, ignore).diff(newGrayThumb(clock, ignore)))
+}
+
+func TestWatchChanges(t *testing.T) {
+	assert := assert.New(t)
+	src := &testSource{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	eventC := WatchChanges(ctx, src, 100*time.Millisecond, ChangeOptions{})
+	src.publish(testFrame(t, grayImage(64, 64, 100, image.Rectangle{}, 0)))
+	time.Sleep(10 * time.Millisecond)
+	src.publish(testFrame(t, grayImage(64, 64, 100, image.Rect(0, 0, 32, 32), 250)))
+
+	ev := <-eventC
+	assert.Equal(ScreenChanged, ev.Type)
+	assert.InDelta(0.25, ev.Diff, 0.05)
+	ev = <-eventC
+	assert.Equal(ScreenSettled, ev.Type)
+}
+
+func TestWaitStable(t *testing.T) {
+	s := &Service{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.Nil(t, s.WaitStable(ctx, 50*time.Millisecond, 0.01))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.WaitStable(ctx, time.Second, 0.01))
+}
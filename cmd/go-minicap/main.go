@@ -0,0 +1,448 @@
+// Command go-minicap captures the screen of android devices with minicap.
+//
+//	go-minicap devices
+//	go-minicap [-s serial] info
+//	go-minicap [-s serial] install | uninstall
+//	go-minicap [-s serial] screenshot -o screen.png
+//	go-minicap [-s serial] record -o screen.avi --duration 30s
+//	go-minicap [-s serial] serve --addr 127.0.0.1:8000 --control minitouch
+//	go-minicap [-s serial] stream > frames.minicap
+//	go-minicap [-s serial] vnc --addr 127.0.0.1:5900
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	minicap "github.com/openatx/go-minicap"
+	"github.com/openatx/go-minicap/vnc"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var (
+	serial  string
+	adbPath string
+	logger  *slog.Logger
+
+	commands = map[string]command{
+		"devices":    {"list connected devices", runDevices},
+		"info":       {"show display info and minicap support", runInfo},
+		"install":    {"install minicap to the device", runInstall},
+		"uninstall":  {"remove minicap from the device", runUninstall},
+		"screenshot": {"take a screenshot", runScreenshot},
+		"record":     {"record the screen into an AVI file", runRecord},
+		"serve":      {"serve the screen as MJPEG and websocket", runServe},
+		"stream":     {"write raw minicap frames to stdout", runStream},
+		"vnc":        {"serve the screen to VNC viewers", runVNC},
+	}
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-s serial] [-adb path] [-v] <command> [args]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s%s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.StringVar(&serial, "s", os.Getenv("ANDROID_SERIAL"), "device serial, default the only connected device")
+	flag.StringVar(&adbPath, "adb", "", "path to adb")
+	verbose := flag.Bool("v", false, "log every adb command")
+	flag.Usage = usage
+	flag.Parse()
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func listDevices() (serials []string, err error) {
+	if serials, err = minicap.ListDevices(); err != nil {
+		return
+	}
+	sort.Strings(serials)
+	return
+}
+
+func newService() (s *minicap.Service, err error) {
+	if serial == "" {
+		serials, err := listDevices()
+		if err != nil {
+			return nil, err
+		}
+		switch len(serials) {
+		case 0:
+			return nil, errors.New("no device connected")
+		case 1:
+			serial = serials[0]
+		default:
+			return nil, errors.New("more than one device connected, use -s to choose one")
+		}
+	}
+	return minicap.NewService(minicap.Options{Serial: serial, Adb: adbPath, Logger: logger})
+}
+
+// startCapture installs minicap if needed and starts streaming
+func startCapture() (s *minicap.Service, err error) {
+	if s, err = newService(); err != nil {
+		return
+	}
+	if err = s.Install(); err != nil {
+		return
+	}
+	if err = s.Start(); err != nil {
+		return
+	}
+	return s, nil
+}
+
+// startInput returns the input backend for control, "minitouch", "shell" or
+// "" for none, and a function to stop it
+func startInput(s *minicap.Service, control string) (in minicap.InputBackend, stop func(), err error) {
+	stop = func() {}
+	switch control {
+	case "":
+		return nil, stop, nil
+	case "shell":
+		return s.ShellInput(), stop, nil
+	case "minitouch":
+		t, err := s.Touch()
+		if err != nil {
+			return nil, stop, err
+		}
+		if err = t.Start(); err != nil {
+			return nil, stop, err
+		}
+		return t, func() { t.Close() }, nil
+	}
+	return nil, stop, fmt.Errorf("unknown control %q, use minitouch or shell", control)
+}
+
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+func runDevices(args []string) error {
+	serials, err := listDevices()
+	if err != nil {
+		return err
+	}
+	for _, serial := range serials {
+		fmt.Println(serial)
+	}
+	return nil
+}
+
+func runInfo(args []string) error {
+	s, err := newService()
+	if err != nil {
+		return err
+	}
+	info, err := s.QueryDisplayInfo()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("serial:      %s\n", s.Serial())
+	for _, prop := range []string{"ro.product.model", "ro.build.version.release", "ro.build.version.sdk", "ro.product.cpu.abi"} {
+		value, _ := s.GetProp(prop)
+		label := prop[strings.LastIndex(prop, ".")+1:] + ":"
+		fmt.Printf("%-12s %s\n", label, value)
+	}
+	fmt.Printf("display:     %dx%d\n", info.Width, info.Height)
+	fmt.Printf("orientation: %d\n", info.Orientation)
+	fmt.Printf("minicap:     %v\n", s.IsSupported())
+	return nil
+}
+
+func runInstall(args []string) error {
+	s, err := newService()
+	if err != nil {
+		return err
+	}
+	return s.Install()
+}
+
+func runUninstall(args []string) error {
+	s, err := newService()
+	if err != nil {
+		return err
+	}
+	return s.Uninstall()
+}
+
+func runScreenshot(args []string) error {
+	fs := flag.NewFlagSet("screenshot", flag.ExitOnError)
+	output := fs.String("o", "screenshot.png", "output file, .png, .jpg or .gif, - for png to stdout")
+	fs.Parse(args)
+
+	s, err := newService()
+	if err != nil {
+		return err
+	}
+	if *output == "-" {
+		return s.EncodeScreenshot(os.Stdout, minicap.FormatPNG)
+	}
+	return s.SaveScreenshot(*output)
+}
+
+func runRecord(args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	output := fs.String("o", "record.avi", "output AVI file")
+	duration := fs.Duration("duration", 0, "stop after duration, default until interrupted")
+	fps := fs.Int("fps", 10, "frame rate of the video")
+	maxSize := fs.Int64("max-size", 0, "stop when the file reaches this many bytes")
+	fs.Parse(args)
+
+	s, err := startCapture()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	r := minicap.NewRecorder(s, minicap.RecorderOptions{
+		FPS:         *fps,
+		MaxDuration: *duration,
+		MaxSize:     *maxSize,
+	})
+	if err = r.Start(*output); err != nil {
+		return err
+	}
+	log.Printf("recording to %s, press Ctrl-C to stop", *output)
+	ctx, cancel := interruptContext()
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		r.Stop()
+	case <-r.Done():
+	}
+	return r.Err()
+}
+
+const viewerPage = `<!doctype html>
+<title>go-minicap</title>
+<style>body{margin:0;background:#222;text-align:center}img{max-height:100vh}</style>
+<img src="mjpeg/">
+<script>
+// input only, the screen comes with MJPEG
+var img = document.querySelector('img'), down = false
+var ws = new WebSocket('ws://' + location.host + '/ws')
+ws.onopen = function() { ws.send(JSON.stringify({type: 'pause'})) }
+function send(msg) { if (ws.readyState === 1) ws.send(JSON.stringify(msg)) }
+function touch(type, e) {
+  var r = img.getBoundingClientRect()
+  send({type: type, x: (e.clientX - r.left) * img.naturalWidth / r.width, y: (e.clientY - r.top) * img.naturalHeight / r.height})
+}
+img.onmousedown = function(e) { e.preventDefault(); down = true; touch('touchDown', e) }
+img.onmousemove = function(e) { if (down) touch('touchMove', e) }
+window.onmouseup = function() { if (down) { down = false; send({type: 'touchUp'}) } }
+var keys = {Escape: 'back', Home: 'home', Enter: 'enter', Backspace: 'del'}
+document.onkeydown = function(e) {
+  if (keys[e.key]) send({type: 'key', key: keys[e.key]})
+  else if (e.key.length === 1) send({type: 'text', text: e.key})
+  else return
+  e.preventDefault()
+}
+</script>
+`
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8000", "listen address")
+	control := fs.String("control", "", "allow remote control with minitouch or shell")
+	fs.Parse(args)
+
+	s, err := startCapture()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	input, stopInput, err := startInput(s, *control)
+	if err != nil {
+		return err
+	}
+	defer stopInput()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, viewerPage)
+	})
+	mux.Handle("/mjpeg/", http.StripPrefix("/mjpeg", minicap.NewMJPEGHandler(s)))
+	ws := minicap.NewWebSocketHandler(s)
+	ws.Input = input
+	mux.Handle("/ws", ws)
+	mux.Handle("/metrics", minicap.MetricsHandler(func() []*minicap.Service { return []*minicap.Service{s} }))
+	server := &http.Server{Addr: *addr, Handler: mux}
+	warnPublic(*addr)
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("serving %s on http://%s", s.Serial(), *addr)
+	if err = server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func runVNC(args []string) error {
+	fs := flag.NewFlagSet("vnc", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:5900", "listen address")
+	control := fs.String("control", "", "allow remote control with minitouch or shell")
+	fs.Parse(args)
+
+	s, err := startCapture()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	input, stopInput, err := startInput(s, *control)
+	if err != nil {
+		return err
+	}
+	defer stopInput()
+	server := vnc.NewServer(s)
+	server.Name = s.Serial()
+	if input != nil {
+		server.Input = vnc.NewInput(input)
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	warnPublic(*addr)
+	log.Printf("serving %s on vnc://%s", s.Serial(), *addr)
+	if err = server.ListenAndServe(*addr); err != vnc.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// warnPublic warns when addr can be reached from other hosts: there is no
+// authentication, anyone can watch the screen and, with --control, touch it.
+func warnPublic(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "localhost" {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return
+	}
+	log.Printf("warning: %s is reachable from other hosts, without any authentication", addr)
+}
+
+func runStream(args []string) error {
+	fs := flag.NewFlagSet("stream", flag.ExitOnError)
+	fs.Parse(args)
+
+	s, err := startCapture()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	sub := s.Subscribe(8)
+	defer sub.Close()
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	// same wire format as minicap itself: banner, then size prefixed JPEG frames
+	out := os.Stdout
+	wroteBanner := false
+	for {
+		select {
+		case f, ok := <-sub.C():
+			if !ok {
+				return nil
+			}
+			if !wroteBanner {
+				if err = writeBanner(out, s.Banner()); err != nil {
+					f.Release()
+					return err
+				}
+				wroteBanner = true
+			}
+			err = writeFrame(out, f.Data)
+			f.Release()
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// writeFrame writes data prefixed by its size
+func writeFrame(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func writeBanner(w io.Writer, b minicap.Banner) error {
+	return binary.Write(w, binary.LittleEndian, struct {
+		Version     uint8
+		Length      uint8
+		PID         uint32
+		RealW       uint32
+		RealH       uint32
+		VirtualW    uint32
+		VirtualH    uint32
+		Orientation uint8
+		Quirks      uint8
+	}{
+		uint8(b.Version), 24, uint32(b.PID),
+		uint32(b.RealWidth), uint32(b.RealHeight),
+		uint32(b.VirtualWidth), uint32(b.VirtualHeight),
+		uint8(b.Orientation / 90), uint8(b.Quirks),
+	})
+}
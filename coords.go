@@ -0,0 +1,120 @@
+package minicap
+
+import "image"
+
+// Display coordinates come in two flavours:
+//
+//	natural: the device held in its natural orientation, size W x H as
+//	         reported with Orientation 0, the space used by touch input
+//	frame:   the upright image minicap sends for the current orientation,
+//	         H x W when the orientation is 90 or 270
+//
+//	touch:   the natural space scaled to the touch panel, 0..max like the
+//	         MaxX and MaxY of the minitouch banner
+//
+// Orientation is the display rotation in degrees, like DisplayInfo.Orientation.
+// Frames captured with RotationNatural are in natural coordinates, use 0 for them.
+
+// FrameSize returns the size of upright frames of a display with natural size for orientation
+func FrameSize(natural image.Point, orientation int) image.Point {
+	if orientation%180 != 0 {
+		return image.Pt(natural.Y, natural.X)
+	}
+	return natural
+}
+
+// NaturalToFrame converts a point in natural coordinates to frame coordinates
+func NaturalToFrame(p, natural image.Point, orientation int) image.Point {
+	switch normOrientation(orientation) {
+	case 90:
+		return image.Pt(p.Y, natural.X-p.X)
+	case 180:
+		return image.Pt(natural.X-p.X, natural.Y-p.Y)
+	case 270:
+		return image.Pt(natural.Y-p.Y, p.X)
+	}
+	return p
+}
+
+// FrameToNatural converts a point in frame coordinates to natural coordinates
+func FrameToNatural(p, natural image.Point, orientation int) image.Point {
+	switch normOrientation(orientation) {
+	case 90:
+		return image.Pt(natural.X-p.Y, p.X)
+	case 180:
+		return image.Pt(natural.X-p.X, natural.Y-p.Y)
+	case 270:
+		return image.Pt(p.Y, natural.Y-p.X)
+	}
+	return p
+}
+
+// NaturalRectToFrame converts a rectangle in natural coordinates to frame coordinates
+func NaturalRectToFrame(r image.Rectangle, natural image.Point, orientation int) image.Rectangle {
+	return image.Rectangle{
+		NaturalToFrame(r.Min, natural, orientation),
+		NaturalToFrame(r.Max, natural, orientation),
+	}.Canon()
+}
+
+// FrameRectToNatural converts a rectangle in frame coordinates to natural coordinates
+func FrameRectToNatural(r image.Rectangle, natural image.Point, orientation int) image.Rectangle {
+	return image.Rectangle{
+		FrameToNatural(r.Min, natural, orientation),
+		FrameToNatural(r.Max, natural, orientation),
+	}.Canon()
+}
+
+// FrameToTouch converts a point in frame coordinates to a touch panel of size max, clamped to it
+func FrameToTouch(p, natural image.Point, orientation int, max image.Point) image.Point {
+	p = FrameToNatural(p, natural, orientation)
+	p = scalePoint(p, natural, max)
+	return image.Pt(maxInt(0, minInt(p.X, max.X)), maxInt(0, minInt(p.Y, max.Y)))
+}
+
+// TouchToFrame converts a point on a touch panel of size max to frame coordinates
+func TouchToFrame(p, max, natural image.Point, orientation int) image.Point {
+	return NaturalToFrame(scalePoint(p, max, natural), natural, orientation)
+}
+
+// scalePoint maps p from a space of size from to a space of size to
+func scalePoint(p, from, to image.Point) image.Point {
+	if from == to || from.X == 0 || from.Y == 0 {
+		return p
+	}
+	return image.Pt(p.X*to.X/from.X, p.Y*to.Y/from.Y)
+}
+
+func normOrientation(orientation int) int {
+	orientation %= 360
+	if orientation < 0 {
+		orientation += 360
+	}
+	return orientation
+}
+
+// scaleRect maps r from a space of size from to a space of size to
+func scaleRect(r image.Rectangle, from, to image.Point) image.Rectangle {
+	if from == to || from.X == 0 || from.Y == 0 {
+		return r
+	}
+	return image.Rect(
+		r.Min.X*to.X/from.X, r.Min.Y*to.Y/from.Y,
+		r.Max.X*to.X/from.X, r.Max.Y*to.Y/from.Y,
+	)
+}
+
+// cropImage cuts region, given in natural coordinates of a display of size
+// natural, out of a frame shown in orientation. Frames smaller than the
+// display, e.g. with a scaled down projection, are handled too.
+func cropImage(im image.Image, region image.Rectangle, natural image.Point, orientation int) image.Image {
+	r := NaturalRectToFrame(region, natural, orientation)
+	b := im.Bounds()
+	r = scaleRect(r, FrameSize(natural, orientation), b.Size()).Add(b.Min).Intersect(b)
+	if sub, ok := im.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	return toRGBA(im).SubImage(r.Sub(b.Min))
+}
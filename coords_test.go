@@ -0,0 +1,49 @@
+package minicap
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNaturalFrameRoundTrip(t *testing.T) {
+	natural := image.Pt(1080, 1920)
+	p := image.Pt(100, 300)
+	for _, orientation := range []int{0, 90, 180, 270, 360, -90} {
+		fp := NaturalToFrame(p, natural, orientation)
+		assert.True(t, fp.In(image.Rectangle{Max: FrameSize(natural, orientation)}.Inset(-1)))
+		assert.Equal(t, p, FrameToNatural(fp, natural, orientation), "orientation %d", orientation)
+	}
+	// the top left corner of the panel ends up bottom left when rotated by 90
+	assert.Equal(t, image.Pt(0, 1080), NaturalToFrame(image.Pt(0, 0), natural, 90))
+	assert.Equal(t, image.Pt(1920, 0), NaturalToFrame(image.Pt(0, 0), natural, 270))
+}
+
+func TestCropImage(t *testing.T) {
+	assert := assert.New(t)
+	natural := image.Pt(100, 200)
+	region := image.Rect(10, 20, 30, 60)
+
+	im := cropImage(image.NewRGBA(image.Rect(0, 0, 100, 200)), region, natural, 0)
+	assert.Equal(region, im.Bounds())
+
+	im = cropImage(image.NewRGBA(image.Rect(0, 0, 200, 100)), region, natural, 90)
+	assert.Equal(image.Rect(20, 70, 60, 90), im.Bounds())
+
+	// frame scaled down by half
+	im = cropImage(image.NewYCbCr(image.Rect(0, 0, 100, 50), image.YCbCrSubsampleRatio420), region, natural, 90)
+	assert.Equal(image.Rect(10, 35, 30, 45), im.Bounds())
+}
+
+func TestFrameTouchRoundTrip(t *testing.T) {
+	natural := image.Pt(540, 960)
+	max := image.Pt(1080, 1920)
+	p := image.Pt(100, 300)
+	for _, orientation := range []int{0, 90, 180, 270} {
+		tp := FrameToTouch(p, natural, orientation, max)
+		assert.Equal(t, p, TouchToFrame(tp, max, natural, orientation), "orientation %d", orientation)
+	}
+	assert.Equal(t, image.Pt(200, 600), FrameToTouch(p, natural, 0, max))
+	assert.Equal(t, image.Pt(0, 1920), FrameToTouch(image.Pt(-5, 2000), natural, 0, max))
+}
@@ -0,0 +1,62 @@
+package minicap
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+)
+
+// Decoder decodes the JPEG frames of minicap
+type Decoder interface {
+	Decode(data []byte) (image.Image, error)
+}
+
+// ScaledDecoder is a Decoder that can shrink images by 1/denom while decoding,
+// in the DCT domain, without decoding the full resolution first.
+// denom is 1, 2, 4 or 8.
+type ScaledDecoder interface {
+	Decoder
+	DecodeScaled(data []byte, denom int) (image.Image, error)
+}
+
+// StdDecoder decodes with image/jpeg
+type StdDecoder struct{}
+
+func (StdDecoder) Decode(data []byte) (image.Image, error) {
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+// DefaultDecoder decodes frames of services without Options.Decoder, and
+// frames not read from a service. Building with the libjpeg tag makes it a
+// LibJPEGDecoder.
+var DefaultDecoder Decoder = StdDecoder{}
+
+// DecodeScaled decodes data shrunk by 1/denom, rounded up like libjpeg does.
+// The shrinking is done while decoding when dec is a ScaledDecoder, otherwise
+// the full image is decoded and shrunk with a box filter. nil dec is
+// DefaultDecoder.
+func DecodeScaled(dec Decoder, data []byte, denom int) (image.Image, error) {
+	if dec == nil {
+		dec = DefaultDecoder
+	}
+	denom = scaleDenom(denom)
+	if sd, ok := dec.(ScaledDecoder); ok {
+		return sd.DecodeScaled(data, denom)
+	}
+	im, err := dec.Decode(data)
+	if err != nil || denom == 1 {
+		return im, err
+	}
+	size := im.Bounds().Size()
+	return resizeImage(im, (size.X+denom-1)/denom, (size.Y+denom-1)/denom), nil
+}
+
+// scaleDenom returns the largest of 1, 2, 4 and 8 not above denom
+func scaleDenom(denom int) int {
+	for _, d := range []int{8, 4, 2} {
+		if denom >= d {
+			return d
+		}
+	}
+	return 1
+}
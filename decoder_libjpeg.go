@@ -0,0 +1,49 @@
+//go:build libjpeg
+// +build libjpeg
+
+package minicap
+
+import (
+	"bytes"
+	"image"
+
+	libjpeg "github.com/pixiv/go-libjpeg/jpeg"
+)
+
+// LibJPEGDecoder decodes with libjpeg(-turbo) through cgo, which is faster
+// than image/jpeg and shrinks in the DCT domain. It needs the libjpeg
+// headers, build with -tags libjpeg to use it. It does not build on windows.
+type LibJPEGDecoder struct {
+	// DCTMethod trades precision for speed, libjpeg.DCTIFast by default
+	DCTMethod libjpeg.DCTMethod
+	// FancyUpsampling smooths the chroma, disabled by default for speed
+	FancyUpsampling bool
+}
+
+func init() {
+	DefaultDecoder = LibJPEGDecoder{DCTMethod: libjpeg.DCTIFast}
+}
+
+func (d LibJPEGDecoder) options() *libjpeg.DecoderOptions {
+	return &libjpeg.DecoderOptions{
+		DCTMethod:              d.DCTMethod,
+		DisableFancyUpsampling: !d.FancyUpsampling,
+	}
+}
+
+func (d LibJPEGDecoder) Decode(data []byte) (image.Image, error) {
+	return libjpeg.Decode(bytes.NewReader(data), d.options())
+}
+
+func (d LibJPEGDecoder) DecodeScaled(data []byte, denom int) (image.Image, error) {
+	opt := d.options()
+	if denom = scaleDenom(denom); denom > 1 {
+		cfg, err := libjpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		// libjpeg picks the smallest scale covering the target
+		opt.ScaleTarget = image.Rect(0, 0, (cfg.Width+denom-1)/denom, (cfg.Height+denom-1)/denom)
+	}
+	return libjpeg.Decode(bytes.NewReader(data), opt)
+}
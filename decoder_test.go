@@ -0,0 +1,133 @@
+package minicap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDecoder shrinks like a ScaledDecoder and counts the calls
+type countingDecoder struct {
+	decodes, scaled int
+	denom           int
+}
+
+func (d *countingDecoder) Decode(data []byte) (image.Image, error) {
+	d.decodes++
+	return StdDecoder{}.Decode(data)
+}
+
+func (d *countingDecoder) DecodeScaled(data []byte, denom int) (image.Image, error) {
+	d.scaled++
+	d.denom = denom
+	return DecodeScaled(StdDecoder{}, data, denom)
+}
+
+func TestDecodeScaled(t *testing.T) {
+	assert := assert.New(t)
+	data := testJPEG(t, 41, 20)
+	for _, c := range []struct {
+		denom int
+		size  image.Point
+	}{
+		{0, image.Pt(41, 20)},
+		{1, image.Pt(41, 20)},
+		{2, image.Pt(21, 10)},
+		{3, image.Pt(21, 10)},
+		{4, image.Pt(11, 5)},
+		{16, image.Pt(6, 3)},
+	} {
+		im, err := DecodeScaled(nil, data, c.denom)
+		assert.Nil(err)
+		assert.Equal(c.size, im.Bounds().Size(), "1/%d", c.denom)
+	}
+
+	dec := &countingDecoder{}
+	_, err := DecodeScaled(dec, data, 5)
+	assert.Nil(err)
+	assert.Equal(1, dec.scaled, "a ScaledDecoder shrinks by itself")
+	assert.Equal(4, dec.denom)
+	assert.Equal(0, dec.decodes)
+
+	_, err = DecodeScaled(nil, []byte("not a jpeg"), 2)
+	assert.NotNil(err)
+}
+
+func TestFrameReaderDecoder(t *testing.T) {
+	assert := assert.New(t)
+	data := testJPEG(t, 40, 80)
+	var stream bytes.Buffer
+	for i := 0; i < 2; i++ {
+		binary.Write(&stream, binary.LittleEndian, uint32(len(data)))
+		stream.Write(data)
+	}
+	dec := &countingDecoder{}
+	s := &Service{decoder: dec}
+	// a display big enough for the frame to maybe be black
+	fr := &frameReader{s: s, rd: bufio.NewReader(&stream), natural: image.Pt(4000, 8000)}
+
+	f, err := fr.next(0)
+	assert.Nil(err)
+	assert.True(f.black, "testJPEG is black")
+	assert.Nil(f.im)
+	assert.Equal(1, dec.scaled, "a thumbnail tells black frames")
+	assert.Equal(8, dec.denom)
+	assert.Equal(0, dec.decodes)
+
+	atomic.StoreInt32(&s.decodeAll, 1)
+	f, err = fr.next(0)
+	assert.Nil(err)
+	assert.Equal(image.Pt(40, 80), f.im.Bounds().Size())
+	assert.Equal(1, dec.decodes, "captured frames are fully decoded")
+
+	// subscribers and pipelines decode with the decoder of the service too
+	_, err = f.frame.Decode()
+	assert.Nil(err)
+	assert.Equal(2, dec.decodes)
+	_, err = ResizeStage(0.5).Process(context.Background(), f.frame)
+	assert.Nil(err)
+	assert.Equal(2, dec.scaled)
+}
+
+func TestResizeStageScaled(t *testing.T) {
+	assert := assert.New(t)
+	dec := &countingDecoder{}
+	DefaultDecoder = dec
+	defer func() { DefaultDecoder = StdDecoder{} }()
+
+	f := &Frame{Data: testJPEG(t, 100, 200)}
+	out, err := ResizeStage(0.3).Process(context.Background(), f)
+	assert.Nil(err)
+	assert.Equal(image.Pt(30, 60), out.Image.Bounds().Size())
+	assert.Equal(1, dec.scaled)
+	assert.Equal(2, dec.denom)
+	assert.Equal(0, dec.decodes, "the frame is not decoded at full resolution")
+}
+
+func BenchmarkStdDecoder(b *testing.B) {
+	// color frames decode into image.YCbCr, like the ones of minicap
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 720, 1280)), nil); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, denom := range []int{1, 2} {
+		b.Run(fmt.Sprintf("1/%d", denom), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeScaled(StdDecoder{}, data, denom); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,98 +1,53 @@
 package main
 
 import (
-	"bytes"
+	"flag"
 	"fmt"
 	"html/template"
-	"image"
-	"image/jpeg"
 	"log"
 	"net/http"
 
-	"github.com/gorilla/websocket"
-	"github.com/nfnt/resize"
 	minicap "github.com/openatx/go-minicap"
 )
 
-var (
-	imC      <-chan image.Image
-	upgrader = websocket.Upgrader{}
-)
-
-func test() {
-	m, err := minicap.NewService(minicap.Options{Serial: "EP7333W7XB"})
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = m.Install()
-	if err != nil {
-		log.Fatal(err)
-	}
-	imC, err = m.Capture()
-	imC = m.LimitedSampling(imC, 10)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func hIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	tmpl := template.Must(template.New("t").ParseFiles("index.html"))
 	tmpl.ExecuteTemplate(w, "index.html", nil)
 }
 
-func hImageWs(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+func main() {
+	serial := flag.String("s", "EP7333W7XB", "device serial")
+	port := flag.Int("p", 7000, "listen port")
+	control := flag.Bool("control", true, "allow remote control with minitouch")
+	flag.Parse()
+
+	m, err := minicap.NewService(minicap.Options{Serial: *serial})
 	if err != nil {
-		log.Println("upgrade err:", err)
-		return
+		log.Fatal(err)
+	}
+	if err = m.Install(); err != nil {
+		log.Fatal(err)
+	}
+	if err = m.Start(); err != nil {
+		log.Fatal(err)
 	}
-	done := make(chan bool, 1)
-	go func() {
-		buf := new(bytes.Buffer)
-		buf.Reset()
-		log.Println("Prepare websocket send", imC)
-		for im := range imC {
-			select {
-			case <-done:
-				log.Println("finished")
-				return
-			default:
-			}
-			size := im.Bounds().Size()
-			newIm := resize.Resize(uint(size.X)/2, 0, im, resize.Lanczos3)
-			wr, err := c.NextWriter(websocket.BinaryMessage)
-			if err != nil {
-				log.Println(err)
-				break
-			}
 
-			if err := jpeg.Encode(wr, newIm, nil); err != nil {
-				break
-			}
-			wr.Close()
+	log.Printf("server listern on http://localhost:%d ...", *port)
+	http.HandleFunc("/", hIndex)
+	ws := minicap.NewWebSocketHandler(m)
+	if *control {
+		t, err := m.Touch()
+		if err == nil {
+			err = t.Start()
 		}
-	}()
-	for {
-		mt, p, err := c.ReadMessage()
 		if err != nil {
-			log.Println(err)
-			done <- true
-			break
+			log.Fatal(err)
 		}
-		log.Println(mt, p, err)
+		defer t.Close()
+		ws.Input = t
 	}
-}
-
-func startWebServer(port int) {
-	log.Printf("server listern on http://localhost:%d ...", port)
-
-	http.HandleFunc("/", hIndex)
-	http.HandleFunc("/ws", hImageWs)
-	http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
-}
-
-func main() {
-	test()
-	startWebServer(7000)
+	http.Handle("/ws", ws)
+	http.Handle("/mjpeg/", http.StripPrefix("/mjpeg", minicap.NewMJPEGHandler(m)))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", *port), nil))
 }
@@ -10,11 +10,11 @@ package minicap
 import (
 	"errors"
 	"fmt"
-	"log"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	adb "github.com/zach-klippenstein/goadb"
 )
@@ -24,6 +24,8 @@ type AdbDevice struct {
 	AdbPath string
 	*adb.Adb
 	*adb.Device
+
+	log Logger
 }
 
 type DisplayInfo struct {
@@ -32,30 +34,51 @@ type DisplayInfo struct {
 	Orientation int `json:"orientation"`
 }
 
-func newAdbDevice(serial, AdbPath string) (d AdbDevice, err error) {
+func newAdbClient() (client *adb.Adb, err error) {
+	client, err = adb.NewWithConfig(adb.ServerConfig{
+		Port: 5037,
+	})
+	if err != nil {
+		return
+	}
+	client.StartServer()
+	return
+}
+
+// attachAdbDevice binds serial to an existing adb client, so that many
+// devices can share the same server connection.
+func attachAdbDevice(client *adb.Adb, serial, AdbPath string, logger Logger) (d AdbDevice, err error) {
 	if serial == "" {
 		err = errors.New("serial cannot be empty")
 		return
 	}
 	d.Serial = serial
+	d.log = withFields(logger, "serial", serial)
 	if AdbPath == "" {
 		d.AdbPath = "adb"
 	} else {
 		d.AdbPath = AdbPath
 	}
-	d.Adb, err = adb.NewWithConfig(adb.ServerConfig{
-		Port: 5037,
-	})
-	d.Adb.StartServer()
+	d.Adb = client
 	d.Device = d.Adb.Device(adb.DeviceWithSerial(serial))
 	return
 }
 
+// logger never returns nil, devices created in tests have no logger
+func (d *AdbDevice) logger() Logger {
+	if d.log == nil {
+		return nopLogger{}
+	}
+	return d.log
+}
+
 func (d *AdbDevice) shell(cmds ...string) (out string, err error) {
 	args := []string{"-s", d.Serial, "shell"}
 	cmds = append(cmds, ";", "echo", ":$?")
 	args = append(args, cmds...)
+	start := time.Now()
 	output, err := exec.Command(d.AdbPath, args...).Output()
+	d.logger().Debug("adb shell", "args", cmds[:len(cmds)-3], "duration", time.Since(start), "err", err)
 	if err != nil {
 		return
 	}
@@ -73,6 +96,7 @@ func (d *AdbDevice) buildCommand(cmds ...string) (out *exec.Cmd) {
 	args := []string{}
 	args = append(args, "-s", d.Serial, "shell")
 	args = append(args, cmds...)
+	d.logger().Debug("adb shell start", "args", cmds)
 	return exec.Command(d.AdbPath, args...)
 }
 
@@ -80,7 +104,9 @@ func (d *AdbDevice) run(cmds ...string) (out string, err error) {
 	args := []string{}
 	args = append(args, "-s", d.Serial)
 	args = append(args, cmds...)
+	start := time.Now()
 	output, err := exec.Command(d.AdbPath, args...).Output()
+	d.logger().Debug("adb", "args", cmds, "duration", time.Since(start), "err", err)
 	if err != nil {
 		return
 	}
@@ -138,9 +164,10 @@ func (d *AdbDevice) getDisplayInfo() (info DisplayInfo, err error) {
 			break
 		}
 
+		d.logger().Debug("display info", "width", info.Width, "height", info.Height, "orientation", info.Orientation)
 		return
 	}
-	log.Println(info)
+	d.logger().Warn("display info not found in dumpsys display", "err", err)
 	// TODO(ssx): use some other method
 	// info.Orientation = 0
 	// info.Width = 720
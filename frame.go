@@ -0,0 +1,307 @@
+package minicap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Banner is the global header sent by minicap when a client connects.
+// See https://github.com/openstf/minicap#usage
+type Banner struct {
+	Version       int `json:"version"`
+	PID           int `json:"pid"`
+	RealWidth     int `json:"realWidth"`
+	RealHeight    int `json:"realHeight"`
+	VirtualWidth  int `json:"virtualWidth"`
+	VirtualHeight int `json:"virtualHeight"`
+	Orientation   int `json:"orientation"` // in degrees
+	Quirks        int `json:"quirks"`
+}
+
+func readBanner(rd io.Reader) (b Banner, err error) {
+	var raw struct {
+		Version     uint8
+		Length      uint8
+		PID         uint32
+		RealW       uint32
+		RealH       uint32
+		VirtualW    uint32
+		VirtualH    uint32
+		Orientation uint8
+		Quirks      uint8
+	}
+	if err = binary.Read(rd, binary.LittleEndian, &raw); err != nil {
+		return
+	}
+	b = Banner{
+		Version:       int(raw.Version),
+		PID:           int(raw.PID),
+		RealWidth:     int(raw.RealW),
+		RealHeight:    int(raw.RealH),
+		VirtualWidth:  int(raw.VirtualW),
+		VirtualHeight: int(raw.VirtualH),
+		Orientation:   int(raw.Orientation) * 90,
+		Quirks:        int(raw.Quirks),
+	}
+	return
+}
+
+// Frame is a single JPEG image as sent by minicap.
+// Frames are shared between subscribers and must not be modified.
+//
+// The data of frames read from minicap lives in pooled buffers. A frame
+// received from a Subscription or LastFrame holds a reference on its buffer,
+// a consumer done with the frame may give it back with Release so the buffer
+// is reused for a later frame. Frames that are never released are garbage
+// collected like any other value. Retain keeps a frame past a Release done
+// by someone else, e.g. when handing it to another goroutine.
+type Frame struct {
+	Data        []byte      // JPEG bytes, nil when Image was changed by a pipeline stage
+	Time        time.Time   // when the frame was received
+	Orientation int         // orientation of the image in degrees, 0 with RotationNatural
+	Hash        uint64      // perceptual hash (DHash), 0 if not computed
+	Image       image.Image // decoded image, set by pipeline stages
+
+	buf *frameBuffer // holds Data, nil if not pooled
+	dec Decoder      // Options.Decoder of the service that read the frame
+}
+
+// frameBuffer is a reference counted buffer from framePool
+type frameBuffer struct {
+	data []byte
+	refs int32
+}
+
+var framePool sync.Pool
+
+// getFrameBuffer returns a buffer of size bytes with one reference
+func getFrameBuffer(size int) *frameBuffer {
+	buf, _ := framePool.Get().(*frameBuffer)
+	if buf == nil {
+		buf = &frameBuffer{}
+	}
+	buf.resize(size)
+	buf.refs = 1
+	return buf
+}
+
+// resize the buffer to size bytes, its content is lost when it grows
+func (buf *frameBuffer) resize(size int) {
+	if cap(buf.data) < size {
+		buf.data = make([]byte, size, size+size/4) // room for slightly bigger frames
+	}
+	buf.data = buf.data[:size]
+}
+
+// Retain adds a reference to the data of f, to be given back with Release
+func (f *Frame) Retain() *Frame {
+	if f.buf != nil {
+		atomic.AddInt32(&f.buf.refs, 1)
+	}
+	return f
+}
+
+// Release gives back a reference to the data of f, which must not be used
+// afterwards. Frames that are not pooled ignore it.
+func (f *Frame) Release() {
+	if f.buf == nil {
+		return
+	}
+	if atomic.AddInt32(&f.buf.refs, -1) == 0 {
+		framePool.Put(f.buf)
+	}
+}
+
+// setData replaces the data of f by the data of buf, releasing the old buffer
+func (f *Frame) setData(buf *frameBuffer) {
+	old := f.buf
+	f.buf = buf
+	f.Data = buf.data
+	if old != nil && atomic.AddInt32(&old.refs, -1) == 0 {
+		framePool.Put(old)
+	}
+}
+
+// readFrame reads a frame into a pooled buffer, the caller owns its reference
+func readFrame(rd io.Reader) (f *Frame, err error) {
+	buf := getFrameBuffer(4) // the size header, read into the buffer to not allocate
+	if _, err = io.ReadFull(rd, buf.data); err != nil {
+		framePool.Put(buf)
+		return
+	}
+	// the frame is timed from its first byte, the transfer counts to its latency
+	received := time.Now()
+	buf.resize(int(binary.LittleEndian.Uint32(buf.data)))
+	if _, err = io.ReadFull(rd, buf.data); err != nil {
+		framePool.Put(buf)
+		return
+	}
+	return &Frame{Data: buf.data, Time: received, buf: buf}, nil
+}
+
+// Decode the JPEG data of the frame with the decoder of its service,
+// DefaultDecoder if it has none
+func (f *Frame) Decode() (image.Image, error) {
+	if f.Image != nil {
+		return f.Image, nil
+	}
+	return f.decoder().Decode(f.Data)
+}
+
+// DecodeScaled decodes the frame shrunk by 1/denom (1, 2, 4 or 8), see DecodeScaled
+func (f *Frame) DecodeScaled(denom int) (image.Image, error) {
+	if f.Image != nil {
+		denom = scaleDenom(denom)
+		size := f.Image.Bounds().Size()
+		return resizeImage(f.Image, (size.X+denom-1)/denom, (size.Y+denom-1)/denom), nil
+	}
+	return DecodeScaled(f.decoder(), f.Data, denom)
+}
+
+// decoder of the frame, DefaultDecoder unless read by a service with Options.Decoder
+func (f *Frame) decoder() Decoder {
+	if f.dec == nil {
+		return DefaultDecoder
+	}
+	return f.dec
+}
+
+// Size of the frame, read from the JPEG header without decoding
+func (f *Frame) Size() (size image.Point, err error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(f.Data))
+	if err != nil {
+		return
+	}
+	return image.Pt(cfg.Width, cfg.Height), nil
+}
+
+// FrameSource is anything frames can be subscribed from, such as a capturing Service
+type FrameSource interface {
+	Subscribe(size int) *Subscription
+}
+
+// Subscription receives raw frames from a Service.
+// A subscriber that does not keep up loses the oldest frames, capture is never blocked.
+type Subscription struct {
+	c       chan *Frame
+	hub     *frameHub
+	id      uint64
+	dropped uint64
+}
+
+// C returns the channel of frames, it is closed when the subscription or the service is closed.
+// Subscribing to a closed service returns a closed channel.
+func (sub *Subscription) C() <-chan *Frame {
+	return sub.c
+}
+
+// Dropped returns how many frames were discarded because the subscriber was too slow
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// ID identifies the subscription in Stats
+func (sub *Subscription) ID() uint64 {
+	return sub.id
+}
+
+// Close stops delivering frames
+func (sub *Subscription) Close() {
+	sub.hub.unsubscribe(sub)
+}
+
+// frameHub fans frames out to subscriptions
+type frameHub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	lastID uint64
+	closed bool // no more frames, new subscriptions are closed at once
+}
+
+func (h *frameHub) subscribe(size int) *Subscription {
+	if size < 1 {
+		size = 1
+	}
+	sub := &Subscription{
+		c:   make(chan *Frame, size),
+		hub: h,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[*Subscription]struct{})
+	}
+	h.lastID++
+	sub.id = h.lastID
+	if h.closed {
+		close(sub.c)
+		return sub
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+func (h *frameHub) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.c)
+	}
+}
+
+func (h *frameHub) publish(f *Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		// every subscriber holds a reference
+		f.Retain()
+		select {
+		case sub.c <- f:
+			continue
+		default:
+		}
+		// drop the oldest frame to make room for the newest one
+		select {
+		case old := <-sub.c:
+			old.Release()
+			atomic.AddUint64(&sub.dropped, 1)
+		default:
+		}
+		select {
+		case sub.c <- f:
+		default:
+			f.Release()
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// stats of the current subscriptions, ordered by ID
+func (h *frameHub) stats() (stats []SubscriberStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		stats = append(stats, SubscriberStats{ID: sub.id, Queued: len(sub.c), Dropped: sub.Dropped()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return
+}
+
+// closeAll ends every subscription, and the ones made afterwards
+func (h *frameHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.c)
+	}
+}
@@ -0,0 +1,190 @@
+package minicap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBannerAndFrame(t *testing.T) {
+	assert := assert.New(t)
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{1, 24})
+	binary.Write(buf, binary.LittleEndian, []uint32{1234, 1080, 1920, 540, 960})
+	buf.Write([]byte{1, 2})
+	binary.Write(buf, binary.LittleEndian, uint32(3))
+	buf.Write([]byte{0xff, 0xd8, 0xff})
+
+	banner, err := readBanner(buf)
+	assert.Nil(err)
+	assert.Equal(Banner{
+		Version:       1,
+		PID:           1234,
+		RealWidth:     1080,
+		RealHeight:    1920,
+		VirtualWidth:  540,
+		VirtualHeight: 960,
+		Orientation:   90,
+		Quirks:        2,
+	}, banner)
+
+	f, err := readFrame(buf)
+	assert.Nil(err)
+	assert.Equal([]byte{0xff, 0xd8, 0xff}, f.Data)
+}
+
+func TestFrameHubDropsOldest(t *testing.T) {
+	assert := assert.New(t)
+	var h frameHub
+	sub := h.subscribe(1)
+	f1, f2 := &Frame{Data: []byte{1}}, &Frame{Data: []byte{2}}
+	h.publish(f1)
+	h.publish(f2) // must not block
+	assert.Equal(f2, <-sub.C(), "subscriber should get the newest frame")
+	assert.Equal(uint64(1), sub.Dropped())
+
+	sub.Close()
+	_, ok := <-sub.C()
+	assert.False(ok, "channel should be closed")
+	h.publish(f1) // no subscribers left
+}
+
+func TestSubscribeAfterClose(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	assert.Nil(s.Close())
+	sub := s.Subscribe(1)
+	_, ok := <-sub.C()
+	assert.False(ok, "channel should be closed")
+	sub.Close() // must not close it again
+	assert.Empty(s.Stats().Subscribers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Equal(ErrAlreadyClosed, s.WaitStable(ctx, time.Second, 0.01))
+}
+
+func TestFramePool(t *testing.T) {
+	assert := assert.New(t)
+	buf := new(bytes.Buffer)
+	for i := 0; i < 2; i++ {
+		binary.Write(buf, binary.LittleEndian, uint32(3))
+		buf.Write([]byte{0xff, 0xd8, byte(i)})
+	}
+	f, err := readFrame(buf)
+	assert.Nil(err)
+	assert.Equal(int32(1), f.buf.refs)
+	f.Retain()
+	f.Release()
+	assert.Equal(int32(1), f.buf.refs)
+
+	var h frameHub
+	sub := h.subscribe(1)
+	h.publish(f)
+	assert.Equal(int32(2), f.buf.refs)
+	// dropped frames give back the reference of the subscriber
+	h.publish(&Frame{Data: []byte{1}})
+	assert.Equal(int32(1), f.buf.refs)
+	sub.Close()
+
+	f.Release()
+	assert.Equal(int32(0), f.buf.refs)
+	// not pooled frames ignore it
+	(&Frame{Data: []byte{1}}).Release()
+
+	g, err := readFrame(buf)
+	assert.Nil(err)
+	assert.Equal([]byte{0xff, 0xd8, 1}, g.Data)
+}
+
+// frameStream returns n minicap frames of data
+func frameStream(data []byte, n int) []byte {
+	buf := new(bytes.Buffer)
+	for i := 0; i < n; i++ {
+		binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	stream := frameStream(make([]byte, 100<<10), 1)
+	for _, release := range []bool{false, true} {
+		name := "kept"
+		if release {
+			name = "released"
+		}
+		b.Run(name, func(b *testing.B) {
+			rd := bytes.NewReader(stream)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(stream)))
+			for i := 0; i < b.N; i++ {
+				rd.Reset(stream)
+				f, err := readFrame(rd)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if release {
+					f.Release()
+				}
+			}
+		})
+	}
+}
+
+// pooledFrame returns a copy of f whose data lives in a pooled buffer
+func pooledFrame(f *Frame) *Frame {
+	buf := getFrameBuffer(len(f.Data))
+	copy(buf.data, f.Data)
+	pf := *f
+	pf.Data, pf.buf = buf.data, buf
+	return &pf
+}
+
+// publishReleased publishes pooled copies of frames to s, giving back the
+// reference of the publisher, and waits for the consumers to release them
+func publishReleased(t *testing.T, s *Service, frames ...*Frame) {
+	var pooled []*Frame
+	for _, f := range frames {
+		pf := pooledFrame(f)
+		s.frames.publish(pf)
+		pf.Release()
+		pooled = append(pooled, pf)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		held := 0
+		for _, f := range pooled {
+			if atomic.LoadInt32(&f.buf.refs) != 0 {
+				held++
+			}
+		}
+		if held == 0 {
+			return
+		}
+	}
+	t.Fatal("frames not released by their consumers")
+}
+
+func TestConsumersReleaseFrames(t *testing.T) {
+	s := &Service{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	WatchChanges(ctx, s, time.Hour, ChangeOptions{})
+	go RecordSession(ctx, s, io.Discard)
+	for len(s.Stats().Subscribers) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	var frames []*Frame
+	for i := 0; i < 3; i++ {
+		frames = append(frames, testFrame(t, grayImage(64, 64, uint8(i*80), image.Rectangle{}, 0)))
+	}
+	publishReleased(t, s, frames...)
+}
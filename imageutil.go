@@ -0,0 +1,114 @@
+package minicap
+
+import (
+	"image"
+	"image/draw"
+)
+
+// toRGBA returns im as *image.RGBA with origin at (0, 0), converting only if needed
+func toRGBA(im image.Image) *image.RGBA {
+	if rgba, ok := im.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := im.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, im, b.Min, draw.Src)
+	return rgba
+}
+
+// resizeImage scales im to w x h. Shrinking averages the covered source
+// pixels (box filter), enlarging picks the nearest pixel.
+func resizeImage(im image.Image, w, h int) *image.RGBA {
+	src := toRGBA(im)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w <= 0 || h <= 0 || sw == 0 || sh == 0 {
+		return dst
+	}
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := (y + 1) * sh / h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := (x + 1) * sw / w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				off := sy*src.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[off])
+					g += uint32(src.Pix[off+1])
+					b += uint32(src.Pix[off+2])
+					a += uint32(src.Pix[off+3])
+					off += 4
+					n++
+				}
+			}
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// scaleImage resizes im by factor, keeping the aspect ratio
+func scaleImage(im image.Image, factor float64) *image.RGBA {
+	size := im.Bounds().Size()
+	w := int(float64(size.X)*factor + 0.5)
+	h := int(float64(size.Y)*factor + 0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return resizeImage(im, w, h)
+}
+
+// scaleGray resizes a grayscale image to w x h with a box filter, or
+// nearest pixel when enlarging
+func scaleGray(src *image.Gray, w, h int) *image.Gray {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	if w <= 0 || h <= 0 || sw == 0 || sh == 0 {
+		return dst
+	}
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := (y + 1) * sh / h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := (x + 1) * sw / w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					sum += uint32(row[sx])
+					n++
+				}
+			}
+			dst.Pix[y*dst.Stride+x] = uint8(sum / n)
+		}
+	}
+	return dst
+}
+
+// rotateImage turns im clockwise by degrees, a multiple of 90.
+// Turning upright frames clockwise undoes the rotation of the display.
+func rotateImage(im image.Image, degrees int) image.Image {
+	return RotateImage(im, 360-normOrientation(degrees))
+}
@@ -0,0 +1,167 @@
+package minicap
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// android key codes for the keys viewers usually have buttons for
+const (
+	KeycodeHome       = 3
+	KeycodeBack       = 4
+	KeycodeVolumeUp   = 24
+	KeycodeVolumeDown = 25
+	KeycodePower      = 26
+	KeycodeEnter      = 66
+	KeycodeDel        = 67
+	KeycodeMenu       = 82
+	KeycodeAppSwitch  = 187
+	KeycodeWakeUp     = 224
+)
+
+// Keycodes maps key names used by viewers to android key codes
+var Keycodes = map[string]int{
+	"home":        KeycodeHome,
+	"back":        KeycodeBack,
+	"volume_up":   KeycodeVolumeUp,
+	"volume_down": KeycodeVolumeDown,
+	"power":       KeycodePower,
+	"enter":       KeycodeEnter,
+	"del":         KeycodeDel,
+	"menu":        KeycodeMenu,
+	"app_switch":  KeycodeAppSwitch,
+	"wakeup":      KeycodeWakeUp,
+}
+
+// InputBackend sends input to a device. Points are in screen coordinates,
+// the pixels of the upright frames minicap sends, before Options.Crop.
+type InputBackend interface {
+	TouchDown(contact int, p image.Point) error
+	TouchMove(contact int, p image.Point) error
+	TouchUp(contact int) error
+	Key(keycode int) error // press and release
+	Text(text string) error
+}
+
+// TouchDown puts contact down at p right away
+func (t *Touch) TouchDown(contact int, p image.Point) (err error) {
+	if err = t.Down(contact, p, 0); err != nil {
+		return
+	}
+	return t.Commit()
+}
+
+// TouchMove moves contact to p right away
+func (t *Touch) TouchMove(contact int, p image.Point) (err error) {
+	if err = t.Move(contact, p, 0); err != nil {
+		return
+	}
+	return t.Commit()
+}
+
+// TouchUp lifts contact right away
+func (t *Touch) TouchUp(contact int) (err error) {
+	if err = t.Up(contact); err != nil {
+		return
+	}
+	return t.Commit()
+}
+
+// Key presses keycode, minitouch has no keys so the input command is used
+func (t *Touch) Key(keycode int) error {
+	return shellKey(t.d, keycode)
+}
+
+// Text types text with the input command
+func (t *Touch) Text(text string) error {
+	return shellText(t.d, text)
+}
+
+// ShellInput sends input with the android input command. It works without
+// installing anything, but every event takes a round trip through adb shell
+// and touches are only sent when lifted, as a tap or a swipe.
+type ShellInput struct {
+	d AdbDevice
+
+	mu      sync.Mutex
+	touches map[int]*shellTouch
+}
+
+type shellTouch struct {
+	from, to image.Point
+	start    time.Time
+}
+
+// ShellInput returns an InputBackend using the input command on the device of s
+func (s *Service) ShellInput() *ShellInput {
+	return &ShellInput{d: s.d, touches: make(map[int]*shellTouch)}
+}
+
+func (in *ShellInput) TouchDown(contact int, p image.Point) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.touches[contact] = &shellTouch{from: p, to: p, start: time.Now()}
+	return nil
+}
+
+func (in *ShellInput) TouchMove(contact int, p image.Point) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if st, ok := in.touches[contact]; ok {
+		st.to = p
+	}
+	return nil
+}
+
+// TouchUp sends the touch as a tap, or as a swipe if it moved
+func (in *ShellInput) TouchUp(contact int) (err error) {
+	in.mu.Lock()
+	st, ok := in.touches[contact]
+	delete(in.touches, contact)
+	in.mu.Unlock()
+	if !ok {
+		return
+	}
+	d := st.to.Sub(st.from)
+	if d.X*d.X+d.Y*d.Y < 10*10 {
+		_, err = in.d.shell("input", "tap", strconv.Itoa(st.from.X), strconv.Itoa(st.from.Y))
+		return
+	}
+	_, err = in.d.shell("input", "swipe",
+		strconv.Itoa(st.from.X), strconv.Itoa(st.from.Y),
+		strconv.Itoa(st.to.X), strconv.Itoa(st.to.Y),
+		strconv.FormatInt(time.Since(st.start).Milliseconds(), 10))
+	return
+}
+
+func (in *ShellInput) Key(keycode int) error {
+	return shellKey(in.d, keycode)
+}
+
+func (in *ShellInput) Text(text string) error {
+	return shellText(in.d, text)
+}
+
+func shellKey(d AdbDevice, keycode int) (err error) {
+	_, err = d.shell("input", "keyevent", strconv.Itoa(keycode))
+	return
+}
+
+func shellText(d AdbDevice, text string) (err error) {
+	if text == "" {
+		return
+	}
+	_, err = d.shell("input", "text", quoteInputText(text))
+	return
+}
+
+// quoteInputText quotes text for the device shell, spaces are sent as %s
+// which the input command types as a space.
+func quoteInputText(text string) string {
+	text = strings.Replace(text, " ", "%s", -1)
+	return fmt.Sprintf("'%s'", strings.Replace(text, "'", `'\''`, -1))
+}
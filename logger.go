@@ -0,0 +1,81 @@
+package minicap
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Logger receives the log of the library as a message with key value
+// pairs, *slog.Logger implements it. Nothing is logged by default.
+//
+//	minicap.NewService(minicap.Options{Serial: serial, Logger: slog.Default()})
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// fieldLogger adds key value pairs to every message, like slog.Logger.With
+type fieldLogger struct {
+	l      Logger
+	fields []interface{}
+}
+
+// withFields returns a Logger adding the key value pairs args to every message
+func withFields(l Logger, args ...interface{}) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	if _, ok := l.(nopLogger); ok {
+		return l
+	}
+	if fl, ok := l.(*fieldLogger); ok {
+		return &fieldLogger{l: fl.l, fields: append(append([]interface{}(nil), fl.fields...), args...)}
+	}
+	return &fieldLogger{l: l, fields: args}
+}
+
+func (fl *fieldLogger) with(args []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(fl.fields)+len(args)), fl.fields...), args...)
+}
+
+func (fl *fieldLogger) Debug(msg string, args ...interface{}) { fl.l.Debug(msg, fl.with(args)...) }
+func (fl *fieldLogger) Info(msg string, args ...interface{})  { fl.l.Info(msg, fl.with(args)...) }
+func (fl *fieldLogger) Warn(msg string, args ...interface{})  { fl.l.Warn(msg, fl.with(args)...) }
+func (fl *fieldLogger) Error(msg string, args ...interface{}) { fl.l.Error(msg, fl.with(args)...) }
+
+// maxLogLine is the longest line logWriter buffers before logging it
+const maxLogLine = 4096
+
+// logWriter logs every line written to it at debug level, e.g. the stderr of a process
+type logWriter struct {
+	l   Logger
+	msg string
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 && len(w.buf) < maxLogLine {
+			break
+		}
+		if i < 0 {
+			i = len(w.buf)
+		}
+		if line := strings.TrimSpace(string(w.buf[:i])); line != "" {
+			w.l.Debug(w.msg, "line", line)
+		}
+		w.buf = w.buf[minInt(i+1, len(w.buf)):]
+	}
+	return len(p), nil
+}
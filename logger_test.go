@@ -0,0 +1,54 @@
+package minicap
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var _ Logger = slog.Default()
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) log(level, msg string, args []interface{}) {
+	l.lines = append(l.lines, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args) }
+
+func TestWithFields(t *testing.T) {
+	l := &testLogger{}
+	device := withFields(l, "serial", "abc")
+	session := withFields(device, "session", "s1")
+	session.Info("minicap connected", "pid", 42)
+	device.Warn("restart")
+	assert.Equal(t, []string{
+		"INFO minicap connected [serial abc session s1 pid 42]",
+		"WARN restart [serial abc]",
+	}, l.lines)
+
+	// nothing is logged without a logger
+	assert.Equal(t, nopLogger{}, withFields(nil, "serial", "abc"))
+	var d AdbDevice
+	d.logger().Debug("adb")
+	var s Service
+	s.logger().Error("boom")
+}
+
+func TestLogWriter(t *testing.T) {
+	l := &testLogger{}
+	w := &logWriter{l: l, msg: "stderr"}
+	fmt.Fprint(w, "Exception in thread\n  at Rot")
+	fmt.Fprint(w, "ation.main\n\n")
+	assert.Equal(t, []string{
+		"DEBUG stderr [line Exception in thread]",
+		"DEBUG stderr [line at Rotation.main]",
+	}, l.lines)
+}
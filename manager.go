@@ -0,0 +1,369 @@
+package minicap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	adb "github.com/zach-klippenstein/goadb"
+)
+
+var (
+	ErrManagerClosed = errors.New("manager closed")
+	ErrNoFreePort    = errors.New("no free forward port")
+)
+
+type DeviceEventType int
+
+const (
+	DeviceAttached DeviceEventType = iota
+	DeviceDetached
+)
+
+func (t DeviceEventType) String() string {
+	switch t {
+	case DeviceAttached:
+		return "attached"
+	case DeviceDetached:
+		return "detached"
+	}
+	return fmt.Sprintf("DeviceEventType(%d)", int(t))
+}
+
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Serial string
+}
+
+type ManagerOptions struct {
+	Adb string // path to adb, default "adb"
+
+	// Local ports used for adb forward are taken from [PortBase, PortBase+PortCount).
+	// If PortCount is 0, ports are picked by the system.
+	PortBase  int
+	PortCount int
+
+	Logger Logger // passed on to the services, nil logs nothing
+}
+
+// Manager tracks devices through adb track-devices and keeps one capture
+// Service per serial. All services share the same adb client.
+type Manager struct {
+	opt    ManagerOptions
+	client *adb.Adb
+	ports  *portPool
+
+	mu           sync.Mutex
+	devices      map[string]bool
+	services     map[string]*Service
+	eventC       chan DeviceEvent
+	eventsClosed bool // no more events, eventC is closed once created
+	watcher      *adb.DeviceWatcher
+	closed       bool
+	done         chan struct{}
+}
+
+func NewManager(opt ManagerOptions) (m *Manager, err error) {
+	client, err := newAdbClient()
+	if err != nil {
+		return
+	}
+	m = &Manager{
+		opt:      opt,
+		client:   client,
+		ports:    newPortPool(opt.PortBase, opt.PortCount),
+		devices:  make(map[string]bool),
+		services: make(map[string]*Service),
+		done:     make(chan struct{}),
+	}
+	return
+}
+
+// Start tracking devices. Devices already online are reported as attached.
+func (m *Manager) Start() (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	if m.watcher != nil {
+		return nil
+	}
+	serials, err := onlineDevices(m.client)
+	if err != nil {
+		return
+	}
+	var events []DeviceEvent
+	for _, serial := range serials {
+		if event, ok := m.attach(serial); ok {
+			events = append(events, event)
+		}
+	}
+	m.watcher = m.client.NewDeviceWatcher()
+	go m.track(m.watcher, events)
+	return nil
+}
+
+// track is the only goroutine sending to eventC, and closes it when the
+// watcher is shut down.
+func (m *Manager) track(w *adb.DeviceWatcher, events []DeviceEvent) {
+	defer m.closeEvents()
+	for _, event := range events {
+		m.emit(event)
+	}
+	for change := range w.C() {
+		var event DeviceEvent
+		var stale *Service
+		var ok bool
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
+		if change.CameOnline() {
+			event, ok = m.attach(change.Serial)
+		} else if change.WentOffline() {
+			event, stale, ok = m.detach(change.Serial)
+		}
+		m.mu.Unlock()
+		// closing waits for the service to stop, not while holding m.mu
+		m.release(stale)
+		if ok {
+			m.emit(event)
+		}
+	}
+}
+
+// Events returns the channel of attach/detach events, closed once the
+// manager is closed.
+// Once called, the channel must be drained, otherwise device tracking blocks.
+func (m *Manager) Events() <-chan DeviceEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.eventC == nil {
+		m.eventC = make(chan DeviceEvent, 16)
+		if m.eventsClosed {
+			close(m.eventC)
+		}
+	}
+	return m.eventC
+}
+
+// Devices returns the serials of online devices
+func (m *Manager) Devices() (serials []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for serial := range m.devices {
+		serials = append(serials, serial)
+	}
+	return
+}
+
+// Service returns the capture service of serial, created on first use,
+// and again once the previous one has been closed.
+func (m *Manager) Service(serial string) (s *Service, err error) {
+	m.mu.Lock()
+	if s, ok := m.services[serial]; ok && s.State() == StateStopped {
+		// already closed, only its port is left to free, not while holding m.mu
+		m.remove(serial)
+		m.mu.Unlock()
+		m.release(s)
+		m.mu.Lock()
+	}
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+	if s, ok := m.services[serial]; ok {
+		return s, nil
+	}
+	if !m.devices[serial] {
+		return nil, fmt.Errorf("device %s not online", serial)
+	}
+	s, err = newService(Options{Serial: serial, Adb: m.opt.Adb, Logger: m.opt.Logger}, m.client)
+	if err != nil {
+		return
+	}
+	s.lforwardPort, err = m.ports.acquire()
+	if err != nil {
+		return nil, err
+	}
+	m.services[serial] = s
+	return
+}
+
+// Close all services and stop tracking devices
+func (m *Manager) Close() (err error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	close(m.done)
+	var services []*Service
+	for serial := range m.services {
+		services = append(services, m.remove(serial))
+	}
+	if m.watcher != nil {
+		m.watcher.Shutdown()
+	} else {
+		m.closeEventsLocked()
+	}
+	m.mu.Unlock()
+	for _, s := range services {
+		m.release(s)
+	}
+	return nil
+}
+
+// must be called with m.mu held
+func (m *Manager) attach(serial string) (event DeviceEvent, ok bool) {
+	if m.devices[serial] {
+		return
+	}
+	m.devices[serial] = true
+	return DeviceEvent{Type: DeviceAttached, Serial: serial}, true
+}
+
+// detach returns the service of serial, to be released once m.mu is unlocked
+// must be called with m.mu held
+func (m *Manager) detach(serial string) (event DeviceEvent, s *Service, ok bool) {
+	if !m.devices[serial] {
+		return
+	}
+	delete(m.devices, serial)
+	return DeviceEvent{Type: DeviceDetached, Serial: serial}, m.remove(serial), true
+}
+
+// remove forgets the service of serial, nil if there is none
+// must be called with m.mu held
+func (m *Manager) remove(serial string) *Service {
+	s := m.services[serial]
+	delete(m.services, serial)
+	return s
+}
+
+// release closes a removed service and frees its port.
+// Closing can take a while, it should not be called with m.mu held.
+func (m *Manager) release(s *Service) {
+	if s == nil {
+		return
+	}
+	if !s.IsClosed() {
+		s.Close()
+	}
+	m.ports.release(s.lforwardPort)
+}
+
+func (m *Manager) emit(event DeviceEvent) {
+	m.mu.Lock()
+	eventC := m.eventC
+	m.mu.Unlock()
+	if eventC == nil {
+		return
+	}
+	select {
+	case eventC <- event:
+	case <-m.done:
+	}
+}
+
+func (m *Manager) closeEvents() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeEventsLocked()
+}
+
+// must be called with m.mu held
+func (m *Manager) closeEventsLocked() {
+	if m.eventC != nil && !m.eventsClosed {
+		close(m.eventC)
+	}
+	m.eventsClosed = true
+}
+
+// ListDevices returns the serials of the devices adb lists as online,
+// without tracking them like a Manager.
+func ListDevices() (serials []string, err error) {
+	client, err := newAdbClient()
+	if err != nil {
+		return
+	}
+	return onlineDevices(client)
+}
+
+// onlineDevices leaves out offline and unauthorized devices, which can not
+// be captured
+func onlineDevices(client *adb.Adb) (serials []string, err error) {
+	all, err := client.ListDeviceSerials()
+	if err != nil {
+		return
+	}
+	for _, serial := range all {
+		state, err := client.Device(adb.DeviceWithSerial(serial)).State()
+		if err == nil && state == adb.StateOnline {
+			serials = append(serials, serial)
+		}
+	}
+	return
+}
+
+// portPool hands out local ports for adb forward, never giving the same
+// port to two services.
+type portPool struct {
+	mu    sync.Mutex
+	base  int
+	count int
+	used  map[int]bool
+}
+
+func newPortPool(base, count int) *portPool {
+	return &portPool{
+		base:  base,
+		count: count,
+		used:  make(map[int]bool),
+	}
+}
+
+func (p *portPool) acquire() (port int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.count == 0 {
+		for i := 0; i < 10; i++ {
+			port, err = freePort()
+			if err != nil {
+				return
+			}
+			if !p.used[port] {
+				p.used[port] = true
+				return
+			}
+		}
+		return 0, ErrNoFreePort
+	}
+	for port = p.base; port < p.base+p.count; port++ {
+		if p.used[port] || !isPortFree(port) {
+			continue
+		}
+		p.used[port] = true
+		return port, nil
+	}
+	return 0, ErrNoFreePort
+}
+
+func (p *portPool) release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, port)
+}
+
+func isPortFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
@@ -0,0 +1,94 @@
+package minicap
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortPoolRange(t *testing.T) {
+	assert := assert.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, portString, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	base, _ := strconv.Atoi(portString)
+
+	pool := newPortPool(base, 2)
+	p1, err := pool.acquire()
+	assert.Nil(err)
+	p2, err := pool.acquire()
+	assert.Nil(err)
+	assert.NotEqual(p1, p2, "ports should not collide")
+
+	_, err = pool.acquire()
+	assert.Equal(ErrNoFreePort, err)
+
+	pool.release(p1)
+	p3, err := pool.acquire()
+	assert.Nil(err)
+	assert.Equal(p1, p3, "released port should be reused")
+}
+
+func TestPortPoolSystem(t *testing.T) {
+	pool := newPortPool(0, 0)
+	seen := make(map[int]bool)
+	for i := 0; i < 5; i++ {
+		port, err := pool.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[port] {
+			t.Fatalf("port %d allocated twice", port)
+		}
+		seen[port] = true
+	}
+}
+
+func TestManagerServiceStopped(t *testing.T) {
+	assert := assert.New(t)
+	m := &Manager{
+		ports:    newPortPool(0, 0),
+		devices:  make(map[string]bool),
+		services: make(map[string]*Service),
+		done:     make(chan struct{}),
+	}
+	s := &Service{}
+	var err error
+	s.lforwardPort, err = m.ports.acquire()
+	assert.Nil(err)
+	m.services["emulator-5554"] = s
+	got, err := m.Service("emulator-5554")
+	assert.Nil(err)
+	assert.Equal(s, got)
+
+	// closed by the caller, the next call does not return it again
+	s.Close()
+	_, err = m.Service("emulator-5554")
+	assert.NotNil(err, "device is not online")
+	assert.Empty(m.services)
+	assert.Empty(m.ports.used, "the port is freed")
+
+	assert.Nil(m.Close())
+	assert.Equal(ErrManagerClosed, m.Close())
+}
+
+func TestManagerEventsClosed(t *testing.T) {
+	m := &Manager{
+		devices:  make(map[string]bool),
+		services: make(map[string]*Service),
+		done:     make(chan struct{}),
+	}
+	assert.Nil(t, m.Close())
+	select {
+	case _, ok := <-m.Events():
+		assert.False(t, ok, "no events after Close")
+	case <-time.After(time.Second):
+		t.Fatal("events of a closed manager are not closed")
+	}
+}
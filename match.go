@@ -0,0 +1,299 @@
+package minicap
+
+import (
+	"context"
+	"image"
+	"math"
+	"sort"
+)
+
+// Match is where a template was found on the screen
+type Match struct {
+	Rect       image.Rectangle // in frame coordinates
+	Confidence float64         // normalized cross-correlation, 1 is a perfect match
+}
+
+type MatchOptions struct {
+	Threshold float64   // minimum confidence, default 0.9
+	Scales    []float64 // template scales to try for other screen densities, default 1
+	MaxWidth  int       // frames are shrunk to this width before searching, default 480
+}
+
+func (opt *MatchOptions) defaults() {
+	if opt.Threshold <= 0 {
+		opt.Threshold = 0.9
+	}
+	if len(opt.Scales) == 0 {
+		opt.Scales = []float64{1}
+	}
+	if opt.MaxWidth <= 0 {
+		opt.MaxWidth = 480
+	}
+}
+
+// grayF is a grayscale image with integral images for fast window sums
+type grayF struct {
+	w, h  int
+	pix   []float64
+	sum   []float64 // (w+1)*(h+1) integral of pix
+	sqsum []float64 // integral of pix^2
+}
+
+func newGrayF(g *image.Gray) *grayF {
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	f := &grayF{
+		w:     w,
+		h:     h,
+		pix:   make([]float64, w*h),
+		sum:   make([]float64, (w+1)*(h+1)),
+		sqsum: make([]float64, (w+1)*(h+1)),
+	}
+	for y := 0; y < h; y++ {
+		var rowSum, rowSq float64
+		for x := 0; x < w; x++ {
+			v := float64(g.Pix[y*g.Stride+x])
+			f.pix[y*w+x] = v
+			rowSum += v
+			rowSq += v * v
+			i := (y+1)*(w+1) + x + 1
+			f.sum[i] = f.sum[i-w-1] + rowSum
+			f.sqsum[i] = f.sqsum[i-w-1] + rowSq
+		}
+	}
+	return f
+}
+
+// windowStats returns sum and sum of squares of the w x h window at (x, y)
+func (f *grayF) windowStats(x, y, w, h int) (sum, sqsum float64) {
+	s := f.w + 1
+	a, b, c, d := y*s+x, y*s+x+w, (y+h)*s+x, (y+h)*s+x+w
+	return f.sum[d] - f.sum[b] - f.sum[c] + f.sum[a],
+		f.sqsum[d] - f.sqsum[b] - f.sqsum[c] + f.sqsum[a]
+}
+
+// zeroMean returns the pixels of f minus their mean, and their norm
+func (f *grayF) zeroMean() (pix []float64, norm float64) {
+	var mean float64
+	for _, v := range f.pix {
+		mean += v
+	}
+	mean /= float64(len(f.pix))
+	pix = make([]float64, len(f.pix))
+	for i, v := range f.pix {
+		pix[i] = v - mean
+		norm += pix[i] * pix[i]
+	}
+	return pix, math.Sqrt(norm)
+}
+
+// ncc computes the normalized cross-correlation of template t at (x, y) of f
+func (f *grayF) ncc(t *grayF, tpix []float64, tnorm float64, x, y int) float64 {
+	n := float64(t.w * t.h)
+	sum, sqsum := f.windowStats(x, y, t.w, t.h)
+	variance := sqsum - sum*sum/n
+	if variance < 1e-6 || tnorm < 1e-6 {
+		return 0 // flat areas match nothing
+	}
+	var dot float64
+	for ty := 0; ty < t.h; ty++ {
+		row := f.pix[(y+ty)*f.w+x : (y+ty)*f.w+x+t.w]
+		trow := tpix[ty*t.w : (ty+1)*t.w]
+		for i, v := range row {
+			dot += v * trow[i]
+		}
+	}
+	return dot / (math.Sqrt(variance) * tnorm)
+}
+
+type matchCandidate struct {
+	x, y  int
+	score float64
+}
+
+// search returns the keep best positions of t in f
+func (f *grayF) search(t *grayF, keep int) []matchCandidate {
+	tpix, tnorm := t.zeroMean()
+	var best []matchCandidate
+	for y := 0; y+t.h <= f.h; y++ {
+		for x := 0; x+t.w <= f.w; x++ {
+			score := f.ncc(t, tpix, tnorm, x, y)
+			if len(best) < keep || score > best[len(best)-1].score {
+				best = append(best, matchCandidate{x, y, score})
+				sort.Slice(best, func(i, j int) bool { return best[i].score > best[j].score })
+				if len(best) > keep {
+					best = best[:keep]
+				}
+			}
+		}
+	}
+	return best
+}
+
+// refine searches around (x, y) within radius
+func (f *grayF) refine(t *grayF, x, y, radius int) (best matchCandidate) {
+	tpix, tnorm := t.zeroMean()
+	best.score = -1
+	for cy := y - radius; cy <= y+radius; cy++ {
+		for cx := x - radius; cx <= x+radius; cx++ {
+			if cx < 0 || cy < 0 || cx+t.w > f.w || cy+t.h > f.h {
+				continue
+			}
+			if score := f.ncc(t, tpix, tnorm, cx, cy); score > best.score {
+				best = matchCandidate{cx, cy, score}
+			}
+		}
+	}
+	return
+}
+
+// Matcher searches frames for a template image.
+// The template is prepared once and can be matched against many frames.
+type Matcher struct {
+	opt  MatchOptions
+	tmpl *image.Gray
+}
+
+func NewMatcher(tmpl image.Image, opt MatchOptions) *Matcher {
+	opt.defaults()
+	return &Matcher{
+		opt:  opt,
+		tmpl: grayPlane(tmpl),
+	}
+}
+
+// Find the best match of the template in im, ok is false when the
+// confidence is below the threshold
+func (m *Matcher) Find(im image.Image) (match Match, ok bool) {
+	return m.find(im, im.Bounds().Size())
+}
+
+// find searches im, the frame of the given size possibly shrunk while decoding.
+// The match is in the coordinates of the frame.
+func (m *Matcher) find(im image.Image, size image.Point) (match Match, ok bool) {
+	b := im.Bounds()
+	gray := grayPlane(im)
+	// work on a shrunk frame for speed
+	factor := 1.0
+	if size.X > m.opt.MaxWidth {
+		factor = float64(m.opt.MaxWidth) / float64(size.X)
+	}
+	if w, h := int(float64(size.X)*factor+0.5), int(float64(size.Y)*factor+0.5); w != b.Dx() || h != b.Dy() {
+		gray = scaleGray(gray, w, h)
+	}
+	if size != b.Size() {
+		b.Min = image.Point{} // shrunk images are not offset
+	}
+	frame := newGrayF(gray)
+	var coarseFrame *grayF
+	coarseStep := 0
+
+	match.Confidence = -1
+	tw, th := m.tmpl.Rect.Dx(), m.tmpl.Rect.Dy()
+	for _, scale := range m.opt.Scales {
+		w := int(float64(tw)*scale*factor + 0.5)
+		h := int(float64(th)*scale*factor + 0.5)
+		if w < 2 || h < 2 || w > frame.w || h > frame.h {
+			continue
+		}
+		tmplGray := scaleGray(m.tmpl, w, h)
+		tmpl := newGrayF(tmplGray)
+
+		// search a coarser pyramid level first, then refine the best candidates
+		step := minInt(4, minInt(w, h)/8)
+		var best matchCandidate
+		if step < 2 {
+			best = frame.refine(tmpl, 0, 0, maxInt(frame.w, frame.h))
+		} else {
+			if step != coarseStep {
+				coarseStep = step
+				coarseFrame = newGrayF(scaleGray(gray, frame.w/step, frame.h/step))
+			}
+			coarseTmpl := newGrayF(scaleGray(tmplGray, w/step, h/step))
+			best.score = -1
+			for _, c := range coarseFrame.search(coarseTmpl, 5) {
+				if r := frame.refine(tmpl, c.x*step, c.y*step, step); r.score > best.score {
+					best = r
+				}
+			}
+		}
+		if best.score > match.Confidence {
+			match.Confidence = best.score
+			match.Rect = image.Rect(
+				int(float64(best.x)/factor+0.5), int(float64(best.y)/factor+0.5),
+				int(float64(best.x+w)/factor+0.5), int(float64(best.y+h)/factor+0.5),
+			).Add(b.Min)
+		}
+	}
+	return match, match.Confidence >= m.opt.Threshold
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// FindTemplate searches im for tmpl, see Matcher
+func FindTemplate(im, tmpl image.Image, opt MatchOptions) (Match, bool) {
+	return NewMatcher(tmpl, opt).Find(im)
+}
+
+// WaitImage blocks until tmpl appears in a frame of src
+func WaitImage(ctx context.Context, src FrameSource, tmpl image.Image, opt MatchOptions) (Match, error) {
+	return waitImage(ctx, src, nil, NewMatcher(tmpl, opt))
+}
+
+// waitImage matches first, then the frames of src, releasing them
+func waitImage(ctx context.Context, src FrameSource, first *Frame, m *Matcher) (Match, error) {
+	sub := src.Subscribe(1)
+	defer sub.Close()
+	find := func(f *Frame) (Match, bool) {
+		defer f.Release()
+		size, err := f.Size()
+		if err != nil {
+			return Match{}, false
+		}
+		// the search runs at MaxWidth, decoding a shrunk frame is enough
+		im, err := f.DecodeScaled(size.X / m.opt.MaxWidth)
+		if err != nil {
+			return Match{}, false
+		}
+		return m.find(im, size)
+	}
+	if first != nil {
+		if match, ok := find(first); ok {
+			return match, nil
+		}
+	}
+	for {
+		select {
+		case f, ok := <-sub.C():
+			if !ok {
+				return Match{}, ErrAlreadyClosed
+			}
+			if match, ok := find(f); ok {
+				return match, nil
+			}
+		case <-ctx.Done():
+			return Match{}, ctx.Err()
+		}
+	}
+}
+
+// WaitImage blocks until tmpl appears on the screen with at least threshold confidence.
+// The capture must be running.
+func (s *Service) WaitImage(ctx context.Context, tmpl image.Image, threshold float64) (Match, error) {
+	m := NewMatcher(tmpl, MatchOptions{
+		Threshold: threshold,
+		Scales:    []float64{0.8, 0.9, 1, 1.1, 1.25},
+	})
+	return waitImage(ctx, s, s.LastFrame(), m)
+}
@@ -0,0 +1,109 @@
+package minicap
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// noiseImage returns a blurry random texture, so that every region is unique
+func noiseImage(w, h int, seed int64) *image.Gray {
+	rnd := rand.New(rand.NewSource(seed))
+	small := image.NewGray(image.Rect(0, 0, w/4, h/4))
+	rnd.Read(small.Pix)
+	im := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			im.Pix[y*im.Stride+x] = small.Pix[(y/4)*small.Stride+x/4]
+		}
+	}
+	return im
+}
+
+func crop(im *image.Gray, r image.Rectangle) *image.Gray {
+	dst := image.NewGray(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Rect, im, r.Min, draw.Src)
+	return dst
+}
+
+func TestFindTemplate(t *testing.T) {
+	assert := assert.New(t)
+	screen := noiseImage(720, 1280, 1)
+	rect := image.Rect(300, 600, 420, 680)
+	tmpl := crop(screen, rect)
+
+	m, ok := FindTemplate(screen, tmpl, MatchOptions{})
+	assert.True(ok)
+	assert.InDelta(1.0, m.Confidence, 0.05)
+	assert.InDelta(rect.Min.X, m.Rect.Min.X, 3)
+	assert.InDelta(rect.Min.Y, m.Rect.Min.Y, 3)
+	assert.InDelta(rect.Dx(), m.Rect.Dx(), 3)
+
+	_, ok = FindTemplate(screen, crop(noiseImage(720, 1280, 2), rect), MatchOptions{})
+	assert.False(ok, "unrelated template should not match")
+}
+
+func TestFindTemplateScaled(t *testing.T) {
+	assert := assert.New(t)
+	screen := noiseImage(720, 1280, 3)
+	rect := image.Rect(100, 200, 260, 320)
+	// the template was taken on a device with a lower density
+	tmpl := scaleGray(crop(screen, rect), 128, 96)
+
+	_, ok := FindTemplate(screen, tmpl, MatchOptions{})
+	assert.False(ok)
+	m, ok := FindTemplate(screen, tmpl, MatchOptions{Scales: []float64{1, 1.25}, Threshold: 0.8})
+	assert.True(ok)
+	assert.InDelta(rect.Min.X, m.Rect.Min.X, 4)
+	assert.InDelta(rect.Min.Y, m.Rect.Min.Y, 4)
+}
+
+func TestWaitImage(t *testing.T) {
+	screen := noiseImage(200, 200, 4)
+	tmpl := crop(screen, image.Rect(50, 50, 100, 100))
+	src := &testSource{}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		src.publish(testFrame(t, noiseImage(200, 200, 5)))
+		src.publish(testFrame(t, screen))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := WaitImage(ctx, src, tmpl, MatchOptions{Threshold: 0.8})
+	assert.Nil(t, err)
+	assert.InDelta(t, 50, m.Rect.Min.X, 3)
+}
+
+func TestWaitImageScaled(t *testing.T) {
+	assert := assert.New(t)
+	screen := noiseImage(1000, 600, 6)
+	rect := image.Rect(400, 200, 520, 300)
+	m := NewMatcher(crop(screen, rect), MatchOptions{Threshold: 0.8})
+	s := &Service{}
+	dec := &countingDecoder{}
+	first := pooledFrame(testFrame(t, screen))
+	first.dec = dec
+
+	match, err := waitImage(context.Background(), s, first, m)
+	assert.Nil(err)
+	assert.Equal(1, dec.scaled)
+	assert.Equal(2, dec.denom, "decoded at half size, above MaxWidth")
+	assert.InDelta(rect.Min.X, match.Rect.Min.X, 4)
+	assert.InDelta(rect.Min.Y, match.Rect.Min.Y, 4)
+	assert.InDelta(rect.Dx(), match.Rect.Dx(), 4)
+	assert.Equal(int32(0), first.buf.refs, "matched frames are released")
+
+	// frames of the subscription are released too
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go waitImage(ctx, s, nil, m)
+	for len(s.Stats().Subscribers) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	publishReleased(t, s, testFrame(t, noiseImage(200, 200, 7)), testFrame(t, noiseImage(200, 200, 8)))
+}
@@ -0,0 +1,291 @@
+package minicap
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the frame latency histogram
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// rateWindow is the period BytesPerSecond and FPS are averaged over
+const rateWindow = 5 * time.Second
+
+// Stats is a snapshot of the counters of a Service
+type Stats struct {
+	FramesReceived uint64        `json:"framesReceived"`
+	FramesDecoded  uint64        `json:"framesDecoded"`
+	DecodeErrors   uint64        `json:"decodeErrors"`
+	Bytes          uint64        `json:"bytes"`
+	BytesPerSecond float64       `json:"bytesPerSecond"`
+	FPS            float64       `json:"fps"`
+	DecodeTime     time.Duration `json:"decodeTime"` // total time spent decoding
+	Reconnects     uint64        `json:"reconnects"`
+	Rotations      uint64        `json:"rotations"`
+
+	// Latency is the time from the first byte of a frame arriving to the
+	// frame being published to subscribers, including transfer and decoding.
+	Latency Histogram `json:"latency"`
+
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+// SubscriberStats describes a single subscription
+type SubscriberStats struct {
+	ID      uint64 `json:"id"`
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Histogram counts durations into LatencyBuckets
+type Histogram struct {
+	Counts []uint64      `json:"counts"` // cumulative, Counts[i] is the number of values <= LatencyBuckets[i]
+	Count  uint64        `json:"count"`
+	Sum    time.Duration `json:"sum"`
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(LatencyBuckets))
+	}
+	for i, le := range LatencyBuckets {
+		if d <= le {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += d
+}
+
+// Average latency, 0 without values
+func (h Histogram) Average() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// metrics collects the counters of a Service
+type metrics struct {
+	mu    sync.Mutex
+	stats Stats
+	// per second frames and bytes of the last rateWindow
+	seconds []rateSecond
+}
+
+type rateSecond struct {
+	unix   int64
+	frames uint64
+	bytes  uint64
+}
+
+func (m *metrics) received(f *Frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.FramesReceived++
+	m.stats.Bytes += uint64(len(f.Data))
+
+	now := f.Time.Unix()
+	if n := len(m.seconds); n == 0 || m.seconds[n-1].unix != now {
+		m.seconds = append(m.seconds, rateSecond{unix: now})
+	}
+	last := &m.seconds[len(m.seconds)-1]
+	last.frames++
+	last.bytes += uint64(len(f.Data))
+	m.expire(now)
+}
+
+// expire drops the seconds that left the rate window
+func (m *metrics) expire(now int64) {
+	i := 0
+	for i < len(m.seconds) && m.seconds[i].unix <= now-int64(rateWindow/time.Second) {
+		i++
+	}
+	m.seconds = m.seconds[i:]
+}
+
+func (m *metrics) decoded(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.stats.DecodeErrors++
+		return
+	}
+	m.stats.FramesDecoded++
+	m.stats.DecodeTime += d
+}
+
+func (m *metrics) published(f *Frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Latency.observe(time.Since(f.Time))
+}
+
+func (m *metrics) reconnected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Reconnects++
+}
+
+func (m *metrics) rotated() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Rotations++
+}
+
+func (m *metrics) snapshot() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now().Unix())
+	stats := m.stats
+	stats.Latency.Counts = append([]uint64(nil), m.stats.Latency.Counts...)
+	if stats.Latency.Counts == nil {
+		stats.Latency.Counts = make([]uint64, len(LatencyBuckets))
+	}
+	var frames, bytes uint64
+	for _, s := range m.seconds {
+		frames += s.frames
+		bytes += s.bytes
+	}
+	stats.FPS = float64(frames) / rateWindow.Seconds()
+	stats.BytesPerSecond = float64(bytes) / rateWindow.Seconds()
+	return stats
+}
+
+// Return a snapshot of the capture counters
+func (s *Service) Stats() Stats {
+	stats := s.metrics.snapshot()
+	stats.Subscribers = s.frames.stats()
+	return stats
+}
+
+// WriteMetrics writes stats in the Prometheus text format, every series
+// labelled with the serial the stats belong to.
+func WriteMetrics(w io.Writer, stats map[string]Stats) error {
+	serials := make([]string, 0, len(stats))
+	for serial := range stats {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+
+	pw := &promWriter{w: w}
+	each := func(name, typ, help string, value func(st Stats) float64) {
+		pw.header(name, typ, help)
+		for _, serial := range serials {
+			pw.sample(name, value(stats[serial]), "serial", serial)
+		}
+	}
+	each("minicap_frames_received_total", "counter", "Frames received from minicap.",
+		func(st Stats) float64 { return float64(st.FramesReceived) })
+	each("minicap_frames_decoded_total", "counter", "Frames decoded successfully.",
+		func(st Stats) float64 { return float64(st.FramesDecoded) })
+	each("minicap_decode_errors_total", "counter", "Frames that could not be decoded.",
+		func(st Stats) float64 { return float64(st.DecodeErrors) })
+	each("minicap_received_bytes_total", "counter", "JPEG bytes received from minicap.",
+		func(st Stats) float64 { return float64(st.Bytes) })
+	each("minicap_received_bytes_per_second", "gauge", "JPEG bytes per second received recently.",
+		func(st Stats) float64 { return st.BytesPerSecond })
+	each("minicap_frames_per_second", "gauge", "Frames per second received recently.",
+		func(st Stats) float64 { return st.FPS })
+	each("minicap_decode_seconds_total", "counter", "Time spent decoding frames.",
+		func(st Stats) float64 { return st.DecodeTime.Seconds() })
+	each("minicap_reconnects_total", "counter", "Reconnections to the minicap socket.",
+		func(st Stats) float64 { return float64(st.Reconnects) })
+	each("minicap_rotations_total", "counter", "Screen rotations observed.",
+		func(st Stats) float64 { return float64(st.Rotations) })
+	each("minicap_subscribers", "gauge", "Current frame subscriptions.",
+		func(st Stats) float64 { return float64(len(st.Subscribers)) })
+
+	pw.header("minicap_subscriber_dropped_frames_total", "counter", "Frames dropped because a subscriber was too slow.")
+	for _, serial := range serials {
+		for _, sub := range stats[serial].Subscribers {
+			pw.sample("minicap_subscriber_dropped_frames_total", float64(sub.Dropped),
+				"serial", serial, "subscriber", strconv.FormatUint(sub.ID, 10))
+		}
+	}
+
+	const latency = "minicap_frame_latency_seconds"
+	pw.header(latency, "histogram", "Time from the first byte of a frame to its delivery to subscribers.")
+	for _, serial := range serials {
+		h := stats[serial].Latency
+		for i, le := range LatencyBuckets {
+			var count uint64
+			if i < len(h.Counts) {
+				count = h.Counts[i]
+			}
+			pw.sample(latency+"_bucket", float64(count), "serial", serial, "le", formatFloat(le.Seconds()))
+		}
+		pw.sample(latency+"_bucket", float64(h.Count), "serial", serial, "le", "+Inf")
+		pw.sample(latency+"_sum", h.Sum.Seconds(), "serial", serial)
+		pw.sample(latency+"_count", float64(h.Count), "serial", serial)
+	}
+	return pw.err
+}
+
+// promWriter writes the Prometheus text format, keeping the first error
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *promWriter) printf(format string, args ...interface{}) {
+	if pw.err == nil {
+		_, pw.err = fmt.Fprintf(pw.w, format, args...)
+	}
+}
+
+func (pw *promWriter) header(name, typ, help string) {
+	pw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (pw *promWriter) sample(name string, value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	pw.printf("%s{%s} %s\n", name, strings.Join(pairs, ","), formatFloat(value))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsHandler serves the stats of the services returned by services
+// in the Prometheus text format, to be mounted at /metrics.
+func MetricsHandler(services func() []*Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]Stats)
+		for _, s := range services() {
+			stats[s.Serial()] = s.Stats()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, stats)
+	})
+}
+
+// MetricsHandler serves the stats of all services of the manager
+func (m *Manager) MetricsHandler() http.Handler {
+	return MetricsHandler(func() (services []*Service) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, s := range m.services {
+			services = append(services, s)
+		}
+		return
+	})
+}
@@ -0,0 +1,89 @@
+package minicap
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	var m metrics
+	for i := 0; i < 3; i++ {
+		f := &Frame{Data: make([]byte, 100), Time: time.Now().Add(-20 * time.Millisecond)}
+		m.received(f)
+		m.decoded(time.Millisecond, nil)
+		m.published(f)
+	}
+	m.decoded(0, errors.New("bad jpeg"))
+	m.reconnected()
+	m.rotated()
+
+	st := m.snapshot()
+	assert.Equal(uint64(3), st.FramesReceived)
+	assert.Equal(uint64(3), st.FramesDecoded)
+	assert.Equal(uint64(1), st.DecodeErrors)
+	assert.Equal(uint64(300), st.Bytes)
+	assert.Equal(300/rateWindow.Seconds(), st.BytesPerSecond)
+	assert.Equal(3/rateWindow.Seconds(), st.FPS)
+	assert.Equal(3*time.Millisecond, st.DecodeTime)
+	assert.Equal(uint64(1), st.Reconnects)
+	assert.Equal(uint64(1), st.Rotations)
+
+	assert.Equal(uint64(3), st.Latency.Count)
+	assert.Equal([]uint64{0, 0, 3, 3, 3, 3, 3, 3}, st.Latency.Counts)
+	assert.True(st.Latency.Average() >= 20*time.Millisecond)
+
+	// old seconds leave the rate window
+	m.seconds[0].unix -= 60
+	assert.Equal(0.0, m.snapshot().FPS)
+}
+
+func TestSubscriberStats(t *testing.T) {
+	var h frameHub
+	a := h.subscribe(1)
+	b := h.subscribe(2)
+	defer b.Close()
+	a.Close()
+	h.subscribe(1)
+	h.publish(&Frame{})
+	h.publish(&Frame{})
+	assert.Equal(t, []SubscriberStats{
+		{ID: 2, Queued: 2},
+		{ID: 3, Queued: 1, Dropped: 1},
+	}, h.stats())
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := &Service{}
+	s.d.Serial = "emulator-5554"
+	s.metrics.received(&Frame{Data: make([]byte, 10), Time: time.Now()})
+	s.metrics.published(&Frame{Time: time.Now()})
+	sub := s.Subscribe(1)
+	defer sub.Close()
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(func() []*Service { return []*Service{s} }).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE minicap_frames_received_total counter",
+		`minicap_frames_received_total{serial="emulator-5554"} 1`,
+		`minicap_received_bytes_total{serial="emulator-5554"} 10`,
+		`minicap_subscribers{serial="emulator-5554"} 1`,
+		`minicap_subscriber_dropped_frames_total{serial="emulator-5554",subscriber="1"} 0`,
+		`minicap_frame_latency_seconds_bucket{serial="emulator-5554",le="0.005"} 1`,
+		`minicap_frame_latency_seconds_bucket{serial="emulator-5554",le="+Inf"} 1`,
+		`minicap_frame_latency_seconds_count{serial="emulator-5554"} 1`,
+	} {
+		assert.Contains(t, strings.Split(out, "\n"), line)
+	}
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteMetrics(buf, nil))
+	assert.Contains(t, buf.String(), "# TYPE minicap_frame_latency_seconds histogram")
+}
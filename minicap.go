@@ -1,19 +1,17 @@
 package minicap
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
-	"io"
-	"math/rand"
-	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	// _ "github.com/pixiv/go-libjpeg/jpeg" // not work on windows
+
+	adb "github.com/zach-klippenstein/goadb"
 )
 
 var (
@@ -23,6 +21,20 @@ var (
 type Options struct {
 	Serial string
 	Adb    string
+
+	// Only capture this region, in the natural orientation of the device.
+	// minicap can not crop, so frames are cropped and re-encoded on the host.
+	Crop image.Rectangle
+
+	// Rotation selects the orientation of the frames, RotationRaw by default
+	Rotation RotationMode
+
+	// Decoder decodes the frames, DefaultDecoder if nil
+	Decoder Decoder
+
+	// Logger receives the log of the service, adb commands at debug level.
+	// nil logs nothing.
+	Logger Logger
 }
 
 type Service struct {
@@ -31,29 +43,62 @@ type Service struct {
 
 	lforwardPort int // local forward port
 	d            AdbDevice
-	r            Rotation
-	dispInfo     DisplayInfo
+	r            *Rotation
 	maxReDialCnt int
+	crop         image.Rectangle
+	rotation     RotationMode
+	decoder      Decoder
 
-	closed    bool
-	imageC    chan image.Image
+	backend   backend
+	cmdC      chan command  // to the run loop
+	loopDone  chan struct{} // closed when the run loop returns
+	decodeAll int32         // set by Capture, which wants every image
+
+	screenCheck screenCheck // the screen state while frames stall
+
+	// guarded by mu, written by the run loop
 	mu        sync.Mutex
-	lastImage image.Image
+	state     State
+	err       error // why the capture stopped
+	stateSubs []chan StateChange
+	imageC    chan image.Image
+	dispInfo  DisplayInfo
+	model     string      // ro.product.model, fetched by the first EncodeScreenshot
+	lastImage image.Image // decoded lastFrame, nil until needed
+	lastFrame *Frame
+	banner    Banner
+	frames    frameHub
+	screenOff bool // the last frame was black
+	metrics   metrics
+	log       Logger // with the serial and the capture session
 }
 
 func NewService(opt Options) (s *Service, err error) {
+	client, err := newAdbClient()
+	if err != nil {
+		return
+	}
+	return newService(opt, client)
+}
+
+// newService creates a Service on top of an existing adb client
+func newService(opt Options, client *adb.Adb) (s *Service, err error) {
 	s = &Service{
 		AdbPort:      5037,
 		AdbHost:      "localhost",
-		closed:       true,
 		maxReDialCnt: 10,
+		crop:         opt.Crop,
+		rotation:     opt.Rotation,
+		decoder:      opt.Decoder,
 	}
-	s.d, err = newAdbDevice(opt.Serial, opt.Adb)
+	s.d, err = attachAdbDevice(client, opt.Serial, opt.Adb, opt.Logger)
 	if err != nil {
 		return
 	}
+	s.log = s.d.logger()
+	s.backend = adbBackend{s}
 
-	s.r, err = newRotationService(opt)
+	s.r, err = newRotationService(s.d)
 	if err != nil {
 		return
 	}
@@ -126,22 +171,48 @@ func (s *Service) Uninstall() (err error) {
 	return nil
 }
 
+type screenshotConfig struct {
+	region image.Rectangle
+	meta   map[string]string // extra metadata of EncodeScreenshot
+}
+
+type ScreenshotOption func(*screenshotConfig)
+
+// WithRegion only returns the region r of the screen, in the natural orientation of the device
+func WithRegion(r image.Rectangle) ScreenshotOption {
+	return func(c *screenshotConfig) {
+		c.region = r
+	}
+}
+
 // Take screenshot
 // If minicap in on, the return the last recent image
-func (s *Service) Screenshot() (im image.Image, err error) {
+func (s *Service) Screenshot(opts ...ScreenshotOption) (im image.Image, err error) {
+	im, _, err = s.screenshot(newScreenshotConfig(opts))
+	return
+}
+
+func newScreenshotConfig(opts []ScreenshotOption) (cfg screenshotConfig) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return
+}
+
+// screenshot takes a screenshot with minicap -s, dispInfo is the display it was taken in
+func (s *Service) screenshot(cfg screenshotConfig) (im image.Image, dispInfo DisplayInfo, err error) {
 	if !s.IsSupported() {
 		err = errors.New("minicap not supported") // FIXME(ssx): maybe need to fallback to screencap
 		return
 	}
-	dispInfo, err := s.d.getDisplayInfo()
-	if err != nil {
+	if dispInfo, err = s.d.getDisplayInfo(); err != nil {
 		return
 	}
 	if dispInfo.Width > dispInfo.Height {
 		dispInfo.Width, dispInfo.Height = dispInfo.Height, dispInfo.Width
 	}
 	params := fmt.Sprintf("%dx%d@%dx%d/%d", dispInfo.Width, dispInfo.Height,
-		dispInfo.Width, dispInfo.Height, dispInfo.Orientation*90)
+		dispInfo.Width, dispInfo.Height, dispInfo.Orientation)
 	fName := randSeq(10)
 	fName = fmt.Sprintf("go_%v.jpg", fName)
 	cmd := fmt.Sprintf("LD_LIBRARY_PATH=/data/local/tmp /data/local/tmp/minicap -n minicap -P %v -s > /data/local/tmp/%v", params, fName)
@@ -155,58 +226,64 @@ func (s *Service) Screenshot() (im image.Image, err error) {
 	}
 	im, _, err = image.Decode(fout)
 	fout.Close()
+	if err == nil && !cfg.region.Empty() {
+		natural := image.Pt(dispInfo.Width, dispInfo.Height)
+		im = cropImage(im, cfg.region, natural, dispInfo.Orientation)
+	}
 	return
 }
 
-// Capture screen stream based on minicap
-func (s *Service) Capture() (imageC <-chan image.Image, err error) {
-	err = s.r.start()
-	if err != nil {
-		return
-	}
-	orienC, err := s.r.watch()
-	if err != nil {
-		return
-	}
-	s.dispInfo, err = s.d.getDisplayInfo()
-	if err != nil {
-		return
-	}
-	// log.Println(s.dispInfo)
-	if err = s.runMinicap(s.dispInfo.Orientation); err != nil {
-		return
+// logger never returns nil, services created in tests have no logger
+func (s *Service) logger() Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loggerLocked()
+}
+
+// loggerLocked is logger for callers holding s.mu
+func (s *Service) loggerLocked() Logger {
+	if s.log == nil {
+		return nopLogger{}
 	}
-	if err = s.startReadFromSocket(); err != nil {
+	return s.log
+}
+
+// Capture screen stream based on minicap, Start the service and return the
+// channel of decoded frames. The channel is closed when the service stops.
+// Called after Start, it returns the channel of the running service, frames
+// are decoded from then on.
+func (s *Service) Capture() (imageC <-chan image.Image, err error) {
+	atomic.StoreInt32(&s.decodeAll, 1)
+	if err = s.Start(); err != nil && !errors.Is(err, ErrInvalidState) {
 		return
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.imageC, nil
+}
 
-	// TODO(ssx): too slow here
-	select {
-	case orientation := <-orienC:
-		if orientation != s.dispInfo.Orientation {
-			s.dispInfo.Orientation = orientation
-			if err := s.runMinicap(orientation); err != nil {
-				break
-			}
-			time.Sleep(time.Duration(10+rand.Intn(100)) * time.Millisecond)
+// Start minicap and read frames from it until Close. A service can only be
+// started once, States tells when it streams.
+func (s *Service) Start() (err error) {
+	s.mu.Lock()
+	if s.state != StateIdle {
+		st := s.state
+		s.mu.Unlock()
+		if st == StateStopped {
+			return ErrAlreadyClosed
 		}
-	case <-time.After(time.Second):
-		return nil, errors.New("cannot fetch rotation")
+		return invalidState("start", st)
 	}
+	s.log = withFields(s.d.logger(), "session", randSeq(8))
+	s.imageC = make(chan image.Image, 1)
+	s.cmdC = make(chan command)
+	s.loopDone = make(chan struct{})
+	s.setState(StateInstalling, nil)
+	s.mu.Unlock()
 
-	go func() {
-		for {
-			orientation := <-orienC
-			if orientation != s.dispInfo.Orientation {
-				s.dispInfo.Orientation = orientation
-				if err := s.runMinicap(orientation); err != nil {
-					break
-				}
-				time.Sleep(time.Duration(10+rand.Intn(100)) * time.Millisecond)
-			}
-		}
-	}()
-	return s.imageC, nil
+	startedC := make(chan error, 1)
+	go s.run(startedC)
+	return <-startedC
 }
 
 //Sampling minicap with fixed sampling rate
@@ -232,148 +309,168 @@ func (s *Service) FixedSampling(imC <-chan image.Image, freq int) <-chan image.I
 	return imgFxdC
 }
 
-// Start Minicap until the minicap started
-func (s *Service) runMinicap(orientation int) (err error) {
-	if !s.IsSupported() {
-		err = errors.New("minicap not supported")
+// Close Minicap Service. Closing a service that was never started only
+// marks it stopped, closing it twice returns ErrAlreadyClosed. Close waits
+// for Start to install minicap.
+func (s *Service) Close() (err error) {
+	s.mu.Lock()
+	switch s.state {
+	case StateStopped:
+		s.mu.Unlock()
+		return ErrAlreadyClosed
+	case StateIdle:
+		s.setState(StateStopped, nil)
+		s.mu.Unlock()
+		s.frames.closeAll()
 		return
 	}
-	if s.dispInfo.Height == 0 {
-		s.dispInfo, err = s.d.getDisplayInfo()
-		if err != nil {
-			return
-		}
+	s.mu.Unlock()
+	return s.command("stop")
+}
+
+// command sends op to the run loop and waits for its result
+func (s *Service) command(op string) error {
+	s.mu.Lock()
+	st := s.state
+	s.mu.Unlock()
+	switch st {
+	case StateIdle:
+		return invalidState(op, st)
+	case StateStopped:
+		return ErrAlreadyClosed
 	}
-	if s.dispInfo.Width > s.dispInfo.Height {
-		s.dispInfo.Width, s.dispInfo.Height = s.dispInfo.Height, s.dispInfo.Width
+	cmd := command{op: op, done: make(chan error, 1)}
+	select {
+	case s.cmdC <- cmd:
+		return <-cmd.done
+	case <-s.loopDone:
+		return ErrAlreadyClosed
+	}
+}
+
+// Check whether the minicap stream is closed, also true before Start
+func (s *Service) IsClosed() (Closed bool) {
+	st := s.State()
+	return st == StateIdle || st == StateStopped
+}
+
+// encodeFrame replaces the frame data with im, changed on the host
+func encodeFrame(f *Frame, im image.Image) error {
+	buf := getFrameBuffer(0)
+	w := bytes.NewBuffer(buf.data)
+	if err := jpeg.Encode(w, im, &jpeg.Options{Quality: 90}); err != nil {
+		framePool.Put(buf)
+		return err
 	}
-	s.close()
-	params := fmt.Sprintf("%dx%d@%dx%d/%d", s.dispInfo.Width, s.dispInfo.Height,
-		s.dispInfo.Width, s.dispInfo.Height, orientation)
-	cmd := s.d.buildCommand("LD_LIBRARY_PATH=/data/local/tmp", "/data/local/tmp/minicap", "-P", params, "-S")
-	if err = cmd.Start(); err != nil {
+	buf.data = w.Bytes()
+	f.setData(buf)
+	return nil
+}
+
+// Return last screenshot from minicap
+// if minicap is closed, use Screenshot() instead
+func (s *Service) LastScreenshot() (im image.Image, err error) {
+	if s.IsClosed() {
+		return s.Screenshot()
+	}
+	s.mu.Lock()
+	im, f := s.lastImage, s.lastFrame
+	if im == nil && f != nil {
+		f.Retain()
+	}
+	s.mu.Unlock()
+	if im != nil {
 		return
 	}
-	time.Sleep(time.Millisecond) // ?
-	if s.lforwardPort == 0 {
-		s.lforwardPort, err = freePort()
-		if err != nil {
-			return
-		}
+	if f == nil {
+		return s.Screenshot()
 	}
-	if _, err = s.d.run("forward", fmt.Sprintf("tcp:%d", s.lforwardPort), "localabstract:minicap"); err != nil {
+	// frames are only decoded when needed
+	im, err = s.decode(f)
+	f.Release()
+	if err != nil {
 		return
 	}
-	s.closed = false
+	s.mu.Lock()
+	if s.lastFrame == f {
+		s.lastImage = im
+	}
+	s.mu.Unlock()
 	return
 }
 
-// Close Minicap Service
-func (s *Service) Close() (err error) {
+// Subscribe to the raw JPEG frames of the capture stream.
+// size is the channel buffer, when it is full the oldest frame is dropped.
+func (s *Service) Subscribe(size int) *Subscription {
+	return s.frames.subscribe(size)
+}
+
+// Return the last raw frame received from minicap, nil if none.
+// It holds a reference for the caller, see Frame.Release.
+func (s *Service) LastFrame() *Frame {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.closed {
-		return ErrAlreadyClosed
+	if s.lastFrame != nil {
+		s.lastFrame.Retain()
 	}
-	s.closed = true
-	close(s.imageC)
-	s.close()
-	s.d.run("forward", "--remove", fmt.Sprintf("tcp:%d", s.lforwardPort))
-	return
+	return s.lastFrame
 }
 
-func (s *Service) close() (err error) {
-	return s.d.killProc("minicap")
+// decode f with the decoder of the service
+func (s *Service) decode(f *Frame) (image.Image, error) {
+	if f.Image != nil {
+		return f.Image, nil
+	}
+	if f.dec == nil && s.decoder != nil {
+		return s.decoder.Decode(f.Data)
+	}
+	return f.Decode()
 }
 
-// Check whether the minicap stream is closed.
-func (s *Service) IsClosed() (Closed bool) {
-	return s.closed
+// capturing reports whether Capture was called, frames are decoded for it
+func (s *Service) capturing() bool {
+	return atomic.LoadInt32(&s.decodeAll) != 0
 }
 
-// read image from socket
-func (s *Service) startReadFromSocket() (err error) {
-	var conn net.Conn
-	s.dispInfo, err = s.d.getDisplayInfo()
-	if err != nil {
-		return
-	}
-	/*err = s.runMinicap(s.dispInfo.Orientation)
-	if err != nil {
-		return
-	}*/
-	s.imageC = make(chan image.Image, 1)
-	go func() {
-		idxReDialCnt := 0
-		for {
-			conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", s.AdbHost, s.lforwardPort))
-			if err != nil {
-				if idxReDialCnt < s.maxReDialCnt {
-					idxReDialCnt += 1
-					continue
-				} else {
-					break
-				}
-			}
-			var pid, rw, rh, vw, vh uint32
-			var version uint8
-			var unused uint8
-			var orientation uint8
-			binRead := func(data interface{}) error {
-				if err != nil {
-					return err
-				}
-				err = binary.Read(conn, binary.LittleEndian, data)
-				return err
-			}
-			binRead(&version)
-			binRead(&unused)
-			binRead(&pid)
-			binRead(&rw)
-			binRead(&rh)
-			binRead(&vw)
-			binRead(&vh)
-			binRead(&orientation)
-			binRead(&unused)
-			if err != nil {
-				continue
-			}
-			bufrd := bufio.NewReader(conn) // Do not put it into for loop
-			for {
-				var size uint32
-				if err = binRead(&size); err != nil {
-					break
-				}
-				lr := &io.LimitedReader{bufrd, int64(size)}
-				var im image.Image
-				im, err = jpeg.Decode(lr)
-				// im, _, err = image.Decode(lr)
-				if err != nil {
-					break
-				}
-				s.mu.Lock()
-				if s.closed {
-					break
-				}
-				s.lastImage = im
-				select {
-				case s.imageC <- im:
-				default:
-				}
-				s.mu.Unlock()
-			}
-			conn.Close()
-		}
-	}()
-	return nil
+// Return the banner of the running minicap
+func (s *Service) Banner() Banner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.banner
 }
 
-// Return last screenshot from minicap
-// if minicap is closed, use Screenshot() instead
-func (s *Service) LastScreenshot() (im image.Image, err error) {
-	if s.lastImage == nil || s.IsClosed() {
-		im, err = s.Screenshot()
-		return
+// Return the display info of the device, in portrait with the current orientation
+func (s *Service) DisplayInfo() DisplayInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dispInfo
+}
+
+// frameOrientation is the orientation of the captured frames, see RotationMode
+func (s *Service) frameOrientation() int {
+	if s.rotation == RotationNatural {
+		return 0
 	}
-	return s.lastImage, nil
+	return s.DisplayInfo().Orientation
+}
+
+func (s *Service) setDisplayInfo(info DisplayInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dispInfo = info
+}
+
+// Query the display info from the device
+func (s *Service) QueryDisplayInfo() (DisplayInfo, error) {
+	return s.d.getDisplayInfo()
+}
+
+// Return the value of an android system property, like ro.product.model
+func (s *Service) GetProp(key string) (string, error) {
+	return s.d.getProp(key)
+}
+
+// Return the serial of the device
+func (s *Service) Serial() string {
+	return s.d.Serial
 }
@@ -0,0 +1,138 @@
+package minicap
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"strings"
+)
+
+const mjpegBoundary = "minicapframe"
+
+// MJPEGHandler serves the screen of a capturing Service over plain HTTP.
+//
+//	/screenshot.jpg  last frame as JPEG
+//	/info            device and stream information as JSON
+//	anything else    multipart/x-mixed-replace MJPEG stream
+//
+// Frames are passed through as sent by minicap, without re-encoding.
+// Slow clients skip frames instead of slowing down the capture.
+type MJPEGHandler struct {
+	// Pipeline, if set, builds the frame processing of every client stream
+	Pipeline func() *Pipeline
+
+	s *Service
+}
+
+func NewMJPEGHandler(s *Service) *MJPEGHandler {
+	return &MJPEGHandler{s: s}
+}
+
+func (h *MJPEGHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/screenshot.jpg"):
+		h.serveScreenshot(w, r)
+	case strings.HasSuffix(r.URL.Path, "/info"):
+		h.serveInfo(w, r)
+	default:
+		h.serveStream(w, r)
+	}
+}
+
+func (h *MJPEGHandler) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	sub := h.s.Subscribe(1)
+	defer sub.Close()
+	var p *Pipeline
+	if h.Pipeline != nil {
+		p = h.Pipeline()
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusOK)
+
+	// every part is followed by the next boundary, so that clients show a
+	// frame as soon as it is received rather than when the next one arrives
+	if _, err := fmt.Fprintf(w, "--%s\r\n", mjpegBoundary); err != nil {
+		return
+	}
+	writePart := func(f *Frame) error {
+		if p != nil {
+			var err error
+			if f, err = p.Process(r.Context(), f); err != nil || f == nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "Content-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(f.Data))
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(f.Data); err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "\r\n--%s\r\n", mjpegBoundary); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	// show something immediately instead of waiting for the screen to change
+	if f := h.s.LastFrame(); f != nil {
+		err := writePart(f)
+		f.Release()
+		if err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case f, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			err := writePart(f)
+			f.Release()
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *MJPEGHandler) serveScreenshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	if f := h.s.LastFrame(); f != nil && !h.s.IsClosed() {
+		w.Write(f.Data)
+		f.Release()
+		return
+	}
+	im, err := h.s.Screenshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jpeg.Encode(w, im, nil)
+}
+
+func (h *MJPEGHandler) serveInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"serial":    h.s.Serial(),
+		"display":   h.s.DisplayInfo(),
+		"banner":    h.s.Banner(),
+		"closed":    h.s.IsClosed(),
+		"screenOff": h.s.ScreenOff(),
+		"stats":     h.s.Stats(),
+	})
+}
@@ -0,0 +1,75 @@
+package minicap
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMJPEGHandlerStream(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	s.lastFrame = &Frame{Data: []byte("first")}
+	ts := httptest.NewServer(NewMJPEGHandler(s))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	assert.Nil(err)
+	assert.Equal("multipart/x-mixed-replace", mediaType)
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(part)
+	assert.Equal("first", string(data), "last frame should be sent on connect")
+
+	go func() {
+		// wait for the handler to subscribe
+		for i := 0; i < 100; i++ {
+			s.frames.mu.Lock()
+			n := len(s.frames.subs)
+			s.frames.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		s.frames.publish(&Frame{Data: []byte("second")})
+	}()
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(part)
+	assert.Equal("second", string(data))
+}
+
+func TestMJPEGHandlerInfo(t *testing.T) {
+	s := &Service{}
+	s.d.Serial = "abc"
+	ts := httptest.NewServer(NewMJPEGHandler(s))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, "abc", info["serial"])
+}
@@ -0,0 +1,87 @@
+package minicap
+
+import (
+	"context"
+	"errors"
+	"image"
+	"math/bits"
+)
+
+// AHash returns the average hash of im: an 8x8 grayscale thumbnail
+// with a bit set for every pixel brighter than the mean.
+func AHash(im image.Image) uint64 {
+	small := scaleGray(grayPlane(im), 8, 8)
+	var sum int
+	for _, v := range small.Pix {
+		sum += int(v)
+	}
+	mean := sum / 64
+	var hash uint64
+	for i, v := range small.Pix {
+		if int(v) > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// DHash returns the difference hash of im: a 9x8 grayscale thumbnail
+// with a bit set for every pixel brighter than its right neighbour.
+// It is more robust to brightness changes than AHash.
+func DHash(im image.Image) uint64 {
+	small := scaleGray(grayPlane(im), 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < 8; x++ {
+			if row[x] > row[x+1] {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance counts the bits that differ between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// hashFrame returns a copy of f with Hash set
+func hashFrame(f *Frame) (*Frame, error) {
+	if f.Hash != 0 {
+		return f, nil
+	}
+	// the hash is taken from a 9x8 thumbnail, an eighth of the frame is plenty
+	im := f.Image
+	if im == nil {
+		var err error
+		if im, err = f.DecodeScaled(8); err != nil {
+			return nil, err
+		}
+	}
+	hf := *f
+	hf.Hash = DHash(im)
+	hf.buf = nil // the reference stays with f
+	return &hf, nil
+}
+
+// Dedupe drops frames whose DHash is within maxDistance bits of the last
+// frame let through. Frames coming out have their Hash set.
+func Dedupe(frameC <-chan *Frame, maxDistance int) <-chan *Frame {
+	return NewPipeline(DedupeStage(maxDistance)).Run(context.Background(), frameC)
+}
+
+// Fingerprint returns the DHash of the last frame, a cheap way to tell screens apart in logs
+func (s *Service) Fingerprint() (hash uint64, err error) {
+	last := s.LastFrame()
+	if last == nil {
+		return 0, errors.New("no frame captured yet")
+	}
+	defer last.Release()
+	f, err := hashFrame(last)
+	if err != nil {
+		return
+	}
+	return f.Hash, nil
+}
@@ -0,0 +1,85 @@
+package minicap
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockImage has the 9x8 cells a DHash compares, they survive shrinking
+func blockImage(seed int64) *image.Gray {
+	return scaleGray(noiseImage(36, 32, seed), 288, 256)
+}
+
+func TestPerceptualHash(t *testing.T) {
+	assert := assert.New(t)
+	a := noiseImage(256, 256, 1)
+	b := noiseImage(256, 256, 2)
+
+	// a slightly brighter copy is perceptually the same
+	bright := image.NewGray(a.Rect)
+	for i, v := range a.Pix {
+		if v < 250 {
+			v += 5
+		}
+		bright.Pix[i] = v
+	}
+	assert.True(HammingDistance(DHash(a), DHash(bright)) <= 2)
+	assert.True(HammingDistance(AHash(a), AHash(bright)) <= 4)
+	assert.True(HammingDistance(DHash(a), DHash(b)) > 10)
+	assert.True(HammingDistance(AHash(a), AHash(b)) > 10)
+	assert.True(HammingDistance(DHash(a), DHash(scaleGray(a, 128, 128))) <= 6, "hash should barely depend on size")
+}
+
+func TestDedupe(t *testing.T) {
+	assert := assert.New(t)
+	a := testFrame(t, noiseImage(64, 64, 1))
+	b := testFrame(t, noiseImage(64, 64, 2))
+	frameC := make(chan *Frame, 4)
+	frameC <- a
+	frameC <- a
+	frameC <- b
+	frameC <- a
+	close(frameC)
+
+	var out []*Frame
+	for f := range Dedupe(frameC, 2) {
+		out = append(out, f)
+	}
+	if assert.Len(out, 3) {
+		assert.Equal(a.Data, out[0].Data)
+		assert.Equal(b.Data, out[1].Data)
+		assert.NotZero(out[0].Hash)
+	}
+	assert.Zero(a.Hash, "input frames must not be modified")
+
+	// hashes only need a thumbnail
+	dec := &countingDecoder{}
+	f := testFrame(t, blockImage(3))
+	f.dec = dec
+	hf, err := hashFrame(f)
+	assert.Nil(err)
+	assert.Equal(0, dec.decodes)
+	assert.Equal(8, dec.denom)
+	assert.True(HammingDistance(DHash(blockImage(3)), hf.Hash) <= 2)
+}
+
+func TestFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	_, err := s.Fingerprint()
+	assert.NotNil(err)
+
+	im := blockImage(1)
+	s.lastFrame = pooledFrame(testFrame(t, im))
+	hash, err := s.Fingerprint()
+	assert.Nil(err)
+	assert.True(HammingDistance(DHash(im), hash) <= 2)
+	assert.Equal(int32(1), s.lastFrame.buf.refs, "only the service keeps a reference")
+
+	s.lastFrame = pooledFrame(&Frame{Data: []byte("not a jpeg")})
+	_, err = s.Fingerprint()
+	assert.NotNil(err)
+	assert.Equal(int32(1), s.lastFrame.buf.refs)
+}
@@ -0,0 +1,355 @@
+package minicap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"sync"
+	"time"
+)
+
+// Stage is one step of a Pipeline.
+// Process must not modify f, but return a modified copy, or nil to drop the frame.
+// Stages that change the image set Image and clear Data, the pipeline
+// encodes the final image again when needed. Copies do not hold a reference,
+// a stage keeping a frame past Process must Retain it.
+type Stage interface {
+	Name() string
+	Process(ctx context.Context, f *Frame) (*Frame, error)
+}
+
+type stageFunc struct {
+	name string
+	fn   func(ctx context.Context, f *Frame) (*Frame, error)
+}
+
+func (s *stageFunc) Name() string {
+	return s.name
+}
+
+func (s *stageFunc) Process(ctx context.Context, f *Frame) (*Frame, error) {
+	return s.fn(ctx, f)
+}
+
+// NewStage turns a function into a Stage
+func NewStage(name string, fn func(ctx context.Context, f *Frame) (*Frame, error)) Stage {
+	return &stageFunc{name, fn}
+}
+
+// decoded returns a copy of f with Image set
+func decoded(f *Frame) (*Frame, error) {
+	if f.Image != nil {
+		return f, nil
+	}
+	im, err := f.Decode()
+	if err != nil {
+		return nil, err
+	}
+	df := *f
+	df.Image = im
+	df.buf = nil // the reference stays with f
+	return &df, nil
+}
+
+// withImage returns a copy of f showing im
+func withImage(f *Frame, im image.Image) *Frame {
+	nf := *f
+	nf.Image = im
+	nf.Data = nil
+	nf.buf = nil
+	nf.Hash = 0
+	return &nf
+}
+
+// DecodeStage decodes the JPEG data into Image
+func DecodeStage() Stage {
+	return NewStage("decode", func(ctx context.Context, f *Frame) (*Frame, error) {
+		return decoded(f)
+	})
+}
+
+// ResizeStage scales frames by factor. When frames are decoded with a
+// ScaledDecoder (Options.Decoder or DefaultDecoder), frames shrunk by half
+// or more are not decoded at full resolution.
+func ResizeStage(factor float64) Stage {
+	return NewStage("resize", func(ctx context.Context, f *Frame) (*Frame, error) {
+		if factor <= 0 {
+			return nil, fmt.Errorf("resize factor %v is not positive", factor)
+		}
+		if factor == 1 {
+			return f, nil
+		}
+		if _, ok := f.decoder().(ScaledDecoder); ok && f.Image == nil && factor <= 0.5 {
+			// shrink while decoding, then to the exact size
+			size, err := f.Size()
+			if err != nil {
+				return nil, err
+			}
+			im, err := f.DecodeScaled(int(1 / factor))
+			if err != nil {
+				return nil, err
+			}
+			w := maxInt(1, int(float64(size.X)*factor+0.5))
+			h := maxInt(1, int(float64(size.Y)*factor+0.5))
+			if im.Bounds().Size() != image.Pt(w, h) {
+				im = resizeImage(im, w, h)
+			}
+			return withImage(f, im), nil
+		}
+		f, err := decoded(f)
+		if err != nil {
+			return nil, err
+		}
+		return withImage(f, scaleImage(f.Image, factor)), nil
+	})
+}
+
+// RotateStage turns frames clockwise by degrees, a multiple of 90
+func RotateStage(degrees int) Stage {
+	return NewStage("rotate", func(ctx context.Context, f *Frame) (*Frame, error) {
+		if normOrientation(degrees) == 0 {
+			return f, nil
+		}
+		f, err := decoded(f)
+		if err != nil {
+			return nil, err
+		}
+		return withImage(f, rotateImage(f.Image, degrees)), nil
+	})
+}
+
+// CropStage keeps region only, given in the natural orientation of a display of size natural
+func CropStage(region image.Rectangle, natural image.Point) Stage {
+	return NewStage("crop", func(ctx context.Context, f *Frame) (*Frame, error) {
+		f, err := decoded(f)
+		if err != nil {
+			return nil, err
+		}
+		return withImage(f, cropImage(f.Image, region, natural, f.Orientation)), nil
+	})
+}
+
+// DedupeStage drops frames whose DHash is within maxDistance bits of the last frame let through
+func DedupeStage(maxDistance int) Stage {
+	var last uint64
+	first := true
+	return NewStage("dedupe", func(ctx context.Context, f *Frame) (*Frame, error) {
+		f, err := hashFrame(f)
+		if err != nil {
+			return nil, err
+		}
+		if !first && HammingDistance(last, f.Hash) <= maxDistance {
+			return nil, nil
+		}
+		first = false
+		last = f.Hash
+		return f, nil
+	})
+}
+
+// ThrottleStage lets at most fps frames per second through, dropping the
+// others. fps 0 or below lets every frame through.
+func ThrottleStage(fps int) Stage {
+	var interval time.Duration
+	if fps > 0 {
+		interval = time.Second / time.Duration(fps)
+	}
+	var last time.Time
+	return NewStage("throttle", func(ctx context.Context, f *Frame) (*Frame, error) {
+		if interval == 0 {
+			return f, nil
+		}
+		now := time.Now()
+		if now.Sub(last) < interval {
+			return nil, nil
+		}
+		last = now
+		return f, nil
+	})
+}
+
+// AnnotateStage lets fn draw on a copy of every frame, e.g. a timestamp or touch points
+func AnnotateStage(fn func(f *Frame, dst draw.Image)) Stage {
+	return NewStage("annotate", func(ctx context.Context, f *Frame) (*Frame, error) {
+		f, err := decoded(f)
+		if err != nil {
+			return nil, err
+		}
+		b := f.Image.Bounds()
+		dst := image.NewRGBA(b)
+		draw.Draw(dst, b, f.Image, b.Min, draw.Src)
+		af := withImage(f, dst)
+		fn(af, dst)
+		return af, nil
+	})
+}
+
+// EncodeStage encodes frames to JPEG with quality. With quality 0 frames
+// that still have their original data are passed through, and changed
+// images are encoded with the default quality.
+func EncodeStage(quality int) Stage {
+	return NewStage("encode", func(ctx context.Context, f *Frame) (*Frame, error) {
+		if f.Data != nil && quality <= 0 {
+			return f, nil
+		}
+		f, err := decoded(f)
+		if err != nil {
+			return nil, err
+		}
+		opt := &jpeg.Options{Quality: jpeg.DefaultQuality}
+		if quality > 0 {
+			opt.Quality = quality
+		}
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, f.Image, opt); err != nil {
+			return nil, err
+		}
+		ef := *f
+		ef.Data = buf.Bytes()
+		ef.buf = nil
+		return &ef, nil
+	})
+}
+
+// StageStats is the timing of one stage
+type StageStats struct {
+	Name    string
+	Frames  int           // frames processed
+	Dropped int           // frames dropped by the stage
+	Total   time.Duration // time spent in the stage
+	Max     time.Duration // slowest frame
+}
+
+// Average time spent per frame
+func (s StageStats) Average() time.Duration {
+	if s.Frames == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Frames)
+}
+
+// Pipeline runs frames through a sequence of stages.
+// Stages may keep state (e.g. dedupe), so a Pipeline serves one stream only.
+type Pipeline struct {
+	stages []Stage
+	encode Stage
+
+	mu    sync.Mutex
+	stats []StageStats
+	err   error
+}
+
+func NewPipeline(stages ...Stage) *Pipeline {
+	p := &Pipeline{
+		stages: stages,
+		encode: EncodeStage(0),
+		stats:  make([]StageStats, len(stages)),
+	}
+	for i, s := range stages {
+		p.stats[i].Name = s.Name()
+	}
+	return p
+}
+
+// Process runs f through all stages. A nil frame means it was dropped.
+// The returned frame always has JPEG data, which may be the data of f:
+// f is released by the caller once done with the returned frame.
+func (p *Pipeline) Process(ctx context.Context, f *Frame) (*Frame, error) {
+	for i, s := range p.stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		out, err := s.Process(ctx, f)
+		elapsed := time.Since(start)
+
+		p.mu.Lock()
+		st := &p.stats[i]
+		st.Frames++
+		st.Total += elapsed
+		if elapsed > st.Max {
+			st.Max = elapsed
+		}
+		if out == nil && err == nil {
+			st.Dropped++
+		}
+		p.mu.Unlock()
+
+		if err != nil || out == nil {
+			return nil, err
+		}
+		f = out
+	}
+	if f.Data == nil {
+		return p.encode.Process(ctx, f)
+	}
+	return f, nil
+}
+
+// Run processes frames from frameC until it is closed, ctx is done or a stage fails.
+// The returned channel is closed then, see Err for the error. Dropped frames
+// are released, frames coming out hold the reference of the frame they came from.
+func (p *Pipeline) Run(ctx context.Context, frameC <-chan *Frame) <-chan *Frame {
+	outC := make(chan *Frame, 1)
+	go func() {
+		defer close(outC)
+		for {
+			select {
+			case f, ok := <-frameC:
+				if !ok {
+					return
+				}
+				out, err := p.Process(ctx, f)
+				if err != nil || out == nil {
+					f.Release()
+					if err != nil {
+						p.setErr(err)
+						return
+					}
+					continue
+				}
+				if out != f {
+					ref := *out
+					ref.buf = f.buf
+					out = &ref
+				}
+				select {
+				case outC <- out:
+				case <-ctx.Done():
+					out.Release()
+					p.setErr(ctx.Err())
+					return
+				}
+			case <-ctx.Done():
+				p.setErr(ctx.Err())
+				return
+			}
+		}
+	}()
+	return outC
+}
+
+func (p *Pipeline) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Err returns the error that stopped Run, if any
+func (p *Pipeline) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Stats returns the timing of every stage
+func (p *Pipeline) Stats() []StageStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]StageStats(nil), p.stats...)
+}
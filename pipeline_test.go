@@ -0,0 +1,137 @@
+package minicap
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineStages(t *testing.T) {
+	assert := assert.New(t)
+	f := testFrame(t, image.NewGray(image.Rect(0, 0, 100, 200)))
+	f.Orientation = 0
+	p := NewPipeline(
+		CropStage(image.Rect(0, 0, 100, 100), image.Pt(100, 200)),
+		ResizeStage(0.5),
+		RotateStage(90),
+		AnnotateStage(func(f *Frame, dst draw.Image) {
+			dst.Set(0, 0, color.White)
+		}),
+	)
+	out, err := p.Process(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := out.Size()
+	assert.Nil(err)
+	assert.Equal(image.Pt(50, 50), size, "frame should be encoded again")
+	assert.Nil(f.Image, "input frame must not be modified")
+
+	stats := p.Stats()
+	assert.Len(stats, 4)
+	assert.Equal("crop", stats[0].Name)
+	assert.Equal(1, stats[3].Frames)
+}
+
+func TestPipelinePassThrough(t *testing.T) {
+	f := testFrame(t, image.NewGray(image.Rect(0, 0, 10, 10)))
+	out, err := NewPipeline(ResizeStage(1), DedupeStage(0)).Process(context.Background(), f)
+	assert.Nil(t, err)
+	assert.Equal(t, f.Data, out.Data, "unchanged frames keep their JPEG data")
+}
+
+func TestPipelineRun(t *testing.T) {
+	assert := assert.New(t)
+	a := testFrame(t, noiseImage(64, 64, 1))
+	b := testFrame(t, noiseImage(64, 64, 2))
+	frameC := make(chan *Frame, 3)
+	frameC <- a
+	frameC <- a
+	frameC <- b
+	close(frameC)
+
+	p := NewPipeline(DedupeStage(0))
+	n := 0
+	for range p.Run(context.Background(), frameC) {
+		n++
+	}
+	assert.Equal(2, n)
+	assert.Nil(p.Err())
+	assert.Equal(1, p.Stats()[0].Dropped)
+
+	failing := NewPipeline(NewStage("fail", func(ctx context.Context, f *Frame) (*Frame, error) {
+		return nil, errors.New("boom")
+	}))
+	frameC = make(chan *Frame, 1)
+	frameC <- a
+	for range failing.Run(context.Background(), frameC) {
+		t.Fatal("no frame expected")
+	}
+	assert.EqualError(failing.Err(), "boom")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outC := NewPipeline().Run(ctx, make(chan *Frame))
+	cancel()
+	select {
+	case _, ok := <-outC:
+		assert.False(ok)
+	case <-time.After(time.Second):
+		t.Fatal("pipeline should stop with its context")
+	}
+}
+
+func TestPipelineRunRelease(t *testing.T) {
+	assert := assert.New(t)
+	pooled := func() *Frame {
+		f := testFrame(t, noiseImage(64, 64, 1))
+		buf := getFrameBuffer(len(f.Data))
+		copy(buf.data, f.Data)
+		return &Frame{Data: buf.data, buf: buf}
+	}
+	a, b := pooled(), pooled()
+	frameC := make(chan *Frame, 2)
+	frameC <- a
+	frameC <- b
+	close(frameC)
+
+	var out []*Frame
+	for f := range NewPipeline(DedupeStage(0)).Run(context.Background(), frameC) {
+		out = append(out, f)
+	}
+	assert.Equal(int32(0), b.buf.refs, "the duplicate is released")
+	if assert.Len(out, 1) {
+		assert.NotEqual(a, out[0], "a copy with its hash")
+		out[0].Release()
+		assert.Equal(int32(0), a.buf.refs, "the copy holds the reference of a")
+	}
+}
+
+func TestThrottleStage(t *testing.T) {
+	s := ThrottleStage(10)
+	f := &Frame{}
+	out, _ := s.Process(context.Background(), f)
+	assert.NotNil(t, out)
+	out, _ = s.Process(context.Background(), f)
+	assert.Nil(t, out, "second frame within 100ms should be dropped")
+
+	s = ThrottleStage(0)
+	for i := 0; i < 2; i++ {
+		out, _ = s.Process(context.Background(), f)
+		assert.NotNil(t, out, "no limit")
+	}
+}
+
+func TestResizeStageFactor(t *testing.T) {
+	f := testFrame(t, image.NewGray(image.Rect(0, 0, 10, 10)))
+	for _, factor := range []float64{0, -0.5} {
+		out, err := ResizeStage(factor).Process(context.Background(), f)
+		assert.Nil(t, out)
+		assert.NotNil(t, err, "factor %v", factor)
+	}
+}
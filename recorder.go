@@ -0,0 +1,282 @@
+package minicap
+
+import (
+	"context"
+	"errors"
+	"image"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrNotRecording = errors.New("not recording")
+
+// ErrFrameSizeChanged stops a recording whose frames change size, as the
+// screen rotates with RotationRaw. RotationUpright keeps the size.
+var ErrFrameSizeChanged = errors.New("frame size changed while recording")
+
+type RecorderOptions struct {
+	FPS         int           // nominal frame rate of the video, default 10
+	MaxDuration time.Duration // stop after this duration, 0 for no limit
+	MaxSize     int64         // stop before the file, index included, exceeds this size, 0 for no limit (AVI is always limited to 1GB)
+	Pipeline    *Pipeline     // processes frames before they are written, optional
+}
+
+// Recorder writes the frames of a FrameSource into MJPEG AVI files.
+// minicap only sends frames when the screen changes, so frames are
+// repeated to keep the video at a constant nominal rate.
+type Recorder struct {
+	src FrameSource
+	opt RecorderOptions
+
+	mu      sync.Mutex
+	sub     *Subscription
+	file    *os.File
+	aw      *AVIWriter
+	size    image.Point // of the frames in the current file
+	start   time.Time   // start of the current file
+	written int         // frames written in the current file
+	last    *Frame      // repeated until the next frame
+	held    *Frame      // holds the reference of the data of last, see keep
+	err     error
+	done    chan struct{}
+}
+
+func NewRecorder(src FrameSource, opt RecorderOptions) *Recorder {
+	if opt.FPS <= 0 {
+		opt.FPS = 10
+	}
+	return &Recorder{
+		src: src,
+		opt: opt,
+	}
+}
+
+// Start recording into a new file at path
+func (r *Recorder) Start(path string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sub != nil {
+		return errors.New("already recording")
+	}
+	if r.file, err = os.Create(path); err != nil {
+		return
+	}
+	r.start = time.Now()
+	r.written = 0
+	r.aw = nil
+	r.last = nil
+	r.err = nil
+	r.done = make(chan struct{})
+	r.sub = r.src.Subscribe(2)
+	go r.run(r.sub, r.done)
+	return nil
+}
+
+// Rotate finishes the current file and continues recording into path
+func (r *Recorder) Rotate(path string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sub == nil {
+		return ErrNotRecording
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	if err = r.finish(time.Now()); err != nil {
+		file.Close()
+		return
+	}
+	r.file = file
+	r.start = time.Now()
+	r.written = 0
+	if r.last != nil {
+		// the new file starts with what is on screen now
+		err = r.writeFrame(r.last)
+	}
+	return
+}
+
+// Stop recording and close the file
+func (r *Recorder) Stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stop(time.Now())
+}
+
+// Done is closed when the recording stopped, by Stop or by reaching a limit
+func (r *Recorder) Done() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done
+}
+
+// Err returns the error that stopped the recording, if any
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) run(sub *Subscription, done chan struct{}) {
+	ticker := time.NewTicker(time.Second / time.Duration(r.opt.FPS))
+	defer ticker.Stop()
+	for {
+		select {
+		case in, ok := <-sub.C():
+			f := in
+			if ok && r.opt.Pipeline != nil {
+				var err error
+				if f, err = r.opt.Pipeline.Process(context.Background(), in); err != nil || f == nil {
+					in.Release()
+					continue
+				}
+			}
+			r.mu.Lock()
+			if r.sub != sub {
+				r.mu.Unlock()
+				if ok {
+					in.Release()
+				}
+				return
+			}
+			if !ok {
+				r.stop(time.Now())
+			} else {
+				r.add(f, in)
+			}
+			r.mu.Unlock()
+		case now := <-ticker.C:
+			r.mu.Lock()
+			if r.sub == sub {
+				r.fill(now)
+			}
+			r.mu.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+// add places f at its slot in the nominal frame sequence, ref is the
+// received frame holding the reference of its data
+// must be called with r.mu held
+func (r *Recorder) add(f, ref *Frame) {
+	slot := r.slot(f.Time)
+	if r.last != nil {
+		r.fillTo(slot)
+	}
+	if r.aw != nil && r.sub != nil {
+		// the AVI header holds a single frame size
+		if size, err := f.Size(); err != nil || size != r.size {
+			if err == nil {
+				err = ErrFrameSizeChanged
+			}
+			r.check(err)
+		}
+	}
+	if r.sub == nil {
+		// stopped by a limit
+		ref.Release()
+		return
+	}
+	r.keep(f, ref)
+	if r.written <= slot {
+		r.check(r.writeFrame(f))
+	}
+}
+
+// keep f as the last frame, releasing the previous one
+func (r *Recorder) keep(f, ref *Frame) {
+	if r.held != nil {
+		r.held.Release()
+	}
+	r.last, r.held = f, ref
+}
+
+// fill repeats the last frame up to now, and enforces the limits
+// must be called with r.mu held
+func (r *Recorder) fill(now time.Time) {
+	if r.last != nil {
+		r.fillTo(r.slot(now))
+	}
+	if r.opt.MaxDuration > 0 && now.Sub(r.start) >= r.opt.MaxDuration {
+		r.stop(now)
+	}
+}
+
+// fillTo repeats the last frame until slot, stopping early if recording stopped
+func (r *Recorder) fillTo(slot int) {
+	for r.sub != nil && r.written < slot {
+		r.check(r.writeFrame(r.last))
+	}
+}
+
+func (r *Recorder) slot(t time.Time) int {
+	if t.Before(r.start) {
+		return 0
+	}
+	return int(t.Sub(r.start) * time.Duration(r.opt.FPS) / time.Second)
+}
+
+func (r *Recorder) writeFrame(f *Frame) (err error) {
+	if r.aw == nil {
+		size, err := f.Size()
+		if err != nil {
+			return err
+		}
+		if r.aw, err = NewAVIWriter(r.file, size.X, size.Y, r.opt.FPS); err != nil {
+			return err
+		}
+		r.size = size
+	}
+	if r.opt.MaxSize > 0 && r.aw.SizeWith(len(f.Data)) > r.opt.MaxSize {
+		return ErrAVITooLarge
+	}
+	if err = r.aw.WriteFrame(f.Data); err != nil {
+		return
+	}
+	r.written++
+	return nil
+}
+
+// check stops the recording on write errors, reaching the size limit is not an error
+func (r *Recorder) check(err error) {
+	if err == nil {
+		return
+	}
+	if err != ErrAVITooLarge {
+		r.err = err
+	}
+	r.stop(time.Now())
+}
+
+// must be called with r.mu held
+func (r *Recorder) stop(now time.Time) (err error) {
+	if r.sub == nil {
+		return ErrNotRecording
+	}
+	r.sub.Close()
+	r.sub = nil
+	r.keep(nil, nil)
+	close(r.done)
+	err = r.finish(now)
+	if r.err == nil {
+		r.err = err
+	}
+	return
+}
+
+// finish closes the current file
+func (r *Recorder) finish(now time.Time) (err error) {
+	if r.aw != nil {
+		err = r.aw.Close()
+		r.aw = nil
+	}
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return
+}
@@ -0,0 +1,304 @@
+package minicap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DumpFormat of ReplayBuffer.Dump
+type DumpFormat string
+
+const (
+	DumpAVI     DumpFormat = "avi"     // MJPEG AVI, like Recorder
+	DumpGIF     DumpFormat = "gif"     // animated GIF, see WriteAnimation
+	DumpAPNG    DumpFormat = "apng"    // animated PNG, see WriteAnimation
+	DumpSession DumpFormat = "session" // session file, see RecordSession
+)
+
+// ParseDumpFormat accepts format names and the file extensions .avi, .gif, .png, .apng and .mcap
+func ParseDumpFormat(name string) (DumpFormat, error) {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "avi":
+		return DumpAVI, nil
+	case "gif":
+		return DumpGIF, nil
+	case "png", "apng":
+		return DumpAPNG, nil
+	case "mcap", "session":
+		return DumpSession, nil
+	}
+	return "", fmt.Errorf("unknown dump format %q", name)
+}
+
+type ReplayOptions struct {
+	Duration  time.Duration    // how far back frames are kept, default 10s
+	MaxBytes  int64            // memory the kept frames may use, default 64MB
+	FPS       int              // nominal frame rate of AVI dumps, default 10
+	Animation AnimationOptions // of GIF and APNG dumps, the format is set by Dump
+}
+
+// ReplayBuffer keeps the recent frames of a FrameSource, so the last seconds
+// of screen can be dumped when something goes wrong ("instant replay").
+// The oldest frames are dropped once older than Duration, or when the kept
+// frames use more than MaxBytes. The frame shown at the start of the window
+// is kept, a static screen still has a replay.
+type ReplayBuffer struct {
+	src FrameSource
+	opt ReplayOptions
+	sub *Subscription
+
+	mu     sync.Mutex
+	ring   []*Frame // oldest at head
+	head   int
+	n      int
+	bytes  int64
+	closed bool
+	done   chan struct{}
+}
+
+// NewReplayBuffer starts keeping the frames of src until Close
+func NewReplayBuffer(src FrameSource, opt ReplayOptions) *ReplayBuffer {
+	if opt.Duration <= 0 {
+		opt.Duration = 10 * time.Second
+	}
+	if opt.MaxBytes <= 0 {
+		opt.MaxBytes = 64 << 20
+	}
+	if opt.FPS <= 0 {
+		opt.FPS = 10
+	}
+	rb := &ReplayBuffer{
+		src:  src,
+		opt:  opt,
+		sub:  src.Subscribe(16),
+		ring: make([]*Frame, 16),
+		done: make(chan struct{}),
+	}
+	go rb.run()
+	return rb
+}
+
+func (rb *ReplayBuffer) run() {
+	defer close(rb.done)
+	for f := range rb.sub.C() {
+		rb.add(f)
+	}
+}
+
+// add keeps f, which holds a reference, and drops what no longer fits
+func (rb *ReplayBuffer) add(f *Frame) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.closed {
+		f.Release()
+		return
+	}
+	if rb.n == len(rb.ring) {
+		ring := make([]*Frame, 2*len(rb.ring))
+		for i := 0; i < rb.n; i++ {
+			ring[i] = rb.at(i)
+		}
+		rb.ring, rb.head = ring, 0
+	}
+	rb.ring[(rb.head+rb.n)%len(rb.ring)] = f
+	rb.n++
+	rb.bytes += int64(len(f.Data))
+	rb.trim(f.Time.Add(-rb.opt.Duration))
+}
+
+// at returns the i-th oldest frame, must be called with rb.mu held
+func (rb *ReplayBuffer) at(i int) *Frame {
+	return rb.ring[(rb.head+i)%len(rb.ring)]
+}
+
+// trim drops the frames that are no longer shown at start, and the oldest
+// ones while over MaxBytes. The newest frame is always kept.
+// must be called with rb.mu held
+func (rb *ReplayBuffer) trim(start time.Time) {
+	for rb.n > 1 && (!rb.at(1).Time.After(start) || rb.bytes > rb.opt.MaxBytes) {
+		f := rb.ring[rb.head]
+		rb.ring[rb.head] = nil
+		rb.head = (rb.head + 1) % len(rb.ring)
+		rb.n--
+		rb.bytes -= int64(len(f.Data))
+		f.Release()
+	}
+}
+
+// Frames returns the frames shown during the last Duration, the first one is
+// timed from the start of the window. Frames hold a reference, see Frame.Release.
+func (rb *ReplayBuffer) Frames() []*Frame {
+	end := time.Now()
+	start := end.Add(-rb.opt.Duration)
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.trim(start)
+	frames := make([]*Frame, 0, rb.n)
+	for i := 0; i < rb.n; i++ {
+		f := rb.at(i).Retain()
+		if i == 0 && f.Time.Before(start) {
+			first := *f
+			first.Time = start
+			f = &first
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// Dump writes the frames of the last Duration into w. AVI dumps need to seek,
+// they are built in memory unless w is an io.WriteSeeker.
+func (rb *ReplayBuffer) Dump(ctx context.Context, w io.Writer, format DumpFormat) (err error) {
+	end := time.Now()
+	frames := rb.Frames()
+	defer func() {
+		for _, f := range frames {
+			f.Release()
+		}
+	}()
+	if len(frames) == 0 {
+		return errors.New("no frames to dump")
+	}
+	switch format {
+	case DumpAVI:
+		return rb.dumpAVI(ctx, w, frames, end)
+	case DumpGIF, DumpAPNG:
+		opt := rb.opt.Animation
+		opt.Format = FormatGIF
+		if format == DumpAPNG {
+			opt.Format = FormatPNG
+		}
+		// the last frame shows until the dump
+		opt.Hold = maxDuration(end.Sub(frames[len(frames)-1].Time), 10*time.Millisecond)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		return WriteAnimation(w, frames, opt)
+	case DumpSession:
+		return rb.dumpSession(ctx, w, frames)
+	}
+	return fmt.Errorf("unknown dump format %q", format)
+}
+
+// DumpFile writes the frames of the last Duration into a new file at path,
+// in the format of its extension, see ParseDumpFormat
+func (rb *ReplayBuffer) DumpFile(ctx context.Context, path string) (err error) {
+	format, err := ParseDumpFormat(filepath.Ext(path))
+	if err != nil {
+		return
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	if err = rb.Dump(ctx, file, format); err != nil {
+		file.Close()
+		os.Remove(path)
+		return
+	}
+	return file.Close()
+}
+
+// dumpAVI writes frames at the nominal frame rate, repeating or skipping them like Recorder.
+// Like Recorder, it fails with ErrFrameSizeChanged when the screen rotated
+// with RotationRaw during the window.
+func (rb *ReplayBuffer) dumpAVI(ctx context.Context, w io.Writer, frames []*Frame, end time.Time) (err error) {
+	ws, ok := w.(io.WriteSeeker)
+	var mem *memWriteSeeker
+	if !ok {
+		mem = &memWriteSeeker{}
+		ws = mem
+	}
+	size, err := frames[0].Size()
+	if err != nil {
+		return
+	}
+	aw, err := NewAVIWriter(ws, size.X, size.Y, rb.opt.FPS)
+	if err != nil {
+		return
+	}
+	start := frames[0].Time
+	slot := func(t time.Time) int {
+		return int(t.Sub(start) * time.Duration(rb.opt.FPS) / time.Second)
+	}
+	// every slot shows the latest frame received before its end
+	for i, k := 0, 0; k <= slot(end); k++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		for i+1 < len(frames) && slot(frames[i+1].Time) <= k {
+			i++
+			// the AVI header holds a single frame size
+			next, err := frames[i].Size()
+			if err != nil {
+				return err
+			}
+			if next != size {
+				return ErrFrameSizeChanged
+			}
+		}
+		if err = aw.WriteFrame(frames[i].Data); err != nil {
+			return
+		}
+	}
+	if err = aw.Close(); err != nil {
+		return
+	}
+	if mem != nil {
+		_, err = w.Write(mem.buf)
+	}
+	return
+}
+
+func (rb *ReplayBuffer) dumpSession(ctx context.Context, w io.Writer, frames []*Frame) (err error) {
+	sw, err := NewSessionWriter(w, frames[0].Time)
+	if err != nil {
+		return
+	}
+	if bs, ok := rb.src.(interface{ Banner() Banner }); ok {
+		if err = sw.WriteBanner(bs.Banner(), frames[0].Time); err != nil {
+			return
+		}
+	}
+	for _, f := range frames {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = sw.WriteFrame(f); err != nil {
+			return
+		}
+	}
+	return sw.Flush()
+}
+
+// Close stops keeping frames and releases the kept ones
+func (rb *ReplayBuffer) Close() error {
+	rb.mu.Lock()
+	if rb.closed {
+		rb.mu.Unlock()
+		return ErrAlreadyClosed
+	}
+	rb.closed = true
+	for i := 0; i < rb.n; i++ {
+		rb.at(i).Release()
+	}
+	rb.ring, rb.head, rb.n, rb.bytes = nil, 0, 0, 0
+	rb.mu.Unlock()
+	rb.sub.Close()
+	<-rb.done
+	return nil
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
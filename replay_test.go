@@ -0,0 +1,127 @@
+package minicap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayBufferTrim(t *testing.T) {
+	assert := assert.New(t)
+	rb := NewReplayBuffer(&Service{}, ReplayOptions{Duration: time.Second, MaxBytes: 100})
+	defer rb.Close()
+
+	start := time.Now().Add(-time.Hour)
+	var frames []*Frame
+	for i := 0; i < 40; i++ {
+		buf := getFrameBuffer(1)
+		f := &Frame{Data: buf.data, Time: start.Add(time.Duration(i) * 100 * time.Millisecond), buf: buf}
+		frames = append(frames, f)
+		rb.add(f)
+	}
+	// the frame at 2.9s is shown at the start of the window
+	rb.mu.Lock()
+	assert.Equal(11, rb.n)
+	assert.Equal(int64(11), rb.bytes)
+	assert.Equal(frames[29], rb.at(0))
+	rb.mu.Unlock()
+	assert.Equal(int32(0), frames[28].buf.refs, "dropped frames are released")
+	assert.Equal(int32(1), frames[29].buf.refs)
+
+	rb.add(&Frame{Data: make([]byte, 95), Time: start.Add(4 * time.Second)})
+	rb.mu.Lock()
+	assert.Equal(6, rb.n, "the oldest frames are dropped to fit in MaxBytes")
+	assert.Equal(int64(100), rb.bytes)
+	rb.mu.Unlock()
+
+	// a static screen keeps its last frame
+	frames = rb.Frames()
+	if assert.Len(frames, 1) {
+		assert.Len(frames[0].Data, 95)
+		assert.True(time.Since(frames[0].Time) < time.Minute, "timed from the start of the window")
+	}
+}
+
+func TestReplayBufferDump(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{banner: Banner{Version: 1, PID: 42}}
+	rb := NewReplayBuffer(s, ReplayOptions{Duration: 2 * time.Second})
+	now := time.Now()
+	frames := animationFrames(t, 0, 0, 0)
+	for i, offset := range []time.Duration{-3 * time.Second, -time.Second, -500 * time.Millisecond} {
+		frames[i].Time = now.Add(offset)
+		s.frames.publish(frames[i])
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		rb.mu.Lock()
+		n := rb.n
+		rb.mu.Unlock()
+		if n == 3 || time.Now().After(deadline) {
+			break
+		}
+	}
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	assert.Nil(rb.Dump(ctx, &buf, DumpAVI))
+	assert.Equal("RIFF", buf.String()[:4])
+	total := binary.LittleEndian.Uint32(buf.Bytes()[48:])
+	assert.InDelta(21, total, 1, "2 seconds at 10 fps")
+
+	buf.Reset()
+	assert.Nil(rb.Dump(ctx, &buf, DumpGIF))
+	g, err := gif.DecodeAll(&buf)
+	if assert.Nil(err) {
+		assert.Len(g.Image, 3)
+		assert.InDelta(100, g.Delay[0], 10, "the first frame is shown from the start of the window")
+		assert.Equal(50, g.Delay[1])
+	}
+
+	buf.Reset()
+	assert.Nil(rb.Dump(ctx, &buf, DumpSession))
+	sr, err := NewSessionReader(bytes.NewReader(buf.Bytes()))
+	if assert.Nil(err) {
+		rec, err := sr.Next()
+		assert.Nil(err)
+		assert.Equal(42, rec.Banner.PID)
+	}
+	replayed, err := SessionFrames(&buf, 0, time.Hour)
+	assert.Nil(err)
+	assert.Len(replayed, 3)
+
+	dir := t.TempDir()
+	assert.Nil(rb.DumpFile(ctx, filepath.Join(dir, "failure.avi")))
+	_, err = os.Stat(filepath.Join(dir, "failure.avi"))
+	assert.Nil(err)
+	assert.NotNil(rb.DumpFile(ctx, filepath.Join(dir, "failure.txt")))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(context.Canceled, rb.DumpFile(cancelled, filepath.Join(dir, "cancelled.mcap")))
+	_, err = os.Stat(filepath.Join(dir, "cancelled.mcap"))
+	assert.True(os.IsNotExist(err))
+
+	assert.Nil(rb.Close())
+	assert.Equal(ErrAlreadyClosed, rb.Close())
+	assert.Empty(rb.Frames())
+}
+
+func TestReplayBufferDumpRotated(t *testing.T) {
+	assert := assert.New(t)
+	rb := NewReplayBuffer(&Service{}, ReplayOptions{Duration: time.Second})
+	defer rb.Close()
+	now := time.Now()
+	rb.add(&Frame{Data: testJPEG(t, 40, 20), Time: now.Add(-500 * time.Millisecond)})
+	rb.add(&Frame{Data: testJPEG(t, 20, 40), Time: now.Add(-200 * time.Millisecond)})
+
+	var buf bytes.Buffer
+	assert.Equal(ErrFrameSizeChanged, rb.Dump(context.Background(), &buf, DumpAVI))
+	assert.Zero(buf.Len())
+}
@@ -0,0 +1,157 @@
+package minicap
+
+import "image"
+
+// RotationMode selects the orientation frames are delivered in
+type RotationMode int
+
+const (
+	// RotationRaw delivers frames as minicap projects them. minicap is
+	// restarted in the new orientation on every rotation, so frames are
+	// upright after a short gap.
+	RotationRaw RotationMode = iota
+	// RotationUpright keeps minicap in natural orientation and rotates the
+	// frames on the host, rotations cause no restart. Frames are re-encoded.
+	RotationUpright
+	// RotationNatural always delivers frames in natural orientation,
+	// Frame.Orientation is 0 whatever the display orientation is.
+	RotationNatural
+)
+
+func (m RotationMode) String() string {
+	switch m {
+	case RotationRaw:
+		return "raw"
+	case RotationUpright:
+		return "upright"
+	case RotationNatural:
+		return "natural"
+	}
+	return "unknown"
+}
+
+// RotateImage turns im, an image in natural orientation, into the upright
+// frame shown in orientation, see NaturalToFrame. RotateImage(im, 360-orientation)
+// turns an upright frame back to natural orientation. RGBA, Gray and
+// YCbCr images are rotated by copying pixels, other images are converted to RGBA.
+func RotateImage(im image.Image, orientation int) image.Image {
+	return rotateImageInto(nil, im, orientation)
+}
+
+// rotateImageInto is RotateImage writing into dst when it has the type and
+// size of the result, dst may be nil
+func rotateImageInto(dst, im image.Image, orientation int) image.Image {
+	o := normOrientation(orientation)
+	if o == 0 || o%90 != 0 {
+		return im
+	}
+	size := rotatedSize(im.Bounds().Size(), o)
+	switch src := im.(type) {
+	case *image.RGBA:
+		d, _ := dst.(*image.RGBA)
+		return rotateRGBA(d, src, o)
+	case *image.Gray:
+		d, _ := dst.(*image.Gray)
+		if d == nil || d.Rect != (image.Rectangle{Max: size}) {
+			d = image.NewGray(image.Rectangle{Max: size})
+		}
+		b := src.Rect
+		rotatePlane(d.Pix, d.Stride, src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, b.Dx(), b.Dy(), 1, o)
+		return d
+	case *image.YCbCr:
+		d, _ := dst.(*image.YCbCr)
+		if d = rotateYCbCr(d, src, o); d != nil {
+			return d
+		}
+	}
+	d, _ := dst.(*image.RGBA)
+	return rotateRGBA(d, toRGBA(im), o)
+}
+
+func rotatedSize(size image.Point, orientation int) image.Point {
+	if orientation%180 != 0 {
+		return image.Pt(size.Y, size.X)
+	}
+	return size
+}
+
+// rotateRGBA rotates src into dst, or a new image if dst does not fit
+func rotateRGBA(dst, src *image.RGBA, orientation int) *image.RGBA {
+	b := src.Rect
+	size := rotatedSize(b.Size(), orientation)
+	if dst == nil || dst.Rect != (image.Rectangle{Max: size}) {
+		dst = image.NewRGBA(image.Rectangle{Max: size})
+	}
+	rotatePlane(dst.Pix, dst.Stride, src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, b.Dx(), b.Dy(), 4, orientation)
+	return dst
+}
+
+// rotateYCbCr rotates the planes of src into dst, or a new image if dst does
+// not fit. nil when the subsampling does not allow it: 4:1:1 and 4:1:0, or
+// odd sizes of subsampled planes.
+func rotateYCbCr(dst, src *image.YCbCr, orientation int) *image.YCbCr {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	cw, ch := w, h
+	ratio := src.SubsampleRatio
+	switch ratio {
+	case image.YCbCrSubsampleRatio444:
+	case image.YCbCrSubsampleRatio422:
+		cw = w / 2
+		if orientation != 180 {
+			ratio = image.YCbCrSubsampleRatio440
+		}
+	case image.YCbCrSubsampleRatio440:
+		ch = h / 2
+		if orientation != 180 {
+			ratio = image.YCbCrSubsampleRatio422
+		}
+	case image.YCbCrSubsampleRatio420:
+		cw, ch = w/2, h/2
+	default:
+		return nil
+	}
+	// chroma samples of odd sizes or origins cover a half luma block at the edge
+	if src.Rect.Min != (image.Point{}) || (cw != w && w%2 != 0) || (ch != h && h%2 != 0) {
+		return nil
+	}
+	r := image.Rectangle{Max: rotatedSize(src.Rect.Size(), orientation)}
+	if dst == nil || dst.Rect != r || dst.SubsampleRatio != ratio {
+		dst = image.NewYCbCr(r, ratio)
+	}
+	rotatePlane(dst.Y, dst.YStride, src.Y, src.YStride, w, h, 1, orientation)
+	rotatePlane(dst.Cb, dst.CStride, src.Cb, src.CStride, cw, ch, 1, orientation)
+	rotatePlane(dst.Cr, dst.CStride, src.Cr, src.CStride, cw, ch, 1, orientation)
+	return dst
+}
+
+// rotatePlane copies a w x h plane of 1 or 4 byte pixels from src into dst,
+// turned like NaturalToFrame does for orientation 90, 180 or 270.
+func rotatePlane(dst []byte, dstStride int, src []byte, srcStride, w, h, bpp, orientation int) {
+	for y := 0; y < h; y++ {
+		row := src[y*srcStride : y*srcStride+w*bpp]
+		// index of the pixel x = 0 in dst, and the step to x + 1
+		var d, step int
+		switch orientation {
+		case 90:
+			d, step = (w-1)*dstStride+y*bpp, -dstStride
+		case 180:
+			d, step = (h-1-y)*dstStride+(w-1)*bpp, -bpp
+		case 270:
+			d, step = (h-1-y)*bpp, dstStride
+		}
+		if bpp == 1 {
+			for _, v := range row {
+				dst[d] = v
+				d += step
+			}
+			continue
+		}
+		for x := 0; x < len(row); x += 4 {
+			dst[d] = row[x]
+			dst[d+1] = row[x+1]
+			dst[d+2] = row[x+2]
+			dst[d+3] = row[x+3]
+			d += step
+		}
+	}
+}
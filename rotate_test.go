@@ -0,0 +1,104 @@
+package minicap
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRGBA(w, h int) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			im.SetRGBA(x, y, color.RGBA{uint8(x * 40), uint8(y * 40), uint8(x + y), 255})
+		}
+	}
+	return im
+}
+
+func testYCbCr(w, h int, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	im := image.NewYCbCr(image.Rect(0, 0, w, h), ratio)
+	for i := range im.Y {
+		im.Y[i] = uint8(i * 7)
+	}
+	for i := range im.Cb {
+		im.Cb[i] = uint8(i * 13)
+		im.Cr[i] = uint8(255 - i*11)
+	}
+	return im
+}
+
+func TestRotateImage(t *testing.T) {
+	assert := assert.New(t)
+	src := testRGBA(6, 4)
+	natural := src.Rect.Size()
+	for _, orientation := range []int{0, 90, 180, 270} {
+		dst := RotateImage(src, orientation)
+		assert.Equal(FrameSize(natural, orientation), dst.Bounds().Size())
+		// every pixel moves like its square in NaturalRectToFrame
+		for y := 0; y < natural.Y; y++ {
+			for x := 0; x < natural.X; x++ {
+				r := NaturalRectToFrame(image.Rect(x, y, x+1, y+1), natural, orientation)
+				assert.Equal(src.At(x, y), dst.At(r.Min.X, r.Min.Y), "orientation %d pixel %d,%d", orientation, x, y)
+			}
+		}
+		assert.Equal(src, RotateImage(dst, 360-orientation))
+	}
+}
+
+func TestRotateImageTypes(t *testing.T) {
+	assert := assert.New(t)
+	gray := image.NewGray(image.Rect(0, 0, 8, 6))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	sub := gray.SubImage(image.Rect(1, 2, 6, 5)).(*image.Gray)
+	images := []image.Image{
+		sub,
+		testRGBA(8, 6).SubImage(image.Rect(1, 1, 7, 4)),
+		testYCbCr(8, 6, image.YCbCrSubsampleRatio444),
+		testYCbCr(8, 6, image.YCbCrSubsampleRatio422),
+		testYCbCr(8, 6, image.YCbCrSubsampleRatio440),
+		testYCbCr(8, 6, image.YCbCrSubsampleRatio420),
+		testYCbCr(7, 5, image.YCbCrSubsampleRatio420), // converted to RGBA
+		testYCbCr(8, 6, image.YCbCrSubsampleRatio411), // converted to RGBA
+	}
+	for i, im := range images {
+		for _, orientation := range []int{90, 180, 270} {
+			got := RotateImage(im, orientation)
+			want := rotateRGBA(nil, toRGBA(im), orientation)
+			assert.Equal(want.Rect, got.Bounds(), "image %d orientation %d", i, orientation)
+			for y := 0; y < want.Rect.Dy(); y++ {
+				for x := 0; x < want.Rect.Dx(); x++ {
+					r, g, b, a := got.At(x, y).RGBA()
+					wr, wg, wb, wa := want.At(x, y).RGBA()
+					if r>>8 != wr>>8 || g>>8 != wg>>8 || b>>8 != wb>>8 || a>>8 != wa>>8 {
+						t.Fatalf("image %d orientation %d pixel %d,%d: %v != %v", i, orientation, x, y, got.At(x, y), want.At(x, y))
+					}
+				}
+			}
+		}
+	}
+	assert.IsType(&image.YCbCr{}, RotateImage(images[5], 90))
+	assert.Equal(image.YCbCrSubsampleRatio440, RotateImage(images[3], 90).(*image.YCbCr).SubsampleRatio)
+	assert.IsType(&image.RGBA{}, RotateImage(images[6], 90))
+}
+
+func BenchmarkRotateImage(b *testing.B) {
+	src := testYCbCr(1080, 1920, image.YCbCrSubsampleRatio420)
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			RotateImage(src, 90)
+		}
+	})
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+		var dst image.Image
+		for i := 0; i < b.N; i++ {
+			dst = rotateImageInto(dst, src, 90)
+		}
+	})
+}
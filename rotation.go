@@ -9,27 +9,41 @@ package minicap
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"net/http"
-	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Rotation struct {
 	d           AdbDevice
 	orientation int
-	proc        *exec.Cmd
 	closed      bool
-	brd         *bufio.Reader
+	done        chan struct{}
+
+	// the watcher process, replaced by watch when it crashes
+	mu   sync.Mutex
+	proc *exec.Cmd
+	brd  *bufio.Reader
+	cmd  func() (*exec.Cmd, error) // builds the watcher command, watcherCommand if nil
 }
 
-func newRotationService(option Options) (r Rotation, err error) {
-	r = Rotation{}
-	r.d, err = newAdbDevice(option.Serial, option.Adb)
+var (
+	rotationRestartDelay = 100 * time.Millisecond // doubled after every failed restart
+	rotationMaxRestarts  = 5                      // in a row before watch gives up
+)
+
+var errRotationStopped = errors.New("rotation watcher stopped")
+
+func newRotationService(d AdbDevice) (r *Rotation, err error) {
+	r = &Rotation{}
+	r.d = d
 	r.closed = true
+	r.done = make(chan struct{})
 	return
 }
 
@@ -80,46 +94,122 @@ func (r *Rotation) install() (err error) {
 	return
 }
 
-//start rotation service
-func (r *Rotation) start() (err error) {
+// watcherCommand runs RotationWatcher from its installed apk
+func (r *Rotation) watcherCommand() (*exec.Cmd, error) {
 	pkgName := "jp.co.cyberagent.stf.rotationwatcher"
 	out, err := r.d.shell("pm path " + pkgName)
 	if err != nil {
-		return
+		return nil, err
 	}
 	fields := strings.Split(strip(out), ":")
 	path := fields[len(fields)-1]
-	r.proc = r.d.buildCommand("CLASSPATH="+path, "app_process", "/system/bin", "jp.co.cyberagent.stf.rotationwatcher.RotationWatcher")
-	r.proc.Stderr = os.Stderr
-	stdoutReader, err := r.proc.StdoutPipe()
+	return r.d.buildCommand("CLASSPATH="+path, "app_process", "/system/bin", "jp.co.cyberagent.stf.rotationwatcher.RotationWatcher"), nil
+}
+
+//start rotation service
+func (r *Rotation) start() (err error) {
+	newCmd := r.cmd
+	if newCmd == nil {
+		newCmd = r.watcherCommand
+	}
+	proc, err := newCmd()
+	if err != nil {
+		return
+	}
+	proc.Stderr = &logWriter{l: r.d.logger(), msg: "rotation watcher stderr"}
+	stdoutReader, err := proc.StdoutPipe()
 	if err != nil {
 		return
 	}
-	r.brd = bufio.NewReader(stdoutReader)
-	return r.proc.Start()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// stop must not miss a process started after it
+	select {
+	case <-r.done:
+		return errRotationStopped
+	default:
+	}
+	if err = proc.Start(); err != nil {
+		return
+	}
+	r.proc, r.brd = proc, bufio.NewReader(stdoutReader)
+	r.d.logger().Info("rotation watcher started", "pid", proc.Process.Pid)
+	return
+}
+
+// reader returns the output of the current watcher process
+func (r *Rotation) reader() (proc *exec.Cmd, brd *bufio.Reader) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.proc, r.brd
 }
 
+// watch sends the orientations reported by the watcher started by start, the
+// watcher is restarted when it crashes. The channel is closed after stop, or
+// when the watcher can not be restarted.
 func (r *Rotation) watch() (orienC <-chan int, err error) {
-	rC := make(chan int, 0)
+	proc, brd := r.reader()
+	if brd == nil {
+		return nil, errors.New("rotation watcher not started")
+	}
+	rC := make(chan int)
 	go func() {
-		for {
-			line, _, er := r.brd.ReadLine()
+		defer close(rC)
+		delay := rotationRestartDelay
+		for failures := 0; ; {
+			line, _, er := brd.ReadLine()
 			if er != nil {
-				// restart if rotation watcher crashed.
-				r.start()
+				// reap the crashed watcher
+				proc.Process.Kill()
+				proc.Wait()
+				for {
+					select {
+					case <-r.done:
+						return
+					case <-time.After(delay):
+					}
+					r.d.logger().Warn("rotation watcher stopped, restarting", "err", er)
+					if er = r.start(); er == nil {
+						break
+					}
+					if failures++; failures >= rotationMaxRestarts {
+						r.d.logger().Error("rotation watcher can not restart", "err", er)
+						return
+					}
+					delay *= 2
+				}
+				proc, brd = r.reader()
 				continue
-				//break
 			}
 			tmp := strings.Replace(string(line), "\r", "", -1)
 			tmp = strings.Replace(tmp, "\n", "", -1)
 			orientation, er := strconv.Atoi(string(tmp))
 			if er != nil {
-				break
+				return
+			}
+			failures, delay = 0, rotationRestartDelay
+			select {
+			case rC <- orientation:
+			case <-r.done:
+				return
 			}
-			rC <- orientation
 		}
-		close(rC)
 	}()
 	orienC = rC
 	return
 }
+
+// stop the rotation watcher, it is not restarted by watch anymore
+func (r *Rotation) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	close(r.done)
+	if r.proc != nil && r.proc.Process != nil {
+		r.proc.Process.Kill()
+	}
+}
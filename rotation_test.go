@@ -0,0 +1,84 @@
+package minicap
+
+import (
+	"errors"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWatcher makes r run a watcher that reports 90 and 180 and crashes,
+// restarts fail after ok starts
+func fakeWatcher(t *testing.T, r *Rotation, ok int32) *int32 {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	var starts int32
+	r.cmd = func() (*exec.Cmd, error) {
+		if atomic.AddInt32(&starts, 1) > ok {
+			return nil, errors.New("adb is gone")
+		}
+		return exec.Command("sh", "-c", "echo 90; echo 180"), nil
+	}
+	return &starts
+}
+
+func TestRotationRestart(t *testing.T) {
+	assert := assert.New(t)
+	r, _ := newRotationService(AdbDevice{})
+	starts := fakeWatcher(t, r, 100)
+	_, err := r.watch()
+	assert.NotNil(err, "not started")
+	assert.Nil(r.start())
+	orienC, err := r.watch()
+	assert.Nil(err)
+
+	var got []int
+	for len(got) < 4 {
+		select {
+		case o := <-orienC:
+			got = append(got, o)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no orientation")
+		}
+	}
+	assert.Equal([]int{90, 180, 90, 180}, got, "the crashed watcher is restarted")
+	assert.True(atomic.LoadInt32(starts) >= 2)
+
+	// nobody receives anymore, stop must end the watch anyway
+	time.Sleep(2 * rotationRestartDelay)
+	r.stop()
+	r.stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-orienC:
+			if !ok {
+				assert.Equal(errRotationStopped, r.start())
+				return
+			}
+		case <-timeout:
+			t.Fatal("watch did not stop")
+		}
+	}
+}
+
+func TestRotationGiveUp(t *testing.T) {
+	defer func(delay time.Duration) { rotationRestartDelay = delay }(rotationRestartDelay)
+	rotationRestartDelay = time.Millisecond
+	r, _ := newRotationService(AdbDevice{})
+	starts := fakeWatcher(t, r, 1)
+	assert.Nil(t, r.start())
+	orienC, err := r.watch()
+	assert.Nil(t, err)
+	n := 0
+	for range orienC {
+		n++
+	}
+	assert.Equal(t, 2, n)
+	assert.Equal(t, int32(1+rotationMaxRestarts), atomic.LoadInt32(starts))
+	r.stop()
+}
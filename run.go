@@ -0,0 +1,432 @@
+package minicap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// reDialInterval is the wait between two connections to minicap
+const reDialInterval = 100 * time.Millisecond
+
+// command asks the run loop to pause, resume or stop
+type command struct {
+	op   string
+	done chan error
+}
+
+// capturedFrame is a frame decoded by the reader of a connection
+type capturedFrame struct {
+	frame *Frame
+	im    image.Image
+	black bool
+}
+
+// minicapConn is a connection to minicap, read by its own goroutine
+type minicapConn struct {
+	rc     io.ReadCloser
+	frameC chan capturedFrame
+	errC   chan error
+	done   chan struct{}
+
+	// display orientation, changed by the run loop when rotating on the host
+	orientation int32
+}
+
+func (c *minicapConn) close() {
+	close(c.done)
+	c.rc.Close()
+}
+
+// dialResult is the outcome of a connection attempt of generation gen
+type dialResult struct {
+	gen    int
+	rc     io.ReadCloser
+	banner Banner
+	err    error
+}
+
+// runLoop owns the capture after Start: the minicap connection, the display
+// info and the state changes. Other goroutines talk to it through channels
+// and read its results from the Service under s.mu.
+type runLoop struct {
+	s      *Service
+	b      backend
+	info   DisplayInfo
+	orienC <-chan int
+	conn   *minicapConn
+
+	dialC     chan dialResult
+	dialing   bool // an attempt of the current generation is in flight
+	gen       int  // bumped by disconnect, results of older attempts are dropped
+	dials     int  // failed attempts in a row
+	retryC    <-chan time.Time
+	connected bool // connected once, the next connections are reconnects
+}
+
+// run is the goroutine started by Start, startedC receives the result of starting minicap
+func (s *Service) run(startedC chan<- error) {
+	defer close(s.loopDone)
+	l := &runLoop{s: s, b: s.backend, dialC: make(chan dialResult)}
+	err := l.startup()
+	startedC <- err
+	if err != nil {
+		l.finish(err)
+		return
+	}
+	for {
+		var frameC chan capturedFrame
+		var errC chan error
+		if l.conn != nil {
+			frameC, errC = l.conn.frameC, l.conn.errC
+		}
+		var err error // stops the capture
+		select {
+		case cmd := <-s.cmdC:
+			if cmd.op == "stop" {
+				l.finish(nil)
+				cmd.done <- nil
+				return
+			}
+			cmd.done <- l.handle(cmd.op)
+		case orientation, ok := <-l.orienC:
+			if !ok {
+				l.orienC = nil
+				continue
+			}
+			err = l.rotate(orientation)
+		case res := <-l.dialC:
+			err = l.dialed(res)
+		case <-l.retryC:
+			l.retryC = nil
+			l.connect()
+		case f := <-frameC:
+			l.publish(f)
+		case readErr := <-errC:
+			l.disconnect()
+			s.logger().Warn("read minicap frame", "err", readErr)
+			l.setState(StateReconnecting, readErr)
+			l.connect()
+		}
+		if err != nil {
+			l.finish(err)
+			return
+		}
+		if s.State() == StateStopped {
+			return
+		}
+	}
+}
+
+// startup installs and starts minicap in the current orientation
+func (l *runLoop) startup() (err error) {
+	if l.info, err = l.b.prepare(); err != nil {
+		return
+	}
+	l.setState(StateStarting, nil)
+	if l.orienC, err = l.b.watchRotation(); err != nil {
+		return
+	}
+	// TODO(ssx): too slow here
+	select {
+	case orientation, ok := <-l.orienC:
+		if !ok {
+			return errors.New("cannot fetch rotation")
+		}
+		l.info.Orientation = orientation
+	case <-time.After(time.Second):
+		l.s.logger().Error("no orientation from the rotation watcher")
+		return errors.New("cannot fetch rotation")
+	}
+	l.s.setDisplayInfo(l.info)
+	if err = l.startMinicap(); err != nil {
+		return
+	}
+	l.connect()
+	return
+}
+
+func (l *runLoop) setState(to State, err error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	l.s.setState(to, err)
+}
+
+// handle pause and resume, stop is handled by run. A failed resume stops the capture.
+func (l *runLoop) handle(op string) error {
+	st := l.s.State()
+	switch {
+	case op == "pause" && (st == StateStarting || st == StateStreaming || st == StateReconnecting):
+		l.disconnect()
+		l.setState(StatePaused, nil)
+		return l.b.kill()
+	case op == "resume" && st == StatePaused:
+		l.setState(StateStarting, nil)
+		if err := l.startMinicap(); err != nil {
+			l.finish(err)
+			return err
+		}
+		l.connect()
+		return nil
+	}
+	return invalidState(op, st)
+}
+
+// startMinicap starts minicap in the current orientation, in natural
+// orientation when frames are rotated on the host
+func (l *runLoop) startMinicap() error {
+	orientation := l.info.Orientation
+	if l.s.rotation != RotationRaw {
+		orientation = 0
+	}
+	return l.b.start(l.info, orientation)
+}
+
+// rotate restarts minicap in the new orientation, unless paused or
+// rotating on the host
+func (l *runLoop) rotate(orientation int) error {
+	if orientation == l.info.Orientation {
+		return nil
+	}
+	l.info.Orientation = orientation
+	l.s.setDisplayInfo(l.info)
+	l.s.metrics.rotated()
+	l.s.logger().Info("rotated", "orientation", orientation)
+	if l.s.State() == StatePaused {
+		return nil // Resume starts minicap in the current orientation
+	}
+	if l.s.rotation != RotationRaw {
+		if l.conn != nil {
+			atomic.StoreInt32(&l.conn.orientation, int32(orientation))
+		}
+		return nil
+	}
+	l.disconnect()
+	l.setState(StateReconnecting, nil)
+	if err := l.startMinicap(); err != nil {
+		l.s.logger().Error("restart minicap after rotation", "err", err)
+		return err
+	}
+	l.connect()
+	return nil
+}
+
+// connect dials minicap in the background, the result arrives on dialC
+func (l *runLoop) connect() {
+	if l.dialing {
+		return
+	}
+	l.dialing = true
+	l.retryC = nil
+	gen, b, dialC, done := l.gen, l.b, l.dialC, l.s.loopDone
+	go func() {
+		res := dialResult{gen: gen}
+		if res.rc, res.err = b.dial(); res.err == nil {
+			if res.banner, res.err = readBanner(res.rc); res.err != nil {
+				res.rc.Close()
+				res.rc = nil
+			}
+		}
+		select {
+		case dialC <- res:
+		case <-done:
+			if res.rc != nil {
+				res.rc.Close()
+			}
+		}
+	}()
+}
+
+// dialed handles a connection attempt, retrying failures and restarting
+// minicap half way through the retries when reconnecting.
+func (l *runLoop) dialed(res dialResult) error {
+	if res.gen != l.gen {
+		if res.rc != nil {
+			res.rc.Close()
+		}
+		return nil
+	}
+	l.dialing = false
+	s := l.s
+	if res.err != nil {
+		l.dials++
+		if l.dials > s.maxReDialCnt {
+			s.logger().Error("connect to minicap", "socket", "minicap", "port", s.lforwardPort, "err", res.err)
+			return fmt.Errorf("connect to minicap: %w", res.err)
+		}
+		if l.dials == s.maxReDialCnt/2 && s.State() == StateReconnecting {
+			s.logger().Warn("restart minicap", "err", res.err)
+			if err := l.startMinicap(); err != nil {
+				return err
+			}
+		}
+		l.retryC = time.After(reDialInterval)
+		return nil
+	}
+	l.dials = 0
+	s.logger().Info("minicap connected", "socket", "minicap", "pid", res.banner.PID,
+		"width", res.banner.VirtualWidth, "height", res.banner.VirtualHeight)
+	s.mu.Lock()
+	s.banner = res.banner
+	s.setState(StateStreaming, nil)
+	s.mu.Unlock()
+	if l.connected {
+		s.metrics.reconnected()
+	}
+	l.connected = true
+	l.conn = l.read(res.rc)
+	return nil
+}
+
+// disconnect closes the connection and forgets the attempt in flight
+func (l *runLoop) disconnect() {
+	if l.conn != nil {
+		l.conn.close()
+		l.conn = nil
+	}
+	l.gen++
+	l.dialing = false
+	l.dials = 0
+	l.retryC = nil
+}
+
+// read starts the goroutine reading and decoding the frames of rc
+func (l *runLoop) read(rc io.ReadCloser) *minicapConn {
+	c := &minicapConn{
+		rc:          rc,
+		frameC:      make(chan capturedFrame),
+		errC:        make(chan error, 1),
+		done:        make(chan struct{}),
+		orientation: int32(l.info.Orientation),
+	}
+	fr := &frameReader{
+		s:       l.s,
+		rd:      bufio.NewReader(rc), // Do not put it into for loop
+		natural: image.Pt(l.info.Width, l.info.Height),
+	}
+	go func() {
+		for {
+			orientation := int(atomic.LoadInt32(&c.orientation))
+			f, err := fr.next(orientation)
+			if err != nil {
+				c.errC <- err
+				return
+			}
+			select {
+			case c.frameC <- f:
+			case <-c.done:
+				f.frame.Release()
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// frameReader reads the frames of a minicap connection
+type frameReader struct {
+	s       *Service
+	rd      *bufio.Reader
+	natural image.Point
+	rotated image.Image // reused for rotations that are only encoded
+}
+
+// next reads the next frame, orientation is the display orientation.
+// Frames are only decoded when their image is needed: for Capture, to
+// rotate or crop them on the host, or when they may be black. The latter
+// only needs a thumbnail when the decoder can shrink while decoding.
+func (fr *frameReader) next(orientation int) (f capturedFrame, err error) {
+	s := fr.s
+	if f.frame, err = readFrame(fr.rd); err != nil {
+		return
+	}
+	f.frame.Orientation = orientation
+	f.frame.dec = s.decoder
+	if s.rotation == RotationNatural {
+		f.frame.Orientation = 0
+	}
+	s.metrics.received(f.frame)
+	rotate := s.rotation == RotationUpright && orientation != 0
+	keep := s.capturing()
+	if !rotate && s.crop.Empty() && !keep && !mayBeBlack(f.frame.Data, fr.natural.X*fr.natural.Y) {
+		return
+	}
+
+	start := time.Now()
+	var im image.Image
+	if sd, ok := f.frame.decoder().(ScaledDecoder); ok && !rotate && s.crop.Empty() && !keep {
+		// only to tell whether it is black, which a thumbnail does
+		im, err = sd.DecodeScaled(f.frame.Data, 8)
+	} else {
+		im, err = s.decode(f.frame)
+	}
+	s.metrics.decoded(time.Since(start), err)
+	if err != nil {
+		f.frame.Release()
+		return
+	}
+	f.black = IsBlackFrame(im)
+	if rotate {
+		if keep {
+			im = RotateImage(im, orientation)
+		} else {
+			// the image is dropped once encoded, its buffer serves the next frame
+			fr.rotated = rotateImageInto(fr.rotated, im, orientation)
+			im = fr.rotated
+		}
+	}
+	if !s.crop.Empty() {
+		im = cropImage(im, s.crop, fr.natural, f.frame.Orientation)
+	}
+	if rotate || !s.crop.Empty() {
+		if err = encodeFrame(f.frame, im); err != nil {
+			f.frame.Release()
+			return
+		}
+	}
+	if keep {
+		f.im = im
+	}
+	return
+}
+
+// publish a frame to the subscribers, the Capture channel and LastScreenshot.
+// The service keeps the reference of the reader as its last frame.
+func (l *runLoop) publish(f capturedFrame) {
+	s := l.s
+	s.mu.Lock()
+	if s.lastFrame != nil {
+		s.lastFrame.Release()
+	}
+	s.lastImage = f.im // nil when not decoded, LastScreenshot decodes it
+	s.lastFrame = f.frame
+	s.screenOff = f.black
+	s.frames.publish(f.frame)
+	if f.im != nil {
+		select {
+		case s.imageC <- f.im:
+		default:
+		}
+	}
+	s.mu.Unlock()
+	s.metrics.published(f.frame)
+}
+
+// finish stops the capture because of err, nil when closed
+func (l *runLoop) finish(err error) {
+	l.disconnect()
+	s := l.s
+	s.mu.Lock()
+	s.setState(StateStopped, err)
+	close(s.imageC)
+	s.mu.Unlock()
+	s.frames.closeAll()
+	if err != nil {
+		s.logger().Error("capture stopped", "err", err)
+	}
+	l.b.stop()
+}
@@ -0,0 +1,469 @@
+package minicap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMinicap is a backend serving frames like minicap from a local listener.
+// Connections made while minicap is not running are closed at once, like
+// adb forward does.
+type fakeMinicap struct {
+	ln      net.Listener
+	frame   []byte
+	rotateC chan int
+	done    chan struct{}
+	stopC   sync.Once
+
+	mu          sync.Mutex
+	running     bool
+	pid         int   // incremented by every start
+	starts      []int // orientations minicap was started in
+	conns       []net.Conn
+	stopped     bool
+	noRestart   bool // start fails
+	orientation int
+}
+
+func newFakeMinicap(t *testing.T) *fakeMinicap {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &fakeMinicap{ln: ln, frame: testJPEG(t, 40, 80), rotateC: make(chan int, 1), done: make(chan struct{})}
+	fm.rotateC <- 0
+	go fm.serve()
+	t.Cleanup(func() { ln.Close() })
+	return fm
+}
+
+func (fm *fakeMinicap) serve() {
+	for {
+		conn, err := fm.ln.Accept()
+		if err != nil {
+			return
+		}
+		fm.mu.Lock()
+		if !fm.running {
+			fm.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		fm.conns = append(fm.conns, conn)
+		pid, orientation := fm.pid, fm.orientation
+		fm.mu.Unlock()
+		go fm.stream(conn, pid, orientation)
+	}
+}
+
+func (fm *fakeMinicap) stream(w io.WriteCloser, pid, orientation int) {
+	defer w.Close()
+	banner := []byte{1, 24}
+	banner = binary.LittleEndian.AppendUint32(banner, uint32(pid))
+	for _, v := range []uint32{40, 80, 40, 80} {
+		banner = binary.LittleEndian.AppendUint32(banner, v)
+	}
+	banner = append(banner, byte(orientation/90), 0)
+	if _, err := w.Write(banner); err != nil {
+		return
+	}
+	for {
+		frame := binary.LittleEndian.AppendUint32(nil, uint32(len(fm.frame)))
+		if _, err := w.Write(append(frame, fm.frame...)); err != nil {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (fm *fakeMinicap) prepare() (DisplayInfo, error) {
+	return DisplayInfo{Width: 40, Height: 80}, nil
+}
+
+func (fm *fakeMinicap) watchRotation() (<-chan int, error) {
+	orienC := make(chan int)
+	go func() {
+		defer close(orienC)
+		for {
+			select {
+			case orientation := <-fm.rotateC:
+				select {
+				case orienC <- orientation:
+				case <-fm.done:
+					return
+				}
+			case <-fm.done:
+				return
+			}
+		}
+	}()
+	return orienC, nil
+}
+
+// rotate the fake display, nothing happens after stop
+func (fm *fakeMinicap) rotate(orientation int) {
+	select {
+	case fm.rotateC <- orientation:
+	case <-fm.done:
+	}
+}
+
+func (fm *fakeMinicap) start(info DisplayInfo, orientation int) error {
+	fm.kill()
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.noRestart && fm.pid > 0 {
+		return io.ErrClosedPipe
+	}
+	fm.running = true
+	fm.pid++
+	fm.orientation = orientation
+	fm.starts = append(fm.starts, orientation)
+	return nil
+}
+
+// kill minicap and its connections, like a crash when called by a test
+func (fm *fakeMinicap) kill() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.running = false
+	for _, conn := range fm.conns {
+		conn.Close()
+	}
+	fm.conns = nil
+	return nil
+}
+
+func (fm *fakeMinicap) dial() (io.ReadCloser, error) {
+	return net.Dial("tcp", fm.ln.Addr().String())
+}
+
+func (fm *fakeMinicap) stop() {
+	fm.kill()
+	fm.mu.Lock()
+	fm.stopped = true
+	fm.mu.Unlock()
+	fm.stopC.Do(func() { close(fm.done) })
+}
+
+func (fm *fakeMinicap) state() (running, stopped bool, starts []int) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return fm.running, fm.stopped, append([]int(nil), fm.starts...)
+}
+
+func fakeService(fm *fakeMinicap) *Service {
+	r, _ := newRotationService(AdbDevice{})
+	return &Service{backend: fm, r: r, maxReDialCnt: 4}
+}
+
+// waitState waits for the service to change to state to
+func waitState(t *testing.T, changes <-chan StateChange, to State) StateChange {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				t.Fatalf("stopped waiting for %v", to)
+			}
+			if change.To == to {
+				return change
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %v", to)
+		}
+	}
+}
+
+// waitFrame waits for a frame in orientation
+func waitFrame(t *testing.T, sub *Subscription, orientation int) *Frame {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case f, ok := <-sub.C():
+			if !ok {
+				t.Fatal("subscription closed")
+			}
+			if f.Orientation == orientation {
+				return f
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for a frame in orientation %d", orientation)
+		}
+	}
+}
+
+func TestRunCapture(t *testing.T) {
+	assert := assert.New(t)
+	fm := newFakeMinicap(t)
+	s := fakeService(fm)
+	changes := s.States()
+	sub := s.Subscribe(1)
+
+	imageC, err := s.Capture()
+	assert.Nil(err)
+	waitState(t, changes, StateStreaming)
+	im := <-imageC
+	assert.Equal(80, im.Bounds().Dy())
+	waitFrame(t, sub, 0)
+	assert.Equal(1, s.Banner().PID)
+	assert.Equal(DisplayInfo{Width: 40, Height: 80}, s.DisplayInfo())
+	last, err := s.LastScreenshot()
+	assert.Nil(err)
+	assert.NotNil(last)
+	assert.True(errors.Is(s.Start(), ErrInvalidState))
+	again, err := s.Capture()
+	assert.Nil(err, "Capture of a started service")
+	assert.Equal(imageC, again)
+
+	assert.Nil(s.Close())
+	assert.Equal(StateStopped, s.State())
+	assert.Nil(s.Err())
+	for range sub.C() {
+	}
+	for range imageC {
+	}
+	running, stopped, _ := fm.state()
+	assert.False(running)
+	assert.True(stopped)
+	assert.Equal(ErrAlreadyClosed, s.Close())
+	assert.Equal(ErrAlreadyClosed, s.Pause())
+}
+
+func TestRunRotation(t *testing.T) {
+	assert := assert.New(t)
+	fm := newFakeMinicap(t)
+	s := fakeService(fm)
+	changes := s.States()
+	sub := s.Subscribe(1)
+	assert.Nil(s.Start())
+	defer s.Close()
+	waitState(t, changes, StateStreaming)
+
+	fm.rotate(90)
+	waitState(t, changes, StateReconnecting)
+	waitState(t, changes, StateStreaming)
+	waitFrame(t, sub, 90)
+	assert.Equal(90, s.DisplayInfo().Orientation)
+	_, _, starts := fm.state()
+	assert.Equal([]int{0, 90}, starts)
+	stats := s.Stats()
+	assert.Equal(uint64(1), stats.Rotations)
+	assert.Equal(uint64(1), stats.Reconnects)
+}
+
+func TestRunReconnect(t *testing.T) {
+	assert := assert.New(t)
+	fm := newFakeMinicap(t)
+	s := fakeService(fm)
+	changes := s.States()
+	assert.Nil(s.Start())
+	defer s.Close()
+	waitState(t, changes, StateStreaming)
+
+	fm.kill() // crash, dials fail until minicap is restarted
+	change := waitState(t, changes, StateReconnecting)
+	assert.NotNil(change.Err)
+	waitState(t, changes, StateStreaming)
+	assert.Equal(2, s.Banner().PID)
+	_, _, starts := fm.state()
+	assert.Equal([]int{0, 0}, starts)
+}
+
+func TestRunGiveUp(t *testing.T) {
+	assert := assert.New(t)
+	fm := newFakeMinicap(t)
+	fm.noRestart = true
+	s := fakeService(fm)
+	changes := s.States()
+	sub := s.Subscribe(1)
+	assert.Nil(s.Start())
+	waitState(t, changes, StateStreaming)
+
+	fm.kill()
+	change := waitState(t, changes, StateStopped)
+	assert.NotNil(change.Err)
+	assert.Equal(change.Err, s.Err())
+	for range sub.C() {
+	}
+	<-s.loopDone
+	_, stopped, _ := fm.state()
+	assert.True(stopped)
+	assert.Equal(ErrAlreadyClosed, s.Close())
+}
+
+func TestRunPauseResume(t *testing.T) {
+	assert := assert.New(t)
+	fm := newFakeMinicap(t)
+	s := fakeService(fm)
+	changes := s.States()
+	sub := s.Subscribe(1)
+	assert.Nil(s.Start())
+	defer s.Close()
+	waitState(t, changes, StateStreaming)
+
+	assert.Nil(s.Pause())
+	assert.Equal(StatePaused, s.State())
+	running, _, _ := fm.state()
+	assert.False(running)
+	assert.True(errors.Is(s.Pause(), ErrInvalidState))
+
+	// rotating while paused only starts minicap on resume
+	fm.rotate(270)
+	for s.DisplayInfo().Orientation != 270 {
+		time.Sleep(time.Millisecond)
+	}
+	_, _, starts := fm.state()
+	assert.Equal([]int{0}, starts)
+
+	assert.Nil(s.Resume())
+	waitState(t, changes, StateStreaming)
+	waitFrame(t, sub, 270)
+	_, _, starts = fm.state()
+	assert.Equal([]int{0, 270}, starts)
+}
+
+func TestRunInterleavings(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		fm := newFakeMinicap(t)
+		s := fakeService(fm)
+		sub := s.Subscribe(1)
+		assert.Nil(t, s.Start())
+
+		var wg sync.WaitGroup
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for range sub.C() {
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				s.LastScreenshot()
+				s.DisplayInfo()
+				s.Stats()
+				s.Pause()
+				s.Resume()
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			fm.rotate(90 * (i%3 + 1))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * time.Millisecond)
+			s.Close()
+		}(i)
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("deadlock in round %d", i)
+		}
+		assert.Equal(t, StateStopped, s.State())
+	}
+}
+
+func TestRunRotationUpright(t *testing.T) {
+	assert := assert.New(t)
+	fm := newFakeMinicap(t)
+	s := fakeService(fm)
+	s.rotation = RotationUpright
+	changes := s.States()
+	sub := s.Subscribe(1)
+	assert.Nil(s.Start())
+	defer s.Close()
+	waitState(t, changes, StateStreaming)
+
+	fm.rotate(90)
+	f := waitFrame(t, sub, 90)
+	size, err := f.Size()
+	assert.Nil(err)
+	assert.Equal(image.Pt(80, 40), size)
+	assert.Equal(90, s.frameOrientation())
+	_, _, starts := fm.state()
+	assert.Equal([]int{0}, starts)
+	assert.Equal(uint64(0), s.Stats().Reconnects)
+}
+
+func TestRunRotationNatural(t *testing.T) {
+	assert := assert.New(t)
+	fm := newFakeMinicap(t)
+	s := fakeService(fm)
+	s.rotation = RotationNatural
+	changes := s.States()
+	assert.Nil(s.Start())
+	defer s.Close()
+	waitState(t, changes, StateStreaming)
+
+	fm.rotate(270)
+	for s.DisplayInfo().Orientation != 270 {
+		time.Sleep(time.Millisecond)
+	}
+	sub := s.Subscribe(1)
+	defer sub.Close()
+	f := waitFrame(t, sub, 0)
+	size, err := f.Size()
+	assert.Nil(err)
+	assert.Equal(image.Pt(40, 80), size)
+	assert.Equal(0, s.frameOrientation())
+	_, _, starts := fm.state()
+	assert.Equal([]int{0}, starts)
+}
+
+func BenchmarkFrameReader(b *testing.B) {
+	// a frame too big to be black, as most frames are
+	im := image.NewGray(image.Rect(0, 0, 360, 640))
+	for i := range im.Pix {
+		im.Pix[i] = uint8(i * 31 % 251)
+	}
+	data := new(bytes.Buffer)
+	if err := jpeg.Encode(data, im, nil); err != nil {
+		b.Fatal(err)
+	}
+	stream := frameStream(data.Bytes(), 1)
+	for _, capture := range []bool{false, true} {
+		name := "subscribe"
+		if capture {
+			name = "capture"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := &Service{}
+			if capture {
+				s.decodeAll = 1
+			}
+			rd := bytes.NewReader(stream)
+			fr := &frameReader{s: s, rd: bufio.NewReader(rd), natural: image.Pt(360, 640)}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rd.Reset(stream)
+				fr.rd.Reset(rd)
+				f, err := fr.next(0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				f.frame.Release()
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package minicap
+
+import (
+	"context"
+	"image"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blackMaxLuma  = 32 // brightest pixel of a black frame, leaves room for JPEG noise
+	blackMeanLuma = 8
+)
+
+// screenOffStall is how long a stream goes without frames before ScreenOff
+// asks the device whether its screen is on
+var screenOffStall = 2 * time.Second
+
+// ScreenState tells whether the device shows anything minicap can capture
+type ScreenState struct {
+	On     bool `json:"on"`
+	Locked bool `json:"locked"` // the keyguard is showing
+	Dozing bool `json:"dozing"` // ambient display, the screen shows a clock at most
+	Secure bool `json:"secure"` // the focused window has FLAG_SECURE, frames are black
+}
+
+// ScreenEvent is sent when the screen state changes
+type ScreenEvent struct {
+	Time  time.Time
+	State ScreenState
+}
+
+var (
+	displayPowerRe = regexp.MustCompile(`Display Power: state=(\w+)`)
+	wakefulnessRe  = regexp.MustCompile(`mWakefulness=(\w+)`)
+	screenOnRe     = regexp.MustCompile(`mScreenOn=(true|false)`)
+	lockedRes      = []*regexp.Regexp{
+		regexp.MustCompile(`mShowingLockscreen=true`),
+		regexp.MustCompile(`mDreamingLockscreen=true`),
+		regexp.MustCompile(`isStatusBarKeyguard=true`),
+		regexp.MustCompile(`(?s)KeyguardServiceDelegate\s+showing=true`),
+	}
+	focusRe  = regexp.MustCompile(`mCurrentFocus=Window\{(\w+) `)
+	windowRe = regexp.MustCompile(`Window #\d+ Window\{(\w+) `)
+)
+
+// parsePowerState reads the screen power from dumpsys power
+func parsePowerState(out string) (on, dozing bool) {
+	if m := displayPowerRe.FindStringSubmatch(out); m != nil {
+		switch m[1] {
+		case "ON", "VR":
+			return true, false
+		case "DOZE", "DOZE_SUSPEND", "ON_SUSPEND":
+			return false, true
+		}
+		return false, false
+	}
+	if m := wakefulnessRe.FindStringSubmatch(out); m != nil {
+		switch m[1] {
+		case "Awake", "Dreaming":
+			return true, false
+		case "Dozing":
+			return false, true
+		}
+		return false, false
+	}
+	if m := screenOnRe.FindStringSubmatch(out); m != nil {
+		return m[1] == "true", false
+	}
+	return false, false
+}
+
+// parseWindowState reads the keyguard and the flags of the focused window from dumpsys window
+func parseWindowState(out string) (locked, secure bool) {
+	for _, re := range lockedRes {
+		if re.MatchString(out) {
+			locked = true
+			break
+		}
+	}
+	m := focusRe.FindStringSubmatch(out)
+	if m == nil {
+		return
+	}
+	current := ""
+	for _, line := range splitLines(out) {
+		if w := windowRe.FindStringSubmatch(line); w != nil {
+			current = w[1]
+			continue
+		}
+		if current != m[1] {
+			continue
+		}
+		if i := strings.Index(line, " fl="); i >= 0 {
+			flags := strings.Fields(line[i+len(" fl="):])
+			for _, flag := range flags {
+				if strings.Contains(flag, "=") {
+					break // the next attribute
+				}
+				if flag == "SECURE" || strings.HasSuffix(flag, "FLAG_SECURE") {
+					return locked, true
+				}
+			}
+		}
+	}
+	return
+}
+
+// Return the screen state of the device from dumpsys power and dumpsys window
+func (s *Service) ScreenState() (state ScreenState, err error) {
+	out, err := s.d.shell("dumpsys", "power")
+	if err != nil {
+		return
+	}
+	state.On, state.Dozing = parsePowerState(out)
+	if out, err = s.d.shell("dumpsys", "window"); err != nil {
+		return
+	}
+	state.Locked, state.Secure = parseWindowState(out)
+	return
+}
+
+// WakeUp turns the screen on, it does not unlock the keyguard
+func (s *Service) WakeUp() (err error) {
+	state, err := s.ScreenState()
+	if err != nil || state.On {
+		return
+	}
+	// KEYCODE_WAKEUP exists since android 4.4W, POWER toggles but the screen is known to be off
+	keycode := KeycodePower
+	if sdk, _ := s.d.getProp("ro.build.version.sdk"); sdk != "" {
+		if v, _ := strconv.Atoi(sdk); v >= 20 {
+			keycode = KeycodeWakeUp
+		}
+	}
+	return shellKey(s.d, keycode)
+}
+
+// WatchScreenState polls the screen state every interval and sends the
+// first state and every change. The channel is closed when ctx is done.
+func (s *Service) WatchScreenState(ctx context.Context, interval time.Duration) <-chan ScreenEvent {
+	eventC := make(chan ScreenEvent, 1)
+	go func() {
+		defer close(eventC)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var last *ScreenState
+		for {
+			state, err := s.ScreenState()
+			if err == nil && (last == nil || state != *last) {
+				last = &state
+				select {
+				case eventC <- ScreenEvent{Time: time.Now(), State: state}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return eventC
+}
+
+// IsBlackFrame reports whether im is all black, like the frames minicap
+// sends while the screen is off or a secure window is shown.
+func IsBlackFrame(im image.Image) bool {
+	b := im.Bounds()
+	if b.Empty() {
+		return false
+	}
+	w := thumbWidth
+	if b.Dx() < w {
+		w = b.Dx()
+	}
+	h := b.Dy() * w / b.Dx()
+	if h < 1 {
+		h = 1
+	}
+	// the thumbnail averages out JPEG noise
+	small := scaleGray(grayPlane(im), w, h)
+	sum := 0
+	for _, v := range small.Pix {
+		if v > blackMaxLuma {
+			return false
+		}
+		sum += int(v)
+	}
+	return sum <= blackMeanLuma*len(small.Pix)
+}
+
+// mayBeBlack tells from the size of a JPEG of pixels pixels whether it may be
+// all black, such a JPEG takes well under two bytes per 8x8 block.
+// Frames that can not be black are not decoded to check.
+func mayBeBlack(data []byte, pixels int) bool {
+	return len(data) < pixels/32
+}
+
+// ScreenOff reports whether the last captured frames were black, which
+// usually means the screen is off. minicap sends no frames while the screen
+// does not change, and some devices stop sending frames once the screen is
+// off: when the stream stalls, the screen state of the device tells.
+func (s *Service) ScreenOff() bool {
+	s.mu.Lock()
+	off, state := s.screenOff, s.state
+	stalled := s.lastFrame != nil && time.Since(s.lastFrame.Time) >= screenOffStall
+	s.mu.Unlock()
+	if off || state != StateStreaming || !stalled {
+		return off
+	}
+	return s.screenCheck.off(s)
+}
+
+// screenCheck asks a stalled service for its screen state, at most once
+// per screenOffStall
+type screenCheck struct {
+	mu      sync.Mutex
+	at      time.Time
+	wasOff  bool
+	stateFn func() (ScreenState, error) // nil: Service.ScreenState, set by tests
+}
+
+func (c *screenCheck) off(s *Service) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.at) < screenOffStall {
+		return c.wasOff
+	}
+	stateFn := c.stateFn
+	if stateFn == nil {
+		stateFn = s.ScreenState
+	}
+	state, err := stateFn()
+	c.at = time.Now()
+	c.wasOff = err == nil && !state.On
+	return c.wasOff
+}
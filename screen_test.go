@@ -0,0 +1,101 @@
+package minicap
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePowerState(t *testing.T) {
+	for _, tc := range []struct {
+		out        string
+		on, dozing bool
+	}{
+		{"Power Manager State:\n  mWakefulness=Awake\n", true, false},
+		{"  mWakefulness=Asleep\n", false, false},
+		{"  mWakefulness=Dozing\n", false, true},
+		{"  mWakefulness=Asleep\nDisplay Power: state=DOZE\n", false, true},
+		{"  mWakefulness=Awake\nDisplay Power: state=ON\n", true, false},
+		{"  mScreenOn=true\n", true, false},
+		{"", false, false},
+	} {
+		on, dozing := parsePowerState(tc.out)
+		assert.Equal(t, tc.on, on, tc.out)
+		assert.Equal(t, tc.dozing, dozing, tc.out)
+	}
+}
+
+const testDumpsysWindow = `WINDOW MANAGER POLICY STATE (dumpsys window policy)
+    mShowingLockscreen=false mShowingDream=false
+    KeyguardServiceDelegate
+      showing=true
+WINDOW MANAGER WINDOWS (dumpsys window windows)
+  Window #0 Window{1f2e3d u0 com.android.systemui.ImageWallpaper}:
+    mAttrs=WM.LayoutParams{(0,0)(fillxfill) ty=WALLPAPER fl=NOT_FOCUSABLE LAYOUT_IN_SCREEN fmt=OPAQUE}
+  Window #1 Window{4a5b6c u0 com.example.bank/com.example.bank.Login}:
+    mAttrs=WM.LayoutParams{(0,0)(fillxfill) sim=#20 ty=BASE_APPLICATION fl=LAYOUT_IN_SCREEN SECURE HARDWARE_ACCELERATED wanim=0x1030465}
+  mCurrentFocus=Window{4a5b6c u0 com.example.bank/com.example.bank.Login}
+`
+
+func TestParseWindowState(t *testing.T) {
+	locked, secure := parseWindowState(testDumpsysWindow)
+	assert.True(t, locked)
+	assert.True(t, secure)
+
+	// the wallpaper is not secure
+	out := strings.Replace(testDumpsysWindow, "mCurrentFocus=Window{4a5b6c", "mCurrentFocus=Window{1f2e3d", 1)
+	out = strings.Replace(out, "showing=true", "showing=false", 1)
+	locked, secure = parseWindowState(out)
+	assert.False(t, locked)
+	assert.False(t, secure)
+}
+
+func TestIsBlackFrame(t *testing.T) {
+	im := image.NewRGBA(image.Rect(0, 0, 100, 200))
+	for i := 3; i < len(im.Pix); i += 4 {
+		im.Pix[i] = 255
+	}
+	// black after a JPEG round trip, as sent by minicap
+	buf := new(bytes.Buffer)
+	assert.Nil(t, jpeg.Encode(buf, im, nil))
+	decoded, err := jpeg.Decode(buf)
+	assert.Nil(t, err)
+	assert.True(t, IsBlackFrame(decoded))
+
+	// a dark screen with a little text is not black
+	for y := 90; y < 110; y++ {
+		for x := 10; x < 90; x++ {
+			im.Set(x, y, color.White)
+		}
+	}
+	assert.False(t, IsBlackFrame(im))
+	assert.False(t, IsBlackFrame(image.NewGray(image.Rectangle{})))
+}
+
+func TestScreenOffStalled(t *testing.T) {
+	assert := assert.New(t)
+	asked := 0
+	s := &Service{state: StateStreaming}
+	s.screenCheck.stateFn = func() (ScreenState, error) {
+		asked++
+		return ScreenState{On: false}, nil
+	}
+	s.lastFrame = &Frame{Time: time.Now()}
+	assert.False(s.ScreenOff(), "frames still arrive")
+	assert.Equal(0, asked)
+
+	// no frame for a while, the device says the screen is off
+	s.lastFrame = &Frame{Time: time.Now().Add(-2 * screenOffStall)}
+	assert.True(s.ScreenOff())
+	assert.True(s.ScreenOff())
+	assert.Equal(1, asked, "asked once per stall interval")
+
+	s.state = StatePaused
+	assert.False(s.ScreenOff(), "paused streams send no frames anyway")
+}
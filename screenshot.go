@@ -0,0 +1,444 @@
+package minicap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ImageFormat of encoded screenshots
+type ImageFormat string
+
+const (
+	FormatJPEG ImageFormat = "jpeg"
+	FormatPNG  ImageFormat = "png"
+	FormatGIF  ImageFormat = "gif"
+)
+
+// Metadata keys written by EncodeScreenshot
+const (
+	MetaSerial      = "Serial"
+	MetaModel       = "Model"
+	MetaOrientation = "Orientation"   // of the image in degrees
+	MetaTime        = "Creation Time" // RFC 3339
+	MetaSoftware    = "Software"
+)
+
+var errNotImage = errors.New("unknown image data")
+
+// ParseImageFormat accepts format names and file extensions like ".jpg"
+func ParseImageFormat(name string) (ImageFormat, error) {
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "jpg", "jpeg":
+		return FormatJPEG, nil
+	case "png":
+		return FormatPNG, nil
+	case "gif":
+		return FormatGIF, nil
+	}
+	return "", fmt.Errorf("unknown image format %q", name)
+}
+
+// WithMetadata adds the metadata key to screenshots written by EncodeScreenshot.
+// Keys are at most 79 characters and contain no '=', values are UTF-8
+// without NUL.
+func WithMetadata(key, value string) ScreenshotOption {
+	return func(c *screenshotConfig) {
+		if c.meta == nil {
+			c.meta = make(map[string]string)
+		}
+		c.meta[key] = value
+	}
+}
+
+// EncodeScreenshot writes a screenshot in format, with the serial and model
+// of the device, the orientation and the capture time as metadata: PNG text
+// chunks, JPEG and GIF comments. While streaming the last frame is used, JPEG
+// screenshots without region are the bytes minicap sent.
+func (s *Service) EncodeScreenshot(w io.Writer, format ImageFormat, opts ...ScreenshotOption) (err error) {
+	data, err := s.encodeScreenshot(format, newScreenshotConfig(opts))
+	if err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	return
+}
+
+// SaveScreenshot writes a screenshot into the file path, in the format of its
+// extension, see EncodeScreenshot
+func (s *Service) SaveScreenshot(path string, opts ...ScreenshotOption) (err error) {
+	format, err := ParseImageFormat(filepath.Ext(path))
+	if err != nil {
+		return
+	}
+	data, err := s.encodeScreenshot(format, newScreenshotConfig(opts))
+	if err != nil {
+		return
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (s *Service) encodeScreenshot(format ImageFormat, cfg screenshotConfig) (data []byte, err error) {
+	var (
+		im          image.Image
+		orientation int
+		taken       time.Time
+	)
+	// frames cropped with Options.Crop no longer hold every region
+	if f := s.LastFrame(); f != nil && !s.IsClosed() && (cfg.region.Empty() || s.crop.Empty()) {
+		defer f.Release()
+		orientation, taken = f.Orientation, f.Time
+		if format == FormatJPEG && cfg.region.Empty() && f.Data != nil {
+			data = f.Data
+		} else if im, err = s.decode(f); err != nil {
+			return
+		} else if !cfg.region.Empty() {
+			info := s.DisplayInfo()
+			im = cropImage(im, cfg.region, image.Pt(info.Width, info.Height), f.Orientation)
+		}
+	} else {
+		var info DisplayInfo
+		if im, info, err = s.screenshot(cfg); err != nil {
+			return
+		}
+		orientation, taken = info.Orientation, time.Now()
+	}
+	if data == nil {
+		var buf bytes.Buffer
+		if err = encodeImage(&buf, im, format); err != nil {
+			return
+		}
+		data = buf.Bytes()
+	}
+
+	meta := map[string]string{
+		MetaSerial:      s.Serial(),
+		MetaModel:       s.deviceModel(),
+		MetaOrientation: strconv.Itoa(orientation),
+		MetaTime:        taken.Format(time.RFC3339Nano),
+		MetaSoftware:    "go-minicap",
+	}
+	for k, v := range cfg.meta {
+		meta[k] = v
+	}
+	return addMetadata(data, format, meta)
+}
+
+// deviceModel returns ro.product.model, empty if unknown
+func (s *Service) deviceModel() string {
+	s.mu.Lock()
+	model := s.model
+	s.mu.Unlock()
+	if model != "" {
+		return model
+	}
+	model, err := s.GetProp("ro.product.model")
+	if err != nil {
+		return ""
+	}
+	s.mu.Lock()
+	s.model = model
+	s.mu.Unlock()
+	return model
+}
+
+// EncodeImage writes im in format with the metadata meta, which may be nil
+func EncodeImage(w io.Writer, im image.Image, format ImageFormat, meta map[string]string) (err error) {
+	var buf bytes.Buffer
+	if err = encodeImage(&buf, im, format); err != nil {
+		return
+	}
+	data, err := addMetadata(buf.Bytes(), format, meta)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	return
+}
+
+func encodeImage(w io.Writer, im image.Image, format ImageFormat) error {
+	switch format {
+	case FormatJPEG:
+		return jpeg.Encode(w, im, &jpeg.Options{Quality: 90})
+	case FormatPNG:
+		return png.Encode(w, im)
+	case FormatGIF:
+		return gif.Encode(w, im, nil)
+	}
+	return fmt.Errorf("unknown image format %q", format)
+}
+
+// addMetadata inserts meta into the encoded image data, data is not modified.
+// Entries are sorted by key, empty values are left out.
+func addMetadata(data []byte, format ImageFormat, meta map[string]string) (out []byte, err error) {
+	keys := make([]string, 0, len(meta))
+	for k, v := range meta {
+		if k == "" || len(k) > 79 || strings.ContainsAny(k, "=\x00") ||
+			strings.IndexByte(v, 0) >= 0 || !utf8.ValidString(v) {
+			return nil, fmt.Errorf("invalid metadata %q", k)
+		}
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var pos int // where the metadata goes
+	var blocks bytes.Buffer
+	switch format {
+	case FormatJPEG:
+		// after SOI and the APPn segments, JFIF and Exif must come first
+		if pos, err = jpegMetadataPos(data); err != nil {
+			return
+		}
+		for _, k := range keys {
+			comment := k + "=" + meta[k]
+			if len(comment) > 0xffff-2 {
+				return nil, fmt.Errorf("metadata %q too long", k)
+			}
+			blocks.Write([]byte{0xff, 0xfe})
+			binary.Write(&blocks, binary.BigEndian, uint16(len(comment)+2))
+			blocks.WriteString(comment)
+		}
+	case FormatPNG:
+		// after IHDR, which must be first
+		if len(data) < 33 || string(data[:8]) != pngHeader || string(data[12:16]) != "IHDR" {
+			return nil, errNotImage
+		}
+		pos = 33
+		for _, k := range keys {
+			writePNGText(&blocks, k, meta[k])
+		}
+	case FormatGIF:
+		// after the global color table, before the first image
+		if len(data) < 13 || string(data[:4]) != "GIF8" {
+			return nil, errNotImage
+		}
+		pos = 13
+		if data[10]&0x80 != 0 {
+			pos += 3 << (data[10]&7 + 1)
+		}
+		for _, k := range keys {
+			blocks.Write([]byte{0x21, 0xfe})
+			writeGIFSubBlocks(&blocks, []byte(k+"="+meta[k]))
+		}
+	default:
+		return nil, fmt.Errorf("unknown image format %q", format)
+	}
+	if pos > len(data) {
+		return nil, errNotImage
+	}
+	out = make([]byte, 0, len(data)+blocks.Len())
+	out = append(out, data[:pos]...)
+	out = append(out, blocks.Bytes()...)
+	out = append(out, data[pos:]...)
+	if format == FormatGIF {
+		copy(out, "GIF89a") // extensions need GIF89a
+	}
+	return
+}
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// jpegMetadataPos returns the offset of the first segment after the APPn ones
+func jpegMetadataPos(data []byte) (int, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, errNotImage
+	}
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff && data[pos+1] >= 0xe0 && data[pos+1] <= 0xef {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	return pos, nil
+}
+
+// writePNGText writes a tEXt chunk, or an iTXt chunk when value is not Latin-1
+func writePNGText(w *bytes.Buffer, key, value string) {
+	latin := make([]byte, 0, len(value))
+	for _, r := range value {
+		latin = append(latin, byte(r))
+		if r > 0xff {
+			latin = nil
+			break
+		}
+	}
+	typ, text := "tEXt", key+"\x00"+string(latin)
+	if latin == nil {
+		// no compression, language nor translated keyword
+		typ, text = "iTXt", key+"\x00\x00\x00\x00\x00"+value
+	}
+	writePNGChunk(w, typ, []byte(text))
+}
+
+func writePNGChunk(w *bytes.Buffer, typ string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	io.MultiWriter(w, crc).Write(append([]byte(typ), data...))
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// writeGIFSubBlocks writes data as GIF sub-blocks of at most 255 bytes
+func writeGIFSubBlocks(w *bytes.Buffer, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > 255 {
+			n = 255
+		}
+		w.WriteByte(byte(n))
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	w.WriteByte(0)
+}
+
+// ReadImageMetadata returns the metadata of a JPEG, PNG or GIF image: text
+// chunks of PNG, and comments of JPEG and GIF written like EncodeScreenshot
+// does, "key=value". Other comments are returned under the key "Comment".
+func ReadImageMetadata(data []byte) (meta map[string]string, err error) {
+	meta = make(map[string]string)
+	add := func(comment string) {
+		if i := strings.IndexByte(comment, '='); i > 0 {
+			meta[comment[:i]] = comment[i+1:]
+		} else {
+			meta["Comment"] = comment
+		}
+	}
+	switch {
+	case len(data) >= 2 && data[0] == 0xff && data[1] == 0xd8:
+		err = readJPEGComments(data, add)
+	case len(data) >= 8 && string(data[:8]) == pngHeader:
+		err = readPNGText(data, meta)
+	case len(data) >= 13 && string(data[:4]) == "GIF8":
+		err = readGIFComments(data, add)
+	default:
+		err = errNotImage
+	}
+	return
+}
+
+func readJPEGComments(data []byte, add func(string)) error {
+	for pos := 2; ; {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return io.ErrUnexpectedEOF
+		}
+		marker := data[pos+1]
+		if marker == 0xda || marker == 0xd9 { // the image data is next
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			return io.ErrUnexpectedEOF
+		}
+		if marker == 0xfe {
+			add(string(data[pos+4 : pos+2+size]))
+		}
+		pos += 2 + size
+	}
+}
+
+func readPNGText(data []byte, meta map[string]string) error {
+	for pos := 8; pos+12 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		if pos+12+size > len(data) {
+			return io.ErrUnexpectedEOF
+		}
+		chunk := data[pos+8 : pos+8+size]
+		pos += 12 + size
+		switch typ {
+		case "tEXt":
+			if i := bytes.IndexByte(chunk, 0); i > 0 {
+				value := make([]rune, 0, len(chunk)-i-1)
+				for _, b := range chunk[i+1:] {
+					value = append(value, rune(b)) // Latin-1
+				}
+				meta[string(chunk[:i])] = string(value)
+			}
+		case "iTXt":
+			// keyword, compression flag and method, language, translated keyword, text
+			i := bytes.IndexByte(chunk, 0)
+			if i <= 0 || len(chunk) < i+3 || chunk[i+1] != 0 {
+				continue // compressed
+			}
+			if parts := bytes.SplitN(chunk[i+3:], []byte{0}, 3); len(parts) == 3 {
+				meta[string(chunk[:i])] = string(parts[2])
+			}
+		case "IEND":
+			return nil
+		}
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func readGIFComments(data []byte, add func(string)) error {
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&7 + 1)
+	}
+	// subBlocks returns the sub-blocks from pos, and the position after them
+	subBlocks := func(pos int) ([]byte, int, error) {
+		var out []byte
+		for pos < len(data) {
+			n := int(data[pos])
+			if n == 0 {
+				return out, pos + 1, nil
+			}
+			if pos+1+n > len(data) {
+				break
+			}
+			out = append(out, data[pos+1:pos+1+n]...)
+			pos += 1 + n
+		}
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	for pos < len(data) {
+		var (
+			block []byte
+			err   error
+		)
+		switch data[pos] {
+		case 0x21: // extension
+			if pos+2 > len(data) {
+				return io.ErrUnexpectedEOF
+			}
+			label := data[pos+1]
+			if block, pos, err = subBlocks(pos + 2); err != nil {
+				return err
+			}
+			if label == 0xfe {
+				add(string(block))
+			}
+		case 0x2c: // image descriptor, local color table, LZW code size
+			if pos+10 > len(data) {
+				return io.ErrUnexpectedEOF
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			if _, pos, err = subBlocks(pos + 1); err != nil {
+				return err
+			}
+		case 0x3b: // trailer
+			return nil
+		default:
+			return errNotImage
+		}
+	}
+	return io.ErrUnexpectedEOF
+}
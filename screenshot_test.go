@@ -0,0 +1,104 @@
+package minicap
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func streamingService(t *testing.T) *Service {
+	s := &Service{state: StateStreaming, model: "Pixel 3"}
+	s.d.Serial = "emulator-5554"
+	s.dispInfo = DisplayInfo{Width: 20, Height: 40, Orientation: 90}
+	s.lastFrame = &Frame{Data: testJPEG(t, 40, 20), Orientation: 90, Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	return s
+}
+
+func TestEncodeScreenshot(t *testing.T) {
+	assert := assert.New(t)
+	s := streamingService(t)
+	for _, format := range []ImageFormat{FormatJPEG, FormatPNG, FormatGIF} {
+		var buf bytes.Buffer
+		assert.Nil(s.EncodeScreenshot(&buf, format, WithMetadata("Test", "é✓")), format)
+		im, name, err := image.Decode(bytes.NewReader(buf.Bytes()))
+		assert.Nil(err, format)
+		assert.Equal(string(format), name)
+		assert.Equal(image.Pt(40, 20), im.Bounds().Size())
+
+		meta, err := ReadImageMetadata(buf.Bytes())
+		assert.Nil(err, format)
+		assert.Equal(map[string]string{
+			MetaSerial:      "emulator-5554",
+			MetaModel:       "Pixel 3",
+			MetaOrientation: "90",
+			MetaTime:        "2020-01-02T03:04:05Z",
+			MetaSoftware:    "go-minicap",
+			"Test":          "é✓",
+		}, meta, format)
+	}
+
+	// the JPEG of minicap is kept, only comments are added
+	var buf bytes.Buffer
+	assert.Nil(s.EncodeScreenshot(&buf, FormatJPEG))
+	data := s.lastFrame.Data
+	pos, _ := jpegMetadataPos(data)
+	assert.True(bytes.HasSuffix(buf.Bytes(), data[pos:]))
+
+	buf.Reset()
+	assert.Nil(s.EncodeScreenshot(&buf, FormatJPEG, WithRegion(image.Rect(0, 0, 20, 10))))
+	im, _, err := image.Decode(&buf)
+	assert.Nil(err)
+	assert.Equal(image.Pt(10, 20), im.Bounds().Size(), "region in natural orientation")
+
+	assert.NotNil(s.EncodeScreenshot(&buf, FormatJPEG, WithMetadata("a=b", "c")))
+	assert.NotNil(s.EncodeScreenshot(&buf, "bmp"))
+}
+
+func TestSaveScreenshot(t *testing.T) {
+	assert := assert.New(t)
+	s := streamingService(t)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "screen.PNG")
+	assert.Nil(s.SaveScreenshot(path))
+	data, err := os.ReadFile(path)
+	assert.Nil(err)
+	_, err = png.Decode(bytes.NewReader(data))
+	assert.Nil(err)
+	meta, err := ReadImageMetadata(data)
+	assert.Nil(err)
+	assert.Equal("emulator-5554", meta[MetaSerial])
+
+	assert.NotNil(s.SaveScreenshot(filepath.Join(dir, "screen.bmp")))
+	_, err = os.Stat(filepath.Join(dir, "screen.bmp"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestImageMetadata(t *testing.T) {
+	assert := assert.New(t)
+	im := image.NewPaletted(image.Rect(0, 0, 4, 4), []color.Color{color.Black, color.White})
+	var buf bytes.Buffer
+	long := string(bytes.Repeat([]byte("x"), 600)) // more than one GIF sub-block
+	assert.Nil(EncodeImage(&buf, im, FormatGIF, map[string]string{"Long": long, "Empty": ""}))
+	assert.Equal("GIF89a", buf.String()[:6])
+	_, err := gif.Decode(bytes.NewReader(buf.Bytes()))
+	assert.Nil(err)
+	meta, err := ReadImageMetadata(buf.Bytes())
+	assert.Nil(err)
+	assert.Equal(map[string]string{"Long": long}, meta)
+
+	_, err = ReadImageMetadata([]byte("BM"))
+	assert.NotNil(err)
+
+	format, err := ParseImageFormat(".JPG")
+	assert.Nil(err)
+	assert.Equal(FormatJPEG, format)
+}
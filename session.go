@@ -0,0 +1,431 @@
+package minicap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A session file keeps the minicap stream exactly as received:
+//
+//	header: "MCAP" version(uint8) start(int64, unix nanoseconds)
+//	record: type(uint8) offset(int64, nanoseconds since start) length(uint32) payload
+//
+// All integers are little endian.
+const (
+	sessionMagic   = "MCAP"
+	sessionVersion = 1
+)
+
+type SessionRecordType uint8
+
+const (
+	SessionBanner      SessionRecordType = 1 // payload: 8 uint32, the fields of Banner
+	SessionFrame       SessionRecordType = 2 // payload: JPEG data
+	SessionOrientation SessionRecordType = 3 // payload: uint32, degrees
+)
+
+var ErrBadSession = errors.New("not a minicap session file")
+
+// maxSessionRecord bounds the payload of a record, far above a JPEG frame,
+// so a corrupt length is not allocated
+const maxSessionRecord = 64 << 20
+
+// SessionRecord is one entry of a session file
+type SessionRecord struct {
+	Type        SessionRecordType
+	Offset      time.Duration // since the start of the session
+	Banner      Banner        // for SessionBanner
+	Data        []byte        // JPEG, for SessionFrame
+	Orientation int           // for SessionOrientation
+}
+
+// SessionWriter writes a minicap stream into a session file
+type SessionWriter struct {
+	w           *bufio.Writer
+	start       time.Time
+	orientation int
+	banner      Banner
+}
+
+func NewSessionWriter(w io.Writer, start time.Time) (sw *SessionWriter, err error) {
+	sw = &SessionWriter{
+		w:           bufio.NewWriter(w),
+		start:       start,
+		orientation: -1,
+	}
+	if _, err = sw.w.WriteString(sessionMagic); err != nil {
+		return nil, err
+	}
+	if err = sw.w.WriteByte(sessionVersion); err != nil {
+		return nil, err
+	}
+	if err = binary.Write(sw.w, binary.LittleEndian, start.UnixNano()); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *SessionWriter) writeRecord(typ SessionRecordType, t time.Time, payload []byte) (err error) {
+	if err = sw.w.WriteByte(byte(typ)); err != nil {
+		return
+	}
+	if err = binary.Write(sw.w, binary.LittleEndian, int64(t.Sub(sw.start))); err != nil {
+		return
+	}
+	if err = binary.Write(sw.w, binary.LittleEndian, uint32(len(payload))); err != nil {
+		return
+	}
+	_, err = sw.w.Write(payload)
+	return
+}
+
+// WriteBanner records the banner, unless it is the same as the previous one
+func (sw *SessionWriter) WriteBanner(b Banner, t time.Time) error {
+	if b == sw.banner {
+		return nil
+	}
+	sw.banner = b
+	payload := make([]byte, 32)
+	for i, v := range []int{b.Version, b.PID, b.RealWidth, b.RealHeight,
+		b.VirtualWidth, b.VirtualHeight, b.Orientation, b.Quirks} {
+		binary.LittleEndian.PutUint32(payload[i*4:], uint32(v))
+	}
+	return sw.writeRecord(SessionBanner, t, payload)
+}
+
+// WriteOrientation records a change of the display orientation
+func (sw *SessionWriter) WriteOrientation(orientation int, t time.Time) error {
+	if orientation == sw.orientation {
+		return nil
+	}
+	sw.orientation = orientation
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, uint32(orientation))
+	return sw.writeRecord(SessionOrientation, t, payload)
+}
+
+// WriteFrame records a frame, preceded by an orientation record if the orientation changed
+func (sw *SessionWriter) WriteFrame(f *Frame) (err error) {
+	if err = sw.WriteOrientation(f.Orientation, f.Time); err != nil {
+		return
+	}
+	return sw.writeRecord(SessionFrame, f.Time, f.Data)
+}
+
+// Flush buffered records to the underlying writer
+func (sw *SessionWriter) Flush() error {
+	return sw.w.Flush()
+}
+
+// sessionOrientationPoll is how often RecordSession looks for rotations
+// between frames
+var sessionOrientationPoll = 100 * time.Millisecond
+
+// RecordSession writes the stream of s into w until ctx is done or the capture stops.
+// Rotations are recorded when they happen, not only with the next frame.
+func RecordSession(ctx context.Context, s *Service, w io.Writer) (err error) {
+	sub := s.Subscribe(16)
+	defer sub.Close()
+	sw, err := NewSessionWriter(w, time.Now())
+	if err != nil {
+		return
+	}
+	defer func() {
+		if ferr := sw.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+	ticker := time.NewTicker(sessionOrientationPoll)
+	defer ticker.Stop()
+	started := false
+	for {
+		select {
+		case f, ok := <-sub.C():
+			if !ok {
+				return nil
+			}
+			started = true
+			if err = sw.WriteBanner(s.Banner(), f.Time); err != nil {
+				f.Release()
+				return
+			}
+			err = sw.WriteFrame(f)
+			f.Release()
+			if err != nil {
+				return
+			}
+		case now := <-ticker.C:
+			// the orientation is known once frames arrive
+			if !started {
+				continue
+			}
+			if err = sw.WriteOrientation(s.frameOrientation(), now); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// SessionReader reads the records of a session file
+type SessionReader struct {
+	r     *bufio.Reader
+	Start time.Time
+}
+
+func NewSessionReader(r io.Reader) (sr *SessionReader, err error) {
+	sr = &SessionReader{r: bufio.NewReader(r)}
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(sr.r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != sessionMagic {
+		return nil, ErrBadSession
+	}
+	if header[4] != sessionVersion {
+		return nil, fmt.Errorf("unsupported session version %d", header[4])
+	}
+	var start int64
+	if err = binary.Read(sr.r, binary.LittleEndian, &start); err != nil {
+		return nil, err
+	}
+	sr.Start = time.Unix(0, start)
+	return sr, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the session
+func (sr *SessionReader) Next() (rec SessionRecord, err error) {
+	var head struct {
+		Type   uint8
+		Offset int64
+		Length uint32
+	}
+	if err = binary.Read(sr.r, binary.LittleEndian, &head); err != nil {
+		return
+	}
+	if head.Length > maxSessionRecord {
+		return rec, fmt.Errorf("session record of %d bytes, corrupt file?", head.Length)
+	}
+	payload := make([]byte, head.Length)
+	if _, err = io.ReadFull(sr.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	rec.Type = SessionRecordType(head.Type)
+	rec.Offset = time.Duration(head.Offset)
+	switch rec.Type {
+	case SessionBanner:
+		if len(payload) < 32 {
+			return rec, ErrBadSession
+		}
+		v := func(i int) int { return int(binary.LittleEndian.Uint32(payload[i*4:])) }
+		rec.Banner = Banner{v(0), v(1), v(2), v(3), v(4), v(5), v(6), v(7)}
+	case SessionFrame:
+		rec.Data = payload
+	case SessionOrientation:
+		if len(payload) < 4 {
+			return rec, ErrBadSession
+		}
+		rec.Orientation = int(binary.LittleEndian.Uint32(payload))
+	}
+	return rec, nil
+}
+
+// ReplaySource plays a session file back through the same API as a capturing Service
+type ReplaySource struct {
+	Speed float64 // 1 plays with original timing, 2 twice as fast, 0 without any delay
+
+	sr     *SessionReader
+	closer io.Closer
+	frames frameHub
+
+	mu        sync.Mutex
+	started   bool
+	banner    Banner
+	lastFrame *Frame
+	stop      chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+func NewReplaySource(r io.Reader) (rs *ReplaySource, err error) {
+	sr, err := NewSessionReader(r)
+	if err != nil {
+		return
+	}
+	return &ReplaySource{
+		Speed: 1,
+		sr:    sr,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// OpenReplay opens the session file at path for replay
+func OpenReplay(path string) (rs *ReplaySource, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	if rs, err = NewReplaySource(f); err != nil {
+		f.Close()
+		return
+	}
+	rs.closer = f
+	return
+}
+
+// Start playing, frames are delivered to subscribers
+func (rs *ReplaySource) Start() error {
+	return rs.play(nil)
+}
+
+// Capture starts playing and returns decoded frames like Service.Capture.
+// Unlike a live capture no frame is dropped, playback waits for the receiver.
+// The channel is closed at the end of the session.
+func (rs *ReplaySource) Capture() (imageC <-chan image.Image, err error) {
+	imC := make(chan image.Image, 1)
+	if err = rs.play(imC); err != nil {
+		return
+	}
+	return imC, nil
+}
+
+func (rs *ReplaySource) play(imC chan image.Image) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.started {
+		return errors.New("replay already started")
+	}
+	rs.started = true
+	go rs.run(imC)
+	return nil
+}
+
+func (rs *ReplaySource) run(imC chan image.Image) {
+	defer close(rs.done)
+	defer rs.frames.closeAll()
+	if imC != nil {
+		defer close(imC)
+	}
+	start := time.Now()
+	orientation := 0
+	for {
+		select {
+		case <-rs.stop:
+			return
+		default:
+		}
+		rec, err := rs.sr.Next()
+		if err != nil {
+			if err != io.EOF {
+				rs.mu.Lock()
+				rs.err = err
+				rs.mu.Unlock()
+			}
+			return
+		}
+		if rs.Speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Offset) / rs.Speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-rs.stop:
+				return
+			}
+		}
+		switch rec.Type {
+		case SessionBanner:
+			rs.mu.Lock()
+			rs.banner = rec.Banner
+			rs.mu.Unlock()
+		case SessionOrientation:
+			orientation = rec.Orientation
+		case SessionFrame:
+			// frames keep the time they were received at
+			f := &Frame{Data: rec.Data, Time: rs.sr.Start.Add(rec.Offset), Orientation: orientation}
+			rs.mu.Lock()
+			rs.lastFrame = f
+			rs.mu.Unlock()
+			rs.frames.publish(f)
+			if imC == nil {
+				continue
+			}
+			im, err := f.Decode()
+			if err != nil {
+				continue
+			}
+			select {
+			case imC <- im:
+			case <-rs.stop:
+				return
+			}
+		}
+	}
+}
+
+// Subscribe to the raw frames of the replay
+func (rs *ReplaySource) Subscribe(size int) *Subscription {
+	return rs.frames.subscribe(size)
+}
+
+// Return the last replayed frame, nil if none
+func (rs *ReplaySource) LastFrame() *Frame {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.lastFrame
+}
+
+// Return the last replayed banner
+func (rs *ReplaySource) Banner() Banner {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.banner
+}
+
+// Done is closed when the replay reached the end or was closed
+func (rs *ReplaySource) Done() <-chan struct{} {
+	return rs.done
+}
+
+// Err returns the error that ended the replay early, if any
+func (rs *ReplaySource) Err() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.err
+}
+
+// Close stops the replay
+func (rs *ReplaySource) Close() (err error) {
+	rs.mu.Lock()
+	select {
+	case <-rs.stop:
+		rs.mu.Unlock()
+		return ErrAlreadyClosed
+	default:
+	}
+	close(rs.stop)
+	started := rs.started
+	rs.started = true // a closed replay can not be started
+	rs.mu.Unlock()
+	if started {
+		<-rs.done
+	} else {
+		rs.frames.closeAll()
+		close(rs.done)
+	}
+	if rs.closer != nil {
+		err = rs.closer.Close()
+	}
+	return
+}
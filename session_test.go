@@ -0,0 +1,163 @@
+package minicap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestSession(t *testing.T, start time.Time, frames ...*Frame) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	sw, err := NewSessionWriter(buf, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	banner := Banner{Version: 1, PID: 42, RealWidth: 40, RealHeight: 20, VirtualWidth: 40, VirtualHeight: 20}
+	assert.Nil(t, sw.WriteBanner(banner, start))
+	for _, f := range frames {
+		assert.Nil(t, sw.WriteFrame(f))
+	}
+	assert.Nil(t, sw.Flush())
+	return buf
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	f1 := &Frame{Data: []byte{1}, Time: start.Add(10 * time.Millisecond)}
+	f2 := &Frame{Data: []byte{2}, Time: start.Add(20 * time.Millisecond), Orientation: 90}
+	buf := writeTestSession(t, start, f1, f2)
+
+	sr, err := NewSessionReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(start.UnixNano(), sr.Start.UnixNano())
+	var recs []SessionRecord
+	for {
+		rec, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if !assert.Len(recs, 5) {
+		return
+	}
+	assert.Equal(SessionBanner, recs[0].Type)
+	assert.Equal(42, recs[0].Banner.PID)
+	assert.Equal(SessionOrientation, recs[1].Type)
+	assert.Equal(0, recs[1].Orientation)
+	assert.Equal(SessionFrame, recs[2].Type)
+	assert.Equal([]byte{1}, recs[2].Data)
+	assert.Equal(10*time.Millisecond, recs[2].Offset)
+	assert.Equal(90, recs[3].Orientation)
+	assert.Equal([]byte{2}, recs[4].Data)
+
+	_, err = NewSessionReader(bytes.NewReader([]byte("RIFF\x01")))
+	assert.Equal(ErrBadSession, err)
+
+	// a corrupt length is not allocated
+	buf = writeTestSession(t, start)
+	binary.Write(buf, binary.LittleEndian, struct {
+		Type   uint8
+		Offset int64
+		Length uint32
+	}{uint8(SessionFrame), 0, 1 << 31})
+	sr, err = NewSessionReader(buf)
+	assert.Nil(err)
+	_, err = sr.Next()
+	assert.Nil(err, "the banner")
+	_, err = sr.Next()
+	assert.NotNil(err)
+}
+
+func TestReplaySource(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	data := testJPEG(t, 40, 20)
+	buf := writeTestSession(t, start,
+		&Frame{Data: data, Time: start},
+		&Frame{Data: data, Time: start.Add(time.Hour), Orientation: 270})
+
+	rs, err := NewReplaySource(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Speed = 0
+	sub := rs.Subscribe(4)
+	imC, err := rs.Capture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for im := range imC {
+		assert.Equal(40, im.Bounds().Dx())
+		n++
+	}
+	assert.Equal(2, n, "replay must not drop frames")
+	<-rs.Done()
+	assert.Nil(rs.Err())
+	assert.Equal(42, rs.Banner().PID)
+	assert.Equal(270, rs.LastFrame().Orientation)
+
+	var orientations []int
+	var offsets []time.Duration
+	for f := range sub.C() {
+		orientations = append(orientations, f.Orientation)
+		offsets = append(offsets, f.Time.Sub(start))
+	}
+	assert.Equal([]int{0, 270}, orientations)
+	assert.Equal([]time.Duration{0, time.Hour}, offsets, "frames keep their recorded time")
+	assert.Nil(rs.Close())
+}
+
+func TestRecordSessionRotation(t *testing.T) {
+	assert := assert.New(t)
+	defer func(d time.Duration) { sessionOrientationPoll = d }(sessionOrientationPoll)
+	sessionOrientationPoll = time.Millisecond
+
+	s := &Service{}
+	ctx, cancel := context.WithCancel(context.Background())
+	var out bytes.Buffer
+	errC := make(chan error, 1)
+	go func() { errC <- RecordSession(ctx, s, &out) }()
+	for len(s.Stats().Subscribers) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	buf := getFrameBuffer(1)
+	f := &Frame{Data: buf.data, Time: time.Now(), buf: buf}
+	s.frames.publish(f)
+	f.Release()
+	time.Sleep(20 * time.Millisecond)
+	// rotated, without a frame since
+	s.setDisplayInfo(DisplayInfo{Orientation: 90})
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.Nil(<-errC)
+	assert.Equal(int32(0), buf.refs, "recorded frames are released")
+
+	sr, err := NewSessionReader(&out)
+	if !assert.Nil(err) {
+		return
+	}
+	var orientations []int
+	for {
+		rec, err := sr.Next()
+		if err != nil {
+			break
+		}
+		if rec.Type == SessionOrientation {
+			orientations = append(orientations, rec.Orientation)
+		}
+	}
+	assert.Equal([]int{0, 90}, orientations)
+}
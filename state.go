@@ -0,0 +1,123 @@
+package minicap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidState = errors.New("invalid state")
+
+// State of the capture of a Service
+//
+//	idle -> installing -> starting -> streaming <-> paused
+//	                                  streaming <-> reconnecting
+//	any -> stopped
+type State int
+
+const (
+	StateIdle         State = iota // created, never started
+	StateInstalling                // pushing minicap to the device
+	StateStarting                  // starting minicap and connecting to it
+	StateStreaming                 // receiving frames
+	StatePaused                    // minicap stopped by Pause, subscribers are kept
+	StateReconnecting              // the connection was lost, minicap is restarted
+	StateStopped                   // closed, can not be started again
+)
+
+var stateNames = [...]string{"idle", "installing", "starting", "streaming", "paused", "reconnecting", "stopped"}
+
+func (st State) String() string {
+	if st < 0 || int(st) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(st))
+	}
+	return stateNames[st]
+}
+
+// StateChange is sent to the channels of States
+type StateChange struct {
+	From State
+	To   State
+	Time time.Time
+	Err  error // why the service stopped or reconnects, if by an error
+}
+
+// Return the current state
+func (s *Service) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Err returns the error that stopped the capture, nil if stopped by Close
+func (s *Service) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// States returns a channel receiving every state change, it is closed when
+// the service stops. A receiver that does not keep up loses the oldest changes.
+func (s *Service) States() <-chan StateChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(chan StateChange, 8)
+	if s.state == StateStopped {
+		close(c)
+		return c
+	}
+	s.stateSubs = append(s.stateSubs, c)
+	return c
+}
+
+// setState moves to state to, must hold s.mu
+func (s *Service) setState(to State, err error) {
+	from := s.state
+	if from == to || from == StateStopped {
+		return
+	}
+	s.state = to
+	if to == StateStopped {
+		s.err = err
+	}
+	change := StateChange{From: from, To: to, Time: time.Now(), Err: err}
+	for _, c := range s.stateSubs {
+		select {
+		case c <- change:
+			continue
+		default:
+		}
+		select {
+		case <-c:
+		default:
+		}
+		c <- change
+	}
+	if to == StateStopped {
+		for _, c := range s.stateSubs {
+			close(c)
+		}
+		s.stateSubs = nil
+	}
+	s.loggerLocked().Debug("state changed", "from", from, "to", to, "err", err)
+}
+
+// invalidState is the error of doing op while in state st
+func invalidState(op string, st State) error {
+	return fmt.Errorf("%w: can not %s while %v", ErrInvalidState, op, st)
+}
+
+// Pause stops minicap until Resume. Subscribers and Capture channels stay open.
+func (s *Service) Pause() error {
+	return s.command("pause")
+}
+
+// Resume restarts minicap after Pause
+func (s *Service) Resume() error {
+	return s.command("resume")
+}
+
+// Stop the capture, same as Close
+func (s *Service) Stop() error {
+	return s.Close()
+}
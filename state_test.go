@@ -0,0 +1,92 @@
+package minicap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateString(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("idle", StateIdle.String())
+	assert.Equal("reconnecting", StateReconnecting.String())
+	assert.Equal("stopped", StateStopped.String())
+	assert.Equal("State(42)", State(42).String())
+}
+
+func TestCloseIdle(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	assert.True(s.IsClosed())
+	sub := s.Subscribe(1)
+	assert.Nil(s.Close())
+	assert.Equal(StateStopped, s.State())
+	assert.Nil(s.Err())
+	assert.True(s.IsClosed())
+	_, ok := <-sub.C()
+	assert.False(ok)
+
+	assert.Equal(ErrAlreadyClosed, s.Close())
+	assert.Equal(ErrAlreadyClosed, s.Start())
+	_, ok = <-s.States()
+	assert.False(ok)
+}
+
+func TestStateTransitions(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	changes := s.States()
+
+	err := s.Pause()
+	assert.True(errors.Is(err, ErrInvalidState))
+	assert.Equal("invalid state: can not pause while idle", err.Error())
+	assert.True(errors.Is(s.Resume(), ErrInvalidState))
+
+	s.mu.Lock()
+	s.setState(StateInstalling, nil)
+	s.mu.Unlock()
+	change := <-changes
+	assert.Equal(StateIdle, change.From)
+	assert.Equal(StateInstalling, change.To)
+	assert.False(s.IsClosed())
+
+	s.mu.Lock()
+	s.setState(StateInstalling, nil) // no change, nothing sent
+	s.mu.Unlock()
+	select {
+	case change = <-changes:
+		t.Fatalf("unexpected change %v", change)
+	default:
+	}
+
+	stopErr := errors.New("minicap not supported")
+	s.mu.Lock()
+	s.setState(StateStopped, stopErr)
+	s.setState(StateStreaming, nil) // stopped is final
+	s.mu.Unlock()
+	change = <-changes
+	assert.Equal(StateStopped, change.To)
+	assert.Equal(stopErr, change.Err)
+	assert.Equal(stopErr, s.Err())
+	_, ok := <-changes
+	assert.False(ok)
+}
+
+func TestStatesDropOldest(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	changes := s.States()
+	s.mu.Lock()
+	for i := 0; i < 10; i++ {
+		s.setState(StateStreaming, nil)
+		s.setState(StateReconnecting, nil)
+	}
+	s.mu.Unlock()
+	assert.Equal(cap(changes), len(changes))
+	var last StateChange
+	for len(changes) > 0 {
+		last = <-changes
+	}
+	assert.Equal(StateReconnecting, last.To)
+}
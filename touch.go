@@ -0,0 +1,454 @@
+package minicap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTouchNotStarted = errors.New("minitouch not started")
+	ErrBadTouchBanner  = errors.New("bad minitouch banner")
+)
+
+// TouchBanner is sent by minitouch when a client connects
+type TouchBanner struct {
+	Version     int `json:"version"`
+	MaxContacts int `json:"maxContacts"`
+	MaxX        int `json:"maxX"`
+	MaxY        int `json:"maxY"`
+	MaxPressure int `json:"maxPressure"`
+	PID         int `json:"pid"`
+}
+
+func readTouchBanner(rd *bufio.Reader) (b TouchBanner, err error) {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return b, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		values := make([]int, len(fields)-1)
+		for i, field := range fields[1:] {
+			if values[i], err = strconv.Atoi(field); err != nil {
+				return b, ErrBadTouchBanner
+			}
+		}
+		switch {
+		case fields[0] == "v" && len(values) == 1:
+			b.Version = values[0]
+		case fields[0] == "^" && len(values) == 4:
+			b.MaxContacts, b.MaxX, b.MaxY, b.MaxPressure = values[0], values[1], values[2], values[3]
+		case fields[0] == "$" && len(values) == 1:
+			b.PID = values[0]
+			// the pid is the last line of the banner
+			if b.MaxX == 0 || b.MaxY == 0 {
+				return b, ErrBadTouchBanner
+			}
+			return b, nil
+		default:
+			return b, ErrBadTouchBanner
+		}
+	}
+}
+
+// Touch sends touch events with minitouch, https://github.com/openstf/minitouch
+//
+// Points are in screen coordinates: the pixels of the upright frames minicap
+// sends, for the current orientation of the device.
+type Touch struct {
+	AdbHost string
+
+	lforwardPort int
+	d            AdbDevice
+	r            *Rotation
+	orientation  func() int // nil: watch the rotation on our own
+	maxReDialCnt int
+
+	mu      sync.Mutex
+	proc    *exec.Cmd
+	conn    io.ReadWriteCloser
+	bw      *bufio.Writer
+	banner  TouchBanner
+	natural image.Point // display size in the natural orientation
+	current int         // orientation from our own rotation watcher
+	closed  bool
+}
+
+// NewTouch creates a Touch service for the device of opt
+func NewTouch(opt Options) (t *Touch, err error) {
+	client, err := newAdbClient()
+	if err != nil {
+		return
+	}
+	d, err := attachAdbDevice(client, opt.Serial, opt.Adb, opt.Logger)
+	if err != nil {
+		return
+	}
+	return newTouch(d, nil)
+}
+
+// Touch creates a Touch service for the same device, which takes points in
+// screen coordinates: the captured frames in their orientation, before
+// Options.Crop. Points on cropped frames must be offset by the crop origin.
+func (s *Service) Touch() (t *Touch, err error) {
+	return newTouch(s.d, s.frameOrientation)
+}
+
+func newTouch(d AdbDevice, orientation func() int) (t *Touch, err error) {
+	t = &Touch{
+		AdbHost:      "localhost",
+		d:            d,
+		orientation:  orientation,
+		maxReDialCnt: 10,
+		closed:       true,
+	}
+	t.r, err = newRotationService(d)
+	return
+}
+
+// Install minitouch to /data/local/tmp
+// files downloaded from github.com/openstf/stf
+func (t *Touch) Install() (err error) {
+	if t.d.isFileExists("/data/local/tmp/minitouch") {
+		return
+	}
+	abi, err := t.d.getProp("ro.product.cpu.abi")
+	if err != nil {
+		return
+	}
+	sdk, err := t.d.getProp("ro.build.version.sdk")
+	if err != nil {
+		return
+	}
+	filename := "minitouch"
+	// PIE binaries are only supported since android 4.1
+	if v, _ := strconv.Atoi(sdk); v < 16 {
+		filename = "minitouch-nopie"
+	}
+	url := "https://github.com/openstf/stf/raw/master/vendor/minitouch/" + abi + "/" + filename
+	return t.r.download("/data/local/tmp/minitouch", url)
+}
+
+// Remove minitouch from device
+func (t *Touch) Uninstall() (err error) {
+	_, err = t.d.shell("rm", "-f", "/data/local/tmp/minitouch")
+	return
+}
+
+// Start minitouch and connect to it
+func (t *Touch) Start() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		return errors.New("minitouch already started")
+	}
+	if err = t.Install(); err != nil {
+		return
+	}
+	info, err := t.d.getDisplayInfo()
+	if err != nil {
+		return
+	}
+	t.natural = FrameSize(image.Pt(info.Width, info.Height), info.Orientation)
+	t.current = info.Orientation
+
+	t.d.killProc("minitouch")
+	t.proc = t.d.buildCommand("/data/local/tmp/minitouch")
+	if err = t.proc.Start(); err != nil {
+		return
+	}
+	forwarded := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		// do not leave minitouch and its forward behind a failed start
+		t.proc.Process.Kill()
+		t.d.killProc("minitouch")
+		if forwarded {
+			t.d.run("forward", "--remove", fmt.Sprintf("tcp:%d", t.lforwardPort))
+		}
+	}()
+	if t.lforwardPort == 0 {
+		if t.lforwardPort, err = freePort(); err != nil {
+			return
+		}
+	}
+	if _, err = t.d.run("forward", fmt.Sprintf("tcp:%d", t.lforwardPort), "localabstract:minitouch"); err != nil {
+		return
+	}
+	forwarded = true
+
+	// minitouch needs a moment to create its socket
+	addr := net.JoinHostPort(t.AdbHost, strconv.Itoa(t.lforwardPort))
+	var conn net.Conn
+	for i := 0; ; i++ {
+		conn, err = net.Dial("tcp", addr)
+		if err == nil {
+			var banner TouchBanner
+			br := bufio.NewReader(conn)
+			if banner, err = readTouchBanner(br); err == nil {
+				t.banner = banner
+				break
+			}
+			conn.Close()
+		}
+		if i >= t.maxReDialCnt {
+			t.d.logger().Error("connect to minitouch", "socket", "minitouch", "port", t.lforwardPort, "err", err)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.conn = conn
+	t.bw = bufio.NewWriter(conn)
+	t.d.logger().Info("minitouch connected", "socket", "minitouch", "pid", t.banner.PID,
+		"contacts", t.banner.MaxContacts, "maxX", t.banner.MaxX, "maxY", t.banner.MaxY)
+
+	if t.orientation == nil {
+		if err = t.watchRotation(); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	t.closed = false
+	return
+}
+
+func (t *Touch) watchRotation() (err error) {
+	// the watcher of a previous Start was stopped by Close
+	if t.r, err = newRotationService(t.d); err != nil {
+		return
+	}
+	if err = t.r.install(); err != nil {
+		return
+	}
+	if err = t.r.start(); err != nil {
+		return
+	}
+	orienC, err := t.r.watch()
+	if err != nil {
+		return
+	}
+	go func() {
+		for orientation := range orienC {
+			t.mu.Lock()
+			t.current = orientation
+			t.mu.Unlock()
+		}
+	}()
+	return
+}
+
+// Return the banner of minitouch
+func (t *Touch) Banner() TouchBanner {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.banner
+}
+
+// Return the current orientation of the screen in degrees
+func (t *Touch) Orientation() int {
+	if t.orientation != nil {
+		return t.orientation()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// toTouch maps a point in screen coordinates to the touch panel, must hold t.mu
+func (t *Touch) toTouch(p image.Point, orientation int) image.Point {
+	return FrameToTouch(p, t.natural, orientation, image.Pt(t.banner.MaxX, t.banner.MaxY))
+}
+
+func (t *Touch) pressure(pressure int) int {
+	if pressure <= 0 {
+		pressure = 50
+	}
+	if t.banner.MaxPressure > 0 && pressure > t.banner.MaxPressure {
+		pressure = t.banner.MaxPressure
+	}
+	return pressure
+}
+
+// send writes minitouch commands, flush sends them to the device
+func (t *Touch) send(flush bool, format string, args ...interface{}) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTouchNotStarted
+	}
+	if _, err = fmt.Fprintf(t.bw, format, args...); err != nil {
+		return
+	}
+	if flush {
+		err = t.bw.Flush()
+	}
+	return
+}
+
+// contact writes a d or m command for a point in screen coordinates
+func (t *Touch) contact(op byte, contact int, p image.Point, pressure int) (err error) {
+	orientation := t.Orientation()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTouchNotStarted
+	}
+	p = t.toTouch(p, orientation)
+	_, err = fmt.Fprintf(t.bw, "%c %d %d %d %d\n", op, contact, p.X, p.Y, t.pressure(pressure))
+	return
+}
+
+// Down puts contact down at p, pressure 0 uses a default pressure.
+// Like all contact operations it takes effect with Commit.
+func (t *Touch) Down(contact int, p image.Point, pressure int) error {
+	return t.contact('d', contact, p, pressure)
+}
+
+// Move contact to p
+func (t *Touch) Move(contact int, p image.Point, pressure int) error {
+	return t.contact('m', contact, p, pressure)
+}
+
+// Up lifts contact
+func (t *Touch) Up(contact int) error {
+	return t.send(false, "u %d\n", contact)
+}
+
+// Commit sends the pending contact operations as one event
+func (t *Touch) Commit() error {
+	return t.send(true, "c\n")
+}
+
+// Wait makes minitouch pause before running the following operations
+func (t *Touch) Wait(d time.Duration) error {
+	return t.send(false, "w %d\n", d.Milliseconds())
+}
+
+// Reset lifts all contacts
+func (t *Touch) Reset() error {
+	return t.send(true, "r\n")
+}
+
+// Tap at p
+func (t *Touch) Tap(p image.Point) (err error) {
+	if err = t.Down(0, p, 0); err != nil {
+		return
+	}
+	if err = t.Commit(); err != nil {
+		return
+	}
+	if err = t.Wait(50 * time.Millisecond); err != nil {
+		return
+	}
+	if err = t.Up(0); err != nil {
+		return
+	}
+	return t.Commit()
+}
+
+// touchStep is the time between moves of gestures
+const touchStep = 16 * time.Millisecond
+
+// Swipe from one point to another within d
+func (t *Touch) Swipe(from, to image.Point, d time.Duration) error {
+	return t.gesture(d, func(i, steps int) error {
+		return t.Move(0, interpolate(from, to, i, steps), 0)
+	}, func() error {
+		return t.Down(0, from, 0)
+	}, func() error {
+		return t.Up(0)
+	})
+}
+
+// Pinch with two fingers on a horizontal line through center, their
+// distance changing from one value to another within d. A growing distance
+// zooms in.
+func (t *Touch) Pinch(center image.Point, from, to int, d time.Duration) error {
+	finger := func(distance, sign int) image.Point {
+		return center.Add(image.Pt(sign*distance/2, 0))
+	}
+	return t.gesture(d, func(i, steps int) (err error) {
+		distance := from + (to-from)*i/steps
+		if err = t.Move(0, finger(distance, -1), 0); err != nil {
+			return
+		}
+		return t.Move(1, finger(distance, 1), 0)
+	}, func() (err error) {
+		if err = t.Down(0, finger(from, -1), 0); err != nil {
+			return
+		}
+		return t.Down(1, finger(from, 1), 0)
+	}, func() (err error) {
+		if err = t.Up(0); err != nil {
+			return
+		}
+		return t.Up(1)
+	})
+}
+
+// gesture runs down, moves every touchStep until d is over and up
+func (t *Touch) gesture(d time.Duration, move func(i, steps int) error, down, up func() error) (err error) {
+	steps := int(d / touchStep)
+	if steps < 1 {
+		steps = 1
+	}
+	if err = down(); err != nil {
+		return
+	}
+	if err = t.Commit(); err != nil {
+		return
+	}
+	for i := 1; i <= steps; i++ {
+		if err = t.Wait(touchStep); err != nil {
+			return
+		}
+		if err = move(i, steps); err != nil {
+			return
+		}
+		if err = t.Commit(); err != nil {
+			return
+		}
+	}
+	if err = up(); err != nil {
+		return
+	}
+	return t.Commit()
+}
+
+func interpolate(from, to image.Point, i, steps int) image.Point {
+	return from.Add(to.Sub(from).Mul(i).Div(steps))
+}
+
+// Close the connection and stop minitouch
+func (t *Touch) Close() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrAlreadyClosed
+	}
+	t.closed = true
+	err = t.conn.Close()
+	if t.orientation == nil {
+		t.r.stop()
+	}
+	if t.proc != nil && t.proc.Process != nil {
+		t.proc.Process.Kill()
+	}
+	t.d.killProc("minitouch")
+	t.d.run("forward", "--remove", fmt.Sprintf("tcp:%d", t.lforwardPort))
+	return
+}
@@ -0,0 +1,99 @@
+package minicap
+
+import (
+	"bufio"
+	"image"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadTouchBanner(t *testing.T) {
+	banner, err := readTouchBanner(bufio.NewReader(strings.NewReader("v 1\n^ 10 1079 1919 2048\n$ 4242\n")))
+	assert.Nil(t, err)
+	assert.Equal(t, TouchBanner{Version: 1, MaxContacts: 10, MaxX: 1079, MaxY: 1919, MaxPressure: 2048, PID: 4242}, banner)
+
+	_, err = readTouchBanner(bufio.NewReader(strings.NewReader("v 1\n$ 4242\n")))
+	assert.Equal(t, ErrBadTouchBanner, err)
+	_, err = readTouchBanner(bufio.NewReader(strings.NewReader("v 1\n^ 10 1079\n")))
+	assert.Equal(t, ErrBadTouchBanner, err)
+}
+
+// testTouch returns a started Touch writing to the returned reader
+func testTouch(orientation int) (*Touch, *bufio.Reader) {
+	client, server := net.Pipe()
+	t := &Touch{
+		conn:        client,
+		bw:          bufio.NewWriter(client),
+		banner:      TouchBanner{MaxContacts: 10, MaxX: 1080, MaxY: 1920, MaxPressure: 255},
+		natural:     image.Pt(540, 960),
+		orientation: func() int { return orientation },
+	}
+	return t, bufio.NewReader(server)
+}
+
+func readTouchCommands(rd *bufio.Reader, n int) (cmds []string) {
+	for i := 0; i < n; i++ {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			break
+		}
+		cmds = append(cmds, strings.TrimSpace(line))
+	}
+	return
+}
+
+func TestTouchTap(t *testing.T) {
+	touch, rd := testTouch(0)
+	go touch.Tap(image.Pt(100, 200))
+	assert.Equal(t, []string{"d 0 200 400 50", "c", "w 50", "u 0", "c"}, readTouchCommands(rd, 5))
+}
+
+func TestTouchOrientation(t *testing.T) {
+	for _, tc := range []struct {
+		orientation int
+		want        string
+	}{
+		{0, "d 0 20 40 255"},
+		{90, "d 0 1040 20 255"},
+		{180, "d 0 1060 1880 255"},
+		{270, "d 0 40 1900 255"},
+	} {
+		touch, rd := testTouch(tc.orientation)
+		go func() {
+			touch.Down(0, image.Pt(10, 20), 1000)
+			touch.Commit()
+		}()
+		assert.Equal(t, []string{tc.want, "c"}, readTouchCommands(rd, 2), "orientation %d", tc.orientation)
+	}
+}
+
+func TestTouchSwipe(t *testing.T) {
+	touch, rd := testTouch(0)
+	go touch.Swipe(image.Pt(0, 0), image.Pt(100, 0), 2*touchStep)
+	assert.Equal(t, []string{
+		"d 0 0 0 50", "c",
+		"w 16", "m 0 100 0 50", "c",
+		"w 16", "m 0 200 0 50", "c",
+		"u 0", "c",
+	}, readTouchCommands(rd, 10))
+}
+
+func TestTouchPinch(t *testing.T) {
+	touch, rd := testTouch(0)
+	go touch.Pinch(image.Pt(200, 400), 100, 300, time.Millisecond)
+	assert.Equal(t, []string{
+		"d 0 300 800 50", "d 1 500 800 50", "c",
+		"w 16", "m 0 100 800 50", "m 1 700 800 50", "c",
+		"u 0", "u 1", "c",
+	}, readTouchCommands(rd, 10))
+}
+
+func TestTouchNotStarted(t *testing.T) {
+	touch := &Touch{closed: true}
+	assert.Equal(t, ErrTouchNotStarted, touch.Tap(image.Pt(1, 1)))
+	assert.Equal(t, ErrAlreadyClosed, touch.Close())
+}
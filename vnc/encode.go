@@ -0,0 +1,190 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+)
+
+const (
+	encodingRaw         int32 = 0
+	encodingCopyRect    int32 = 1
+	encodingTight       int32 = 7
+	encodingDesktopSize int32 = -223
+	encodingQualityMin  int32 = -32 // JPEG quality level 0
+	encodingQualityMax  int32 = -23 // JPEG quality level 9
+
+	tightJPEG = 0x90
+
+	tileSize = 64
+)
+
+// PixelFormat describes how the client wants pixels to be encoded
+type PixelFormat struct {
+	BPP        uint8
+	Depth      uint8
+	BigEndian  uint8
+	TrueColour uint8
+	RedMax     uint16
+	GreenMax   uint16
+	BlueMax    uint16
+	RedShift   uint8
+	GreenShift uint8
+	BlueShift  uint8
+	_          [3]byte
+}
+
+// defaultPixelFormat is 32 bit little endian BGRX
+var defaultPixelFormat = PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	TrueColour: 1,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   16,
+	GreenShift: 8,
+	BlueShift:  0,
+}
+
+// encodeRaw appends the pixels of r in format pf
+func encodeRaw(buf []byte, im *image.RGBA, r image.Rectangle, pf PixelFormat) []byte {
+	bytesPerPixel := int(pf.BPP) / 8
+	var order binary.ByteOrder = binary.LittleEndian
+	if pf.BigEndian != 0 {
+		order = binary.BigEndian
+	}
+	px := make([]byte, 4)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		off := im.PixOffset(r.Min.X, y)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			red := uint32(im.Pix[off]) * uint32(pf.RedMax) / 255
+			green := uint32(im.Pix[off+1]) * uint32(pf.GreenMax) / 255
+			blue := uint32(im.Pix[off+2]) * uint32(pf.BlueMax) / 255
+			v := red<<pf.RedShift | green<<pf.GreenShift | blue<<pf.BlueShift
+			switch bytesPerPixel {
+			case 1:
+				px[0] = uint8(v)
+			case 2:
+				order.PutUint16(px, uint16(v))
+			default:
+				order.PutUint32(px, v)
+			}
+			buf = append(buf, px[:bytesPerPixel]...)
+			off += 4
+		}
+	}
+	return buf
+}
+
+// tightJPEGQuality maps the tight quality levels 0-9 to JPEG quality
+var tightJPEGQuality = [10]int{15, 29, 41, 42, 62, 77, 79, 86, 92, 100}
+
+// encodeTightJPEG appends r as a tight rectangle with JPEG compression
+func encodeTightJPEG(buf []byte, im *image.RGBA, r image.Rectangle, level int) ([]byte, error) {
+	data := new(bytes.Buffer)
+	if err := jpeg.Encode(data, im.SubImage(r), &jpeg.Options{Quality: tightJPEGQuality[level]}); err != nil {
+		return nil, err
+	}
+	buf = append(buf, tightJPEG)
+	buf = appendCompactLength(buf, data.Len())
+	return append(buf, data.Bytes()...), nil
+}
+
+func appendCompactLength(buf []byte, n int) []byte {
+	switch {
+	case n < 1<<7:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, byte(n)|0x80, byte(n>>7))
+	}
+	return append(buf, byte(n)|0x80, byte(n>>7)|0x80, byte(n>>14))
+}
+
+// dirtyRects compares the tiles of two frames of the same size and returns
+// the changed areas, adjacent tiles of a row merged into one rectangle.
+func dirtyRects(prev, cur *image.RGBA, clean []bool) (rects []image.Rectangle) {
+	b := cur.Rect
+	for ty := b.Min.Y; ty < b.Max.Y; ty += tileSize {
+		var run image.Rectangle
+		for tx := b.Min.X; tx < b.Max.X; tx += tileSize {
+			tile := image.Rect(tx, ty, tx+tileSize, ty+tileSize).Intersect(b)
+			if !tileChanged(prev, cur, tile, clean) {
+				if !run.Empty() {
+					rects = append(rects, run)
+					run = image.Rectangle{}
+				}
+				continue
+			}
+			run = run.Union(tile)
+		}
+		if !run.Empty() {
+			rects = append(rects, run)
+		}
+	}
+	return
+}
+
+// tileChanged compares the rows of tile, rows marked clean are skipped
+func tileChanged(prev, cur *image.RGBA, tile image.Rectangle, clean []bool) bool {
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		if clean != nil && clean[y-cur.Rect.Min.Y] {
+			continue
+		}
+		a := prev.Pix[prev.PixOffset(tile.Min.X, y):prev.PixOffset(tile.Max.X, y)]
+		c := cur.Pix[cur.PixOffset(tile.Min.X, y):cur.PixOffset(tile.Max.X, y)]
+		if !bytes.Equal(a, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectScroll looks for a vertical shift of prev inside cur, as produced by
+// scrolling a list. It returns the band of cur that equals prev moved by dy,
+// so it can be sent with CopyRect.
+func detectScroll(prev, cur *image.RGBA) (band image.Rectangle, dy int, ok bool) {
+	h := cur.Rect.Dy()
+	rowHash := func(im *image.RGBA) []uint64 {
+		hashes := make([]uint64, h)
+		for y := 0; y < h; y++ {
+			row := im.Pix[y*im.Stride : y*im.Stride+im.Rect.Dx()*4]
+			var hash uint64 = 14695981039346656037
+			for _, c := range row {
+				hash ^= uint64(c)
+				hash *= 1099511628211
+			}
+			hashes[y] = hash
+		}
+		return hashes
+	}
+	before, after := rowHash(prev), rowHash(cur)
+
+	const minRows = 32
+	bestLen := 0
+	for shift := -h / 2; shift <= h/2; shift++ {
+		if shift == 0 {
+			continue
+		}
+		run := 0
+		for y := 0; y < h; y++ {
+			sy := y + shift
+			// rows that stayed in place are handled by the normal diff
+			if sy >= 0 && sy < h && after[y] == before[sy] && after[y] != before[y] {
+				run++
+				if run > bestLen {
+					bestLen = run
+					band = image.Rect(0, y-run+1, cur.Rect.Dx(), y+1)
+					dy = shift
+				}
+			} else {
+				run = 0
+			}
+		}
+	}
+	if bestLen < minRows {
+		return image.Rectangle{}, 0, false
+	}
+	return band.Add(cur.Rect.Min), dy, true
+}
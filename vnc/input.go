@@ -0,0 +1,96 @@
+package vnc
+
+import (
+	"image"
+	"sync"
+
+	minicap "github.com/openatx/go-minicap"
+)
+
+// android key codes for X11 keysyms without a character
+var keysyms = map[uint32]int{
+	0xff08: minicap.KeycodeDel,   // BackSpace
+	0xff09: 61,                   // Tab
+	0xff0d: minicap.KeycodeEnter, // Return
+	0xff1b: minicap.KeycodeBack,  // Escape
+	0xff50: minicap.KeycodeHome,  // Home
+	0xff51: 21,                   // Left
+	0xff52: 19,                   // Up
+	0xff53: 22,                   // Right
+	0xff54: 20,                   // Down
+	0xff55: 92,                   // Page_Up
+	0xff56: 93,                   // Page_Down
+	0xff67: minicap.KeycodeMenu,  // Menu
+	0xffff: 112,                  // Delete
+}
+
+// NewInput passes the input of viewers to a minicap input backend, like
+// *minicap.Touch. The left button touches the screen, keys with an android
+// counterpart are pressed, printable keys are typed as text.
+func NewInput(backend minicap.InputBackend) InputHandler {
+	return &backendInput{backend: backend}
+}
+
+type backendInput struct {
+	backend minicap.InputBackend
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (in *backendInput) Pointer(e PointerEvent) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	p := image.Pt(e.X, e.Y)
+	if e.Width > 0 && e.Height > 0 {
+		// a viewer that kept its framebuffer across a rotation points
+		// beside the frame, touch its nearest edge instead
+		p.X = clamp(p.X, 0, e.Width-1)
+		p.Y = clamp(p.Y, 0, e.Height-1)
+	}
+	left := e.Buttons&1 != 0
+	switch {
+	case left && !in.down:
+		in.backend.TouchDown(0, p)
+	case left:
+		in.backend.TouchMove(0, p)
+	case in.down:
+		in.backend.TouchUp(0)
+	}
+	in.down = left
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func (in *backendInput) Key(e KeyEvent) {
+	if !e.Down {
+		return
+	}
+	if keycode, ok := keysyms[e.Key]; ok {
+		in.backend.Key(keycode)
+		return
+	}
+	if r, ok := keysymRune(e.Key); ok {
+		in.backend.Text(string(r))
+	}
+}
+
+// keysymRune returns the character typed by a keysym
+func keysymRune(keysym uint32) (rune, bool) {
+	switch {
+	case keysym >= 0x20 && keysym <= 0x7e, keysym >= 0xa0 && keysym <= 0xff:
+		// Latin-1 keysyms equal their code points
+		return rune(keysym), true
+	case keysym >= 0x01000100 && keysym <= 0x0110ffff:
+		return rune(keysym - 0x01000000), true
+	}
+	return 0, false
+}
@@ -0,0 +1,70 @@
+package vnc
+
+import (
+	"fmt"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testBackend struct {
+	events []string
+}
+
+func (b *testBackend) TouchDown(contact int, p image.Point) error {
+	b.events = append(b.events, fmt.Sprintf("down %v", p))
+	return nil
+}
+
+func (b *testBackend) TouchMove(contact int, p image.Point) error {
+	b.events = append(b.events, fmt.Sprintf("move %v", p))
+	return nil
+}
+
+func (b *testBackend) TouchUp(contact int) error {
+	b.events = append(b.events, "up")
+	return nil
+}
+
+func (b *testBackend) Key(keycode int) error {
+	b.events = append(b.events, fmt.Sprintf("key %d", keycode))
+	return nil
+}
+
+func (b *testBackend) Text(text string) error {
+	b.events = append(b.events, "text "+text)
+	return nil
+}
+
+func TestNewInput(t *testing.T) {
+	b := &testBackend{}
+	in := NewInput(b)
+	in.Pointer(PointerEvent{X: 1, Y: 1})
+	in.Pointer(PointerEvent{Buttons: 1, X: 1, Y: 2})
+	in.Pointer(PointerEvent{Buttons: 1, X: 3, Y: 4})
+	in.Pointer(PointerEvent{X: 3, Y: 4})
+	in.Key(KeyEvent{Down: true, Key: 0xff0d})
+	in.Key(KeyEvent{Down: false, Key: 0xff0d})
+	in.Key(KeyEvent{Down: true, Key: 'a'})
+	in.Key(KeyEvent{Down: true, Key: 0x010020ac})
+	in.Key(KeyEvent{Down: true, Key: 0xffe1}) // Shift_L
+	assert.Equal(t, []string{
+		"down (1,2)",
+		"move (3,4)",
+		"up",
+		"key 66",
+		"text a",
+		"text €",
+	}, b.events)
+}
+
+func TestInputOutsideFrame(t *testing.T) {
+	// rotated to portrait under a landscape framebuffer of 40x20
+	b := &testBackend{}
+	in := NewInput(b)
+	in.Pointer(PointerEvent{Buttons: 1, X: 35, Y: 10, Width: 20, Height: 40})
+	in.Pointer(PointerEvent{Buttons: 1, X: 5, Y: 10, Width: 20, Height: 40})
+	in.Pointer(PointerEvent{X: 5, Y: 10, Width: 20, Height: 40})
+	assert.Equal(t, []string{"down (19,10)", "move (5,10)", "up"}, b.events)
+}
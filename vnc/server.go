@@ -0,0 +1,563 @@
+// Package vnc serves the screen of a minicap capture to VNC viewers.
+//
+// It implements the server side of RFB 3.3 to 3.8 without authentication.
+// Updates are incremental: only the tiles that changed since the last update
+// are sent, vertical scrolling is sent as CopyRect and the Tight JPEG
+// encoding is used when the viewer asks for a JPEG quality level.
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	minicap "github.com/openatx/go-minicap"
+)
+
+var (
+	ErrUnsupportedVersion     = errors.New("vnc: unsupported protocol version")
+	ErrUnsupportedPixelFormat = errors.New("vnc: colour map pixel formats are not supported")
+	ErrServerClosed           = errors.New("vnc: server closed")
+)
+
+// Source provides the frames that are served, *minicap.Service and
+// *minicap.ReplaySource both implement it.
+type Source interface {
+	minicap.FrameSource
+	LastFrame() *minicap.Frame
+}
+
+// PointerEvent is a mouse event of a viewer. X and Y are in frame
+// coordinates, Width, Height and Orientation describe the frame so the
+// position can be mapped back to the device with minicap.FrameToNatural.
+// Viewers without the DesktopSize encoding keep their framebuffer size when
+// the screen rotates, the frame is drawn at its top left corner: X and Y can
+// lie outside of the frame.
+type PointerEvent struct {
+	Buttons     uint8 // bit 0 is the left button
+	X, Y        int
+	Width       int
+	Height      int
+	Orientation int
+}
+
+// KeyEvent is a key press or release of a viewer, Key is an X11 keysym
+type KeyEvent struct {
+	Down bool
+	Key  uint32
+}
+
+// InputHandler receives the input events of all viewers
+type InputHandler interface {
+	Pointer(e PointerEvent)
+	Key(e KeyEvent)
+}
+
+// Server is a VNC server for a single screen
+type Server struct {
+	Name  string       // desktop name shown by viewers
+	Input InputHandler // nil makes the server view only
+
+	src Source
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+func NewServer(src Source) *Server {
+	return &Server{
+		Name:      "minicap",
+		src:       src,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves viewers
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts viewers on l until the listener or the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single viewer and closes conn when done
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &clientConn{
+		srv:     s,
+		conn:    conn,
+		br:      bufio.NewReader(conn),
+		pf:      defaultPixelFormat,
+		quality: -1,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	return c.serve()
+}
+
+// Close stops all listeners and disconnects all viewers
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+type clientConn struct {
+	srv  *Server
+	conn net.Conn
+	br   *bufio.Reader
+
+	// guarded by mu, shared by the reader and the writer
+	mu          sync.Mutex
+	pf          PixelFormat
+	copyRect    bool
+	tight       bool
+	desktopSize bool
+	quality     int // tight JPEG quality level, -1 if the viewer did not ask for JPEG
+	pending     bool
+	full        bool
+	frameSize   image.Point // of the latest frame, size may differ without DesktopSize
+	orientation int
+
+	notify chan struct{}
+	done   chan struct{}
+
+	// owned by the writer
+	fb   *image.RGBA // the framebuffer as the viewer has it
+	size image.Point
+}
+
+func (c *clientConn) serve() (err error) {
+	sub := c.srv.src.Subscribe(1)
+	defer sub.Close()
+
+	first, err := c.firstFrame(sub)
+	if err != nil {
+		return
+	}
+	c.size = first.Bounds().Size()
+	c.frameSize = c.size
+	if err = c.handshake(); err != nil {
+		return
+	}
+
+	werr := make(chan error, 1)
+	go func() {
+		werr <- c.writeLoop(sub, first)
+		// unblock the reader
+		c.conn.Close()
+	}()
+	err = c.readLoop()
+	close(c.done)
+	if e := <-werr; e != nil {
+		err = e
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// firstFrame waits for a frame to learn the size of the framebuffer
+func (c *clientConn) firstFrame(sub *minicap.Subscription) (im *image.RGBA, err error) {
+	if f := c.srv.src.LastFrame(); f != nil {
+		if im, err = decodeFrame(f); err == nil {
+			c.orientation = f.Orientation
+			return
+		}
+	}
+	for f := range sub.C() {
+		if im, err = decodeFrame(f); err == nil {
+			c.orientation = f.Orientation
+			return
+		}
+	}
+	return nil, errors.New("vnc: source closed before the first frame")
+}
+
+// decodeFrame decodes f into an RGBA image and releases f
+func decodeFrame(f *minicap.Frame) (*image.RGBA, error) {
+	im, err := f.Decode()
+	f.Release()
+	if err != nil {
+		return nil, err
+	}
+	if rgba, ok := im.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba, nil
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, im.Bounds().Dx(), im.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Rect, im, im.Bounds().Min, draw.Src)
+	return rgba, nil
+}
+
+func (c *clientConn) handshake() error {
+	if _, err := io.WriteString(c.conn, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c.br, version); err != nil {
+		return err
+	}
+	if string(version[:4]) != "RFB " || version[7] != '.' || version[11] != '\n' {
+		return ErrUnsupportedVersion
+	}
+	major, err1 := strconv.Atoi(string(version[4:7]))
+	minor, err2 := strconv.Atoi(string(version[8:11]))
+	if err1 != nil || err2 != nil || major != 3 || minor < 3 {
+		return ErrUnsupportedVersion
+	}
+
+	// security type None
+	if minor < 7 {
+		if err := binary.Write(c.conn, binary.BigEndian, uint32(1)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := c.conn.Write([]byte{1, 1}); err != nil {
+			return err
+		}
+		choice, err := c.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if choice != 1 {
+			return fmt.Errorf("vnc: unsupported security type %d", choice)
+		}
+		if minor >= 8 {
+			if err := binary.Write(c.conn, binary.BigEndian, uint32(0)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// ClientInit, the shared flag is ignored: viewers always share the screen
+	if _, err := c.br.ReadByte(); err != nil {
+		return err
+	}
+	init := struct {
+		Width, Height uint16
+		Format        PixelFormat
+		NameLength    uint32
+	}{uint16(c.size.X), uint16(c.size.Y), defaultPixelFormat, uint32(len(c.srv.Name))}
+	if err := binary.Write(c.conn, binary.BigEndian, init); err != nil {
+		return err
+	}
+	_, err := io.WriteString(c.conn, c.srv.Name)
+	return err
+}
+
+func (c *clientConn) readLoop() error {
+	for {
+		typ, err := c.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0: // SetPixelFormat
+			var msg struct {
+				_      [3]byte
+				Format PixelFormat
+			}
+			if err = binary.Read(c.br, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			pf := msg.Format
+			if pf.TrueColour == 0 {
+				return ErrUnsupportedPixelFormat
+			}
+			if pf.BPP != 8 && pf.BPP != 16 && pf.BPP != 32 {
+				return fmt.Errorf("vnc: unsupported bits per pixel %d", pf.BPP)
+			}
+			c.mu.Lock()
+			c.pf = pf
+			c.mu.Unlock()
+		case 2: // SetEncodings
+			var msg struct {
+				_     byte
+				Count uint16
+			}
+			if err = binary.Read(c.br, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			encodings := make([]int32, msg.Count)
+			if err = binary.Read(c.br, binary.BigEndian, encodings); err != nil {
+				return err
+			}
+			c.setEncodings(encodings)
+		case 3: // FramebufferUpdateRequest
+			var msg struct {
+				Incremental         uint8
+				X, Y, Width, Height uint16
+			}
+			if err = binary.Read(c.br, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			c.mu.Lock()
+			c.pending = true
+			c.full = c.full || msg.Incremental == 0
+			c.mu.Unlock()
+			select {
+			case c.notify <- struct{}{}:
+			default:
+			}
+		case 4: // KeyEvent
+			var msg struct {
+				Down uint8
+				_    [2]byte
+				Key  uint32
+			}
+			if err = binary.Read(c.br, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			if c.srv.Input != nil {
+				c.srv.Input.Key(KeyEvent{Down: msg.Down != 0, Key: msg.Key})
+			}
+		case 5: // PointerEvent
+			var msg struct {
+				Buttons uint8
+				X, Y    uint16
+			}
+			if err = binary.Read(c.br, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			if c.srv.Input != nil {
+				c.mu.Lock()
+				e := PointerEvent{
+					Buttons:     msg.Buttons,
+					X:           int(msg.X),
+					Y:           int(msg.Y),
+					Width:       c.frameSize.X,
+					Height:      c.frameSize.Y,
+					Orientation: c.orientation,
+				}
+				c.mu.Unlock()
+				c.srv.Input.Pointer(e)
+			}
+		case 6: // ClientCutText, the clipboard is not shared
+			var msg struct {
+				_      [3]byte
+				Length uint32
+			}
+			if err = binary.Read(c.br, binary.BigEndian, &msg); err != nil {
+				return err
+			}
+			if _, err = io.CopyN(io.Discard, c.br, int64(msg.Length)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("vnc: unknown client message %d", typ)
+		}
+	}
+}
+
+func (c *clientConn) setEncodings(encodings []int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.copyRect, c.tight, c.desktopSize, c.quality = false, false, false, -1
+	for _, e := range encodings {
+		switch {
+		case e == encodingCopyRect:
+			c.copyRect = true
+		case e == encodingTight:
+			c.tight = true
+		case e == encodingDesktopSize:
+			c.desktopSize = true
+		case e >= encodingQualityMin && e <= encodingQualityMax:
+			c.quality = int(e - encodingQualityMin)
+		}
+	}
+}
+
+func (c *clientConn) writeLoop(sub *minicap.Subscription, latest *image.RGBA) error {
+	frameC := sub.C()
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-c.notify:
+		case f, ok := <-frameC:
+			if !ok {
+				// the source ended, keep serving the last frame
+				frameC = nil
+				continue
+			}
+			im, err := decodeFrame(f)
+			if err != nil {
+				continue
+			}
+			latest = im
+			c.mu.Lock()
+			c.orientation, c.frameSize = f.Orientation, im.Rect.Size()
+			c.mu.Unlock()
+		}
+
+		// take the request, the viewer may send the next one while we write
+		c.mu.Lock()
+		pending, full := c.pending, c.full
+		c.pending, c.full = false, false
+		c.mu.Unlock()
+		if !pending {
+			continue
+		}
+		sent, err := c.sendUpdate(latest, full)
+		if err != nil {
+			return err
+		}
+		if !sent {
+			// nothing changed, answer with the next frame
+			c.mu.Lock()
+			c.pending = true
+			c.mu.Unlock()
+		}
+	}
+}
+
+type rect struct {
+	image.Rectangle
+	encoding int32
+	data     []byte
+}
+
+// sendUpdate sends the difference between the viewer's framebuffer and im.
+// Incremental updates without changes are not sent and stay pending.
+func (c *clientConn) sendUpdate(im *image.RGBA, full bool) (sent bool, err error) {
+	c.mu.Lock()
+	pf, copyRect, desktopSize := c.pf, c.copyRect, c.desktopSize
+	quality := -1
+	if c.tight && pf.BPP == 32 && pf.Depth == 24 {
+		quality = c.quality
+	}
+	c.mu.Unlock()
+
+	var rects []rect
+	if size := im.Rect.Size(); size != c.size {
+		if desktopSize {
+			c.mu.Lock()
+			c.size = size
+			c.mu.Unlock()
+			rects = append(rects, rect{Rectangle: image.Rectangle{Max: size}, encoding: encodingDesktopSize})
+			full = true
+		} else {
+			// the viewer can not resize, keep the size it knows
+			canvas := image.NewRGBA(image.Rectangle{Max: c.size})
+			draw.Draw(canvas, canvas.Rect, im, image.Point{}, draw.Src)
+			im = canvas
+		}
+	}
+
+	var dirty []image.Rectangle
+	if full || c.fb == nil || c.fb.Rect != im.Rect {
+		dirty = []image.Rectangle{im.Rect}
+	} else {
+		var clean []bool
+		if copyRect {
+			if band, dy, ok := detectScroll(c.fb, im); ok {
+				rects = append(rects, rect{Rectangle: band, encoding: encodingCopyRect,
+					data: []byte{0, 0, byte((band.Min.Y + dy) >> 8), byte(band.Min.Y + dy)}})
+				clean = make([]bool, im.Rect.Dy())
+				for y := band.Min.Y; y < band.Max.Y; y++ {
+					clean[y] = true
+				}
+			}
+		}
+		dirty = dirtyRects(c.fb, im, clean)
+		if len(dirty) == 0 && len(rects) == 0 {
+			return false, nil
+		}
+	}
+
+	for _, r := range dirty {
+		if quality >= 0 {
+			data, err := encodeTightJPEG(nil, im, r, quality)
+			if err != nil {
+				return false, err
+			}
+			rects = append(rects, rect{Rectangle: r, encoding: encodingTight, data: data})
+			continue
+		}
+		rects = append(rects, rect{Rectangle: r, encoding: encodingRaw, data: encodeRaw(nil, im, r, pf)})
+	}
+
+	buf := []byte{0, 0, byte(len(rects) >> 8), byte(len(rects))}
+	for _, r := range rects {
+		hdr := make([]byte, 12)
+		binary.BigEndian.PutUint16(hdr[0:], uint16(r.Min.X))
+		binary.BigEndian.PutUint16(hdr[2:], uint16(r.Min.Y))
+		binary.BigEndian.PutUint16(hdr[4:], uint16(r.Dx()))
+		binary.BigEndian.PutUint16(hdr[6:], uint16(r.Dy()))
+		binary.BigEndian.PutUint32(hdr[8:], uint32(r.encoding))
+		buf = append(buf, hdr...)
+		buf = append(buf, r.data...)
+	}
+	if _, err = c.conn.Write(buf); err != nil {
+		return false, err
+	}
+	c.fb = im
+	return true, nil
+}
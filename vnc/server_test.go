@@ -0,0 +1,215 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	minicap "github.com/openatx/go-minicap"
+	"github.com/stretchr/testify/assert"
+)
+
+func grayJPEG(t *testing.T, w, h int, v uint8) []byte {
+	im := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range im.Pix {
+		im.Pix[i] = v
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, im, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testSource replays a single frame
+func testSource(t *testing.T, data []byte) *minicap.ReplaySource {
+	buf := new(bytes.Buffer)
+	start := time.Now()
+	sw, err := minicap.NewSessionWriter(buf, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, sw.WriteFrame(&minicap.Frame{Data: data, Time: start}))
+	assert.Nil(t, sw.Flush())
+	rs, err := minicap.NewReplaySource(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Speed = 0
+	assert.Nil(t, rs.Start())
+	<-rs.Done()
+	return rs
+}
+
+type testInput struct {
+	pointers chan PointerEvent
+	keys     chan KeyEvent
+}
+
+func (ti *testInput) Pointer(e PointerEvent) { ti.pointers <- e }
+func (ti *testInput) Key(e KeyEvent)         { ti.keys <- e }
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestServeConn(t *testing.T) {
+	assert := assert.New(t)
+	srv := NewServer(testSource(t, grayJPEG(t, 40, 20, 128)))
+	input := &testInput{make(chan PointerEvent, 1), make(chan KeyEvent, 1)}
+	srv.Input = input
+
+	client, server := net.Pipe()
+	defer client.Close()
+	errC := make(chan error, 1)
+	go func() { errC <- srv.ServeConn(server) }()
+
+	assert.Equal("RFB 003.008\n", string(readN(t, client, 12)))
+	client.Write([]byte("RFB 003.008\n"))
+	assert.Equal([]byte{1, 1}, readN(t, client, 2))
+	client.Write([]byte{1})
+	assert.Equal([]byte{0, 0, 0, 0}, readN(t, client, 4))
+	client.Write([]byte{1})
+
+	init := readN(t, client, 24)
+	assert.Equal(uint16(40), binary.BigEndian.Uint16(init[0:]))
+	assert.Equal(uint16(20), binary.BigEndian.Uint16(init[2:]))
+	assert.Equal(uint8(32), init[4])
+	name := readN(t, client, int(binary.BigEndian.Uint32(init[20:])))
+	assert.Equal("minicap", string(name))
+
+	// full update with raw encoding
+	client.Write([]byte{2, 0, 0, 1, 0, 0, 0, 0})
+	client.Write([]byte{3, 0, 0, 0, 0, 0, 0, 40, 0, 20})
+	hdr := readN(t, client, 16)
+	assert.Equal(uint16(1), binary.BigEndian.Uint16(hdr[2:]))
+	assert.Equal([]byte{0, 0, 0, 0, 0, 40, 0, 20}, hdr[4:12])
+	assert.Equal(int32(encodingRaw), int32(binary.BigEndian.Uint32(hdr[12:])))
+	pixels := readN(t, client, 40*20*4)
+	assert.Equal([]byte{128, 128, 128, 0}, pixels[:4])
+
+	// input is forwarded in frame coordinates
+	client.Write([]byte{5, 1, 0, 10, 0, 5})
+	assert.Equal(PointerEvent{Buttons: 1, X: 10, Y: 5, Width: 40, Height: 20}, <-input.pointers)
+	client.Write([]byte{4, 1, 0, 0, 0, 0, 0xff, 0x0d})
+	assert.Equal(KeyEvent{Down: true, Key: 0xff0d}, <-input.keys)
+
+	// tight JPEG once a quality level is requested
+	client.Write([]byte{2, 0, 0, 2, 0, 0, 0, 7, 0xff, 0xff, 0xff, 0xe9})
+	client.Write([]byte{3, 0, 0, 0, 0, 0, 0, 40, 0, 20})
+	hdr = readN(t, client, 16)
+	assert.Equal(int32(encodingTight), int32(binary.BigEndian.Uint32(hdr[12:])))
+	assert.Equal(byte(tightJPEG), readN(t, client, 1)[0])
+	n := 0
+	for i := 0; i < 3; i++ {
+		b := readN(t, client, 1)[0]
+		if i == 2 {
+			n |= int(b) << 14
+			break
+		}
+		n |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	im, err := jpeg.Decode(bytes.NewReader(readN(t, client, n)))
+	assert.Nil(err)
+	assert.Equal(image.Rect(0, 0, 40, 20), im.Bounds())
+
+	client.Close()
+	assert.Nil(<-errC)
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	srv := NewServer(testSource(t, grayJPEG(t, 8, 8, 0)))
+	client, server := net.Pipe()
+	defer client.Close()
+	errC := make(chan error, 1)
+	go func() { errC <- srv.ServeConn(server) }()
+	readN(t, client, 12)
+	client.Write([]byte("RFB 004.000\n"))
+	assert.Equal(t, ErrUnsupportedVersion, <-errC)
+}
+
+func TestDesktopSize(t *testing.T) {
+	assert := assert.New(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &clientConn{
+		conn:        server,
+		pf:          defaultPixelFormat,
+		quality:     -1,
+		desktopSize: true,
+		size:        image.Pt(40, 20),
+		fb:          image.NewRGBA(image.Rect(0, 0, 40, 20)),
+	}
+	go c.sendUpdate(image.NewRGBA(image.Rect(0, 0, 20, 40)), false)
+
+	hdr := readN(t, client, 4)
+	assert.Equal(uint16(2), binary.BigEndian.Uint16(hdr[2:]))
+	rect := readN(t, client, 12)
+	assert.Equal([]byte{0, 0, 0, 0, 0, 20, 0, 40}, rect[:8])
+	assert.Equal(int32(encodingDesktopSize), int32(binary.BigEndian.Uint32(rect[8:])))
+	rect = readN(t, client, 12)
+	assert.Equal([]byte{0, 0, 0, 0, 0, 20, 0, 40}, rect[:8])
+	readN(t, client, 20*40*4)
+}
+
+func TestDirtyRects(t *testing.T) {
+	prev := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	cur := image.NewRGBA(prev.Rect)
+	assert.Empty(t, dirtyRects(prev, cur, nil))
+
+	cur.Set(10, 10, color.White)
+	cur.Set(70, 10, color.White)
+	cur.Set(199, 99, color.White)
+	assert.Equal(t, []image.Rectangle{
+		image.Rect(0, 0, 128, 64),
+		image.Rect(192, 64, 200, 100),
+	}, dirtyRects(prev, cur, nil))
+}
+
+func TestDetectScroll(t *testing.T) {
+	prev := image.NewRGBA(image.Rect(0, 0, 16, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 16; x++ {
+			prev.Set(x, y, color.RGBA{uint8(y), uint8(y * 7), uint8(x), 255})
+		}
+	}
+	// content moved up by 40 rows
+	cur := image.NewRGBA(prev.Rect)
+	copy(cur.Pix, prev.Pix[40*prev.Stride:])
+	band, dy, ok := detectScroll(prev, cur)
+	assert.True(t, ok)
+	assert.Equal(t, 40, dy)
+	assert.Equal(t, image.Rect(0, 0, 16, 160), band)
+
+	_, _, ok = detectScroll(prev, prev)
+	assert.False(t, ok)
+}
+
+func TestEncodeRaw(t *testing.T) {
+	im := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	im.Set(0, 0, color.RGBA{255, 0, 255, 255})
+	assert.Equal(t, []byte{255, 0, 255, 0}, encodeRaw(nil, im, im.Rect, defaultPixelFormat))
+
+	rgb565 := PixelFormat{BPP: 16, Depth: 16, BigEndian: 1, TrueColour: 1,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+	assert.Equal(t, []byte{0xf8, 0x1f}, encodeRaw(nil, im, im.Rect, rgb565))
+}
+
+func TestCompactLength(t *testing.T) {
+	assert.Equal(t, []byte{0x7f}, appendCompactLength(nil, 127))
+	assert.Equal(t, []byte{0x80, 0x01}, appendCompactLength(nil, 128))
+	assert.Equal(t, []byte{0x80, 0x80, 0x01}, appendCompactLength(nil, 1<<14))
+}
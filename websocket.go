@@ -0,0 +1,338 @@
+package minicap
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsMessage is a control message sent by a websocket client as JSON text.
+//
+//	{"type": "pause"}
+//	{"type": "resume"}
+//	{"type": "scale", "value": 0.5}    resize frames, 1 for original size
+//	{"type": "quality", "value": 60}   re-encode frames with JPEG quality, 0 to pass through
+//	{"type": "keyframe"}               send the latest frame right now
+//	{"type": "screenshot"}             send the latest frame in original size and quality
+//
+// With an input backend the client can control the device as well. x and y
+// are pixels of the frames the client receives, they are mapped back to the
+// screen for the scale chosen by the client and Options.Crop. Input the
+// backend fails to send is logged.
+//
+//	{"type": "touchDown", "contact": 0, "x": 120, "y": 300}
+//	{"type": "touchMove", "contact": 0, "x": 130, "y": 320}
+//	{"type": "touchUp", "contact": 0}
+//	{"type": "key", "key": "back"}     a name of Keycodes, or "value" with an android key code
+//	{"type": "text", "text": "hello"}
+//	{"type": "back"}, {"type": "home"}
+type wsMessage struct {
+	Type    string  `json:"type"`
+	Value   float64 `json:"value,omitempty"`
+	Contact int     `json:"contact,omitempty"`
+	X       float64 `json:"x,omitempty"`
+	Y       float64 `json:"y,omitempty"`
+	Key     string  `json:"key,omitempty"`
+	Text    string  `json:"text,omitempty"`
+}
+
+// WSInfo is sent as JSON text on connect, and whenever the size,
+// orientation or frame rate of the stream changes.
+// Frames are sent as binary JPEG messages.
+type WSInfo struct {
+	Type        string `json:"type"` // "info", or "screenshot" right before a screenshot frame
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Orientation int    `json:"orientation"`
+	FPS         int    `json:"fps"`
+	ScreenOff   bool   `json:"screenOff,omitempty"` // black or stalled frames, the screen is likely off
+}
+
+// WebSocketHandler streams the screen of a capturing Service to websocket
+// clients. Every client has its own pause, scale and quality settings.
+type WebSocketHandler struct {
+	Upgrader websocket.Upgrader
+	// Pipeline, if set, builds the frame processing of every client,
+	// it runs before the scale and quality chosen by the client.
+	Pipeline func() *Pipeline
+	// Input receives the touch, key and text messages of clients,
+	// nil makes the stream view only.
+	Input InputBackend
+
+	s *Service
+}
+
+func NewWebSocketHandler(s *Service) *WebSocketHandler {
+	return &WebSocketHandler{s: s}
+}
+
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already replied with an error
+	}
+	defer conn.Close()
+	c := &wsClient{
+		s:     h.s,
+		conn:  conn,
+		scale: 1,
+		ctx:   r.Context(),
+	}
+	if h.Pipeline != nil {
+		c.pipeline = h.Pipeline()
+	}
+	if h.Input != nil {
+		// input can be slow, keep it off the frame loop but in order
+		inputC := make(chan func() error, 64)
+		defer close(inputC)
+		go func() {
+			for send := range inputC {
+				if err := send(); err != nil {
+					h.s.logger().Warn("send websocket input", "err", err)
+				}
+			}
+		}()
+		c.input, c.inputC = h.Input, inputC
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	msgC := make(chan wsMessage, 8)
+	go func() {
+		defer close(msgC)
+		for {
+			_, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg wsMessage
+			if json.Unmarshal(p, &msg) != nil {
+				continue
+			}
+			select {
+			case msgC <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sub := h.s.Subscribe(1)
+	defer sub.Close()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// last is kept for keyframes, screenshots and input, with its reference
+	last := h.s.LastFrame()
+	defer func() {
+		if last != nil {
+			last.Release()
+		}
+	}()
+	if last != nil {
+		if err := c.sendFrame(last); err != nil {
+			return
+		}
+	}
+	for {
+		var err error
+		select {
+		case f, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if last != nil {
+				last.Release()
+			}
+			last = f
+			if !c.paused {
+				err = c.sendFrame(f)
+			}
+		case msg, ok := <-msgC:
+			if !ok {
+				return
+			}
+			err = c.handle(msg, last)
+		case <-ticker.C:
+			// a screen turned off may stop the frames, tell it without one
+			fps := c.frameCount
+			c.frameCount = 0
+			screenOff := c.s.ScreenOff()
+			if fps != c.info.FPS || screenOff != c.info.ScreenOff {
+				c.info.FPS, c.info.ScreenOff = fps, screenOff
+				err = c.sendInfo()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+type wsClient struct {
+	s          *Service
+	conn       *websocket.Conn
+	ctx        context.Context
+	pipeline   *Pipeline // set by the handler
+	output     *Pipeline // applies scale and quality
+	input      InputBackend
+	inputC     chan<- func() error
+	paused     bool
+	scale      float64
+	quality    int
+	info       WSInfo
+	frameCount int
+}
+
+func (c *wsClient) handle(msg wsMessage, last *Frame) error {
+	switch msg.Type {
+	case "pause":
+		c.paused = true
+	case "resume":
+		c.paused = false
+	case "scale":
+		if msg.Value > 0 && msg.Value <= 1 {
+			c.scale = msg.Value
+			c.output = nil
+		}
+	case "quality":
+		if msg.Value >= 0 && msg.Value <= 100 {
+			c.quality = int(msg.Value)
+			c.output = nil
+		}
+	case "keyframe":
+		if last != nil {
+			return c.sendFrame(last)
+		}
+	case "screenshot":
+		if last != nil {
+			return c.sendScreenshot(last)
+		}
+	default:
+		c.handleInput(msg, last)
+	}
+	return nil
+}
+
+// handleInput queues input messages for the input backend
+func (c *wsClient) handleInput(msg wsMessage, last *Frame) {
+	if c.input == nil {
+		return
+	}
+	in := c.input
+	var send func() error
+	switch msg.Type {
+	case "touchDown":
+		p := c.toScreen(msg.X, msg.Y, last)
+		send = func() error { return in.TouchDown(msg.Contact, p) }
+	case "touchMove":
+		p := c.toScreen(msg.X, msg.Y, last)
+		send = func() error { return in.TouchMove(msg.Contact, p) }
+	case "touchUp":
+		send = func() error { return in.TouchUp(msg.Contact) }
+	case "key":
+		keycode, ok := Keycodes[msg.Key]
+		if !ok {
+			keycode = int(msg.Value)
+		}
+		if keycode <= 0 {
+			return
+		}
+		send = func() error { return in.Key(keycode) }
+	case "back", "home":
+		keycode := Keycodes[msg.Type]
+		send = func() error { return in.Key(keycode) }
+	case "text":
+		send = func() error { return in.Text(msg.Text) }
+	default:
+		return
+	}
+	select {
+	case c.inputC <- send:
+	case <-c.ctx.Done():
+	}
+}
+
+// toScreen maps a point of the frames sent to the client back to the screen
+func (c *wsClient) toScreen(x, y float64, last *Frame) image.Point {
+	scaleX, scaleY := 1.0, 1.0
+	if last != nil && c.info.Width > 0 && c.info.Height > 0 {
+		if size, err := last.Size(); err == nil {
+			scaleX = float64(size.X) / float64(c.info.Width)
+			scaleY = float64(size.Y) / float64(c.info.Height)
+		}
+	}
+	p := image.Pt(int(x*scaleX+0.5), int(y*scaleY+0.5))
+	if last != nil && !c.s.crop.Empty() {
+		// frames start at the corner of the crop in their orientation
+		info := c.s.DisplayInfo()
+		natural := image.Pt(info.Width, info.Height)
+		p = p.Add(NaturalRectToFrame(c.s.crop, natural, last.Orientation).Min)
+	}
+	return p
+}
+
+// encode returns the JPEG to send for f and its size, nil if f was dropped.
+// Frames are passed through unless changed by a pipeline, scale or quality.
+func (c *wsClient) encode(f *Frame) (data []byte, size image.Point, err error) {
+	if c.pipeline != nil {
+		if f, err = c.pipeline.Process(c.ctx, f); err != nil || f == nil {
+			return
+		}
+	}
+	if c.scale != 1 || c.quality > 0 {
+		if c.output == nil {
+			c.output = NewPipeline(ResizeStage(c.scale), EncodeStage(c.quality))
+		}
+		if f, err = c.output.Process(c.ctx, f); err != nil {
+			return
+		}
+	}
+	size, err = f.Size()
+	return f.Data, size, err
+}
+
+func (c *wsClient) sendFrame(f *Frame) error {
+	data, size, err := c.encode(f)
+	if err != nil || data == nil {
+		return nil // skip undecodable and dropped frames
+	}
+	screenOff := c.s.ScreenOff()
+	if size.X != c.info.Width || size.Y != c.info.Height || f.Orientation != c.info.Orientation ||
+		screenOff != c.info.ScreenOff || c.info.Type == "" {
+		c.info.Width, c.info.Height = size.X, size.Y
+		c.info.Orientation = f.Orientation
+		c.info.ScreenOff = screenOff
+		if err = c.sendInfo(); err != nil {
+			return err
+		}
+	}
+	c.frameCount++
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *wsClient) sendInfo() error {
+	c.info.Type = "info"
+	return c.conn.WriteJSON(c.info)
+}
+
+func (c *wsClient) sendScreenshot(f *Frame) error {
+	size, err := f.Size()
+	if err != nil {
+		return nil
+	}
+	info := WSInfo{
+		Type:        "screenshot",
+		Width:       size.X,
+		Height:      size.Y,
+		Orientation: f.Orientation,
+	}
+	if err = c.conn.WriteJSON(info); err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, f.Data)
+}
@@ -0,0 +1,195 @@
+package minicap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func testJPEG(t *testing.T, w, h int) []byte {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	s.lastFrame = &Frame{Data: testJPEG(t, 40, 20), Orientation: 90}
+	ts := httptest.NewServer(NewWebSocketHandler(s))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var info WSInfo
+	assert.Nil(conn.ReadJSON(&info))
+	assert.Equal(WSInfo{Type: "info", Width: 40, Height: 20, Orientation: 90}, info)
+	mt, p, err := conn.ReadMessage()
+	assert.Nil(err)
+	assert.Equal(websocket.BinaryMessage, mt)
+	assert.Equal(s.lastFrame.Data, p, "frame should be passed through")
+
+	conn.WriteJSON(wsMessage{Type: "scale", Value: 0.5})
+	conn.WriteJSON(wsMessage{Type: "keyframe"})
+	assert.Nil(conn.ReadJSON(&info))
+	assert.Equal(20, info.Width)
+	assert.Equal(10, info.Height)
+	_, p, err = conn.ReadMessage()
+	assert.Nil(err)
+	im, err := jpeg.Decode(bytes.NewReader(p))
+	assert.Nil(err)
+	assert.Equal(image.Pt(20, 10), im.Bounds().Size())
+
+	conn.WriteJSON(wsMessage{Type: "screenshot"})
+	assert.Nil(conn.ReadJSON(&info))
+	assert.Equal("screenshot", info.Type)
+	assert.Equal(40, info.Width)
+	_, p, err = conn.ReadMessage()
+	assert.Nil(err)
+	assert.Equal(s.lastFrame.Data, p)
+}
+
+type testInputBackend struct {
+	events chan string
+}
+
+func (b *testInputBackend) TouchDown(contact int, p image.Point) error {
+	b.events <- fmt.Sprintf("down %d %v", contact, p)
+	return nil
+}
+
+func (b *testInputBackend) TouchMove(contact int, p image.Point) error {
+	b.events <- fmt.Sprintf("move %d %v", contact, p)
+	return nil
+}
+
+func (b *testInputBackend) TouchUp(contact int) error {
+	b.events <- fmt.Sprintf("up %d", contact)
+	return nil
+}
+
+func (b *testInputBackend) Key(keycode int) error {
+	b.events <- fmt.Sprintf("key %d", keycode)
+	return nil
+}
+
+func (b *testInputBackend) Text(text string) error {
+	b.events <- "text " + text
+	return nil
+}
+
+func TestWebSocketInput(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{}
+	s.lastFrame = &Frame{Data: testJPEG(t, 40, 20)}
+	input := &testInputBackend{make(chan string, 8)}
+	h := NewWebSocketHandler(s)
+	h.Input = input
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var info WSInfo
+	conn.WriteJSON(wsMessage{Type: "scale", Value: 0.5})
+	conn.WriteJSON(wsMessage{Type: "keyframe"})
+	for info.Width != 20 {
+		mt, p, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt == websocket.TextMessage {
+			assert.Nil(json.Unmarshal(p, &info))
+		}
+	}
+
+	// coordinates of the half size frames are doubled
+	conn.WriteJSON(wsMessage{Type: "touchDown", X: 5, Y: 5})
+	conn.WriteJSON(wsMessage{Type: "touchMove", Contact: 1, X: 10.4, Y: 2})
+	conn.WriteJSON(wsMessage{Type: "touchUp"})
+	conn.WriteJSON(wsMessage{Type: "key", Key: "back"})
+	conn.WriteJSON(wsMessage{Type: "key", Value: 66})
+	conn.WriteJSON(wsMessage{Type: "home"})
+	conn.WriteJSON(wsMessage{Type: "text", Text: "hello world"})
+	for _, want := range []string{
+		"down 0 (10,10)",
+		"move 1 (21,4)",
+		"up 0",
+		"key 4",
+		"key 66",
+		"key 3",
+		"text hello world",
+	} {
+		select {
+		case got := <-input.events:
+			assert.Equal(want, got)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+}
+
+type failingTextInput struct {
+	*testInputBackend
+}
+
+func (failingTextInput) Text(text string) error {
+	return errors.New("no text input")
+}
+
+func TestWebSocketInputCrop(t *testing.T) {
+	assert := assert.New(t)
+	l := &testLogger{}
+	s := &Service{log: l, crop: image.Rect(10, 100, 50, 120)}
+	s.dispInfo = DisplayInfo{Width: 100, Height: 200}
+	s.lastFrame = &Frame{Data: testJPEG(t, 40, 20)}
+	input := &testInputBackend{make(chan string, 8)}
+	h := NewWebSocketHandler(s)
+	h.Input = failingTextInput{input}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var info WSInfo
+	assert.Nil(conn.ReadJSON(&info))
+	// points of the cropped frames are offset by the crop origin
+	conn.WriteJSON(wsMessage{Type: "text", Text: "hello"})
+	conn.WriteJSON(wsMessage{Type: "touchDown", X: 5, Y: 5})
+	select {
+	case got := <-input.events:
+		assert.Equal("down 0 (15,105)", got)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for touch down")
+	}
+	assert.Equal([]string{"WARN send websocket input [err no text input]"}, l.lines)
+}
+
+func TestQuoteInputText(t *testing.T) {
+	assert.Equal(t, `'hello%sworld'`, quoteInputText("hello world"))
+	assert.Equal(t, `'it'\''s'`, quoteInputText("it's"))
+}